@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"coupon-api/models"
+	"coupon-api/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxImportSize bounds the body of an import, which is read into memory whole
+// before any row is created.
+const maxImportSize = 32 << 20
+
+// ImportCoupons reads a CSV or JSON-lines file from the request body. The
+// format comes from the format parameter or, failing that, the Content-Type.
+func (h *CouponHandler) ImportCoupons(c *gin.Context) {
+	who, ok := actor(c)
+	if !ok {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	options := models.ImportOptions{
+		Format: bulkFormat(c),
+		Mode:   models.ImportMode(c.Query("mode")),
+		DryRun: c.Query("dry_run") == "true",
+	}
+	result, err := h.service.ImportCoupons(c.Request.Body, options, who)
+	respondImport(c, result, err)
+}
+
+func (h *CouponHandler) GetImportAdapters(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"adapters": h.service.ImportAdapters()})
+}
+
+// ImportFromPlatform converts another platform's discount export with the
+// named adapter. Rows with rules that cannot be carried over fail and list
+// those rules.
+func (h *CouponHandler) ImportFromPlatform(c *gin.Context) {
+	who, ok := actor(c)
+	if !ok {
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+	options := models.ImportOptions{
+		Mode:   models.ImportMode(c.Query("mode")),
+		DryRun: c.Query("dry_run") == "true",
+	}
+	result, err := h.service.ImportFromPlatform(c.Param("adapter"), c.Request.Body, options, who)
+	respondImport(c, result, err)
+}
+
+func respondImport(c *gin.Context, result *models.ImportResult, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("import must be at most %d bytes", tooLarge.Limit)})
+	case errors.Is(err, services.ErrImportRejected):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "result": result})
+	case err != nil:
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+	case result.Created > 0:
+		c.JSON(http.StatusCreated, result)
+	default:
+		c.JSON(http.StatusOK, result)
+	}
+}
+
+// ExportCoupons streams the coupon definitions in the same formats that
+// ImportCoupons reads.
+func (h *CouponHandler) ExportCoupons(c *gin.Context) {
+	format := bulkFormat(c)
+	if format == "" {
+		format = models.BulkCSV
+	}
+	contentType := "text/csv"
+	switch format {
+	case models.BulkCSV:
+	case models.BulkJSONLines:
+		contentType = "application/x-ndjson"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrUnsupportedFormat.Error()})
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=coupons.%s", format))
+	c.Status(http.StatusOK)
+	// Headers are already sent, so a failure part way through can only cut
+	// the stream short.
+	if err := h.service.ExportCoupons(c.Writer, format, c.Query("include_archived") == "true"); err != nil {
+		c.Error(err)
+	}
+}
+
+func bulkFormat(c *gin.Context) models.BulkFormat {
+	if format := c.Query("format"); format != "" {
+		return models.BulkFormat(strings.ToLower(format))
+	}
+	switch c.ContentType() {
+	case "text/csv":
+		return models.BulkCSV
+	case "application/x-ndjson", "application/jsonl", "application/x-jsonlines":
+		return models.BulkJSONLines
+	}
+	return ""
+}
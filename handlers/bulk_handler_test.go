@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"coupon-api/models"
+	"coupon-api/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// importService reads the whole body and creates one coupon per line, or
+// rejects the import if any line says so.
+type importService struct {
+	services.CouponService
+	options models.ImportOptions
+}
+
+func (s *importService) ImportCoupons(r io.Reader, options models.ImportOptions, actor string) (*models.ImportResult, error) {
+	s.options = options
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Count(string(data), "\n")
+	result := &models.ImportResult{Format: options.Format, Total: lines, Valid: lines, Created: lines}
+	if strings.Contains(string(data), "invalid") {
+		result.Created = 0
+		return result, services.ErrImportRejected
+	}
+	return result, nil
+}
+
+func TestImportCoupons(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := &importService{}
+	router := gin.New()
+	router.POST("/coupons/import", NewCouponHandler(service).ImportCoupons)
+
+	for _, test := range []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+		format      models.BulkFormat
+	}{
+		{"created", "text/csv", "header\nrow\n", http.StatusCreated, models.BulkCSV},
+		{"nothing created", "application/x-ndjson", "", http.StatusOK, models.BulkJSONLines},
+		{"rejected", "text/csv", "header\ninvalid\n", http.StatusUnprocessableEntity, models.BulkCSV},
+		{"too large", "text/csv", strings.Repeat("row\n", maxImportSize/4+1), http.StatusRequestEntityTooLarge, models.BulkCSV},
+	} {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/coupons/import", bytes.NewBufferString(test.body))
+		request.Header.Set("Content-Type", test.contentType)
+		router.ServeHTTP(response, request)
+		if response.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, response.Code, test.want)
+		}
+		if service.options.Format != test.format {
+			t.Errorf("%s: format %q, want %q", test.name, service.options.Format, test.format)
+		}
+	}
+}
+
+// platformService knows only the example adapter.
+type platformService struct {
+	services.CouponService
+}
+
+func (platformService) ImportAdapters() []string {
+	return []string{"example"}
+}
+
+func (platformService) ImportFromPlatform(adapter string, r io.Reader, options models.ImportOptions, actor string) (*models.ImportResult, error) {
+	if adapter != "example" {
+		return nil, services.ErrUnknownAdapter
+	}
+	return &models.ImportResult{Adapter: adapter, Mode: options.Mode, DryRun: options.DryRun, CouponIDs: []uint{}, Errors: []models.ImportRowError{}}, nil
+}
+
+func TestImportFromPlatform(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	handler := NewCouponHandler(platformService{})
+	router := gin.New()
+	router.GET("/coupons/import/adapters", handler.GetImportAdapters)
+	router.POST("/coupons/import/:adapter", handler.ImportFromPlatform)
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/coupons/import/adapters", nil))
+	if response.Code != http.StatusOK || response.Body.String() != `{"adapters":["example"]}` {
+		t.Fatalf("GET adapters: %d %s, want the example adapter", response.Code, response.Body.String())
+	}
+
+	for path, want := range map[string]int{
+		"/coupons/import/example?dry_run=true": http.StatusOK,
+		"/coupons/import/other":                http.StatusNotFound,
+	} {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodPost, path, strings.NewReader("Discount Code\n")))
+		if response.Code != want {
+			t.Errorf("POST %s: status %d, want %d", path, response.Code, want)
+		}
+	}
+}
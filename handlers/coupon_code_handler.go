@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"coupon-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *CouponHandler) GenerateCodes(c *gin.Context) {
+	var request models.CodeGenerationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
+		return
+	}
+	codes, err := h.service.GenerateCodes(uint(id), &request)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"codes": codes})
+}
+
+func (h *CouponHandler) GetCouponCodes(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
+		return
+	}
+	codes, err := h.service.GetCouponCodes(uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"codes": filterCodesByStatus(codes, c.Query("status"))})
+}
+
+func (h *CouponHandler) ExportCouponCodes(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
+		return
+	}
+	codes, err := h.service.GetCouponCodes(uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	codes = filterCodesByStatus(codes, c.Query("status"))
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=coupon-%d-codes.csv", id))
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"code", "coupon_id", "status", "created_at", "redeemed_at", "redeemed_by"})
+	for _, code := range codes {
+		redeemedAt, redeemedBy := "", ""
+		if code.RedeemedAt != nil {
+			redeemedAt = code.RedeemedAt.Format(time.RFC3339)
+			redeemedBy = strconv.FormatUint(uint64(code.RedeemedBy), 10)
+		}
+		writer.Write([]string{
+			code.Code,
+			strconv.FormatUint(uint64(code.CouponID), 10),
+			string(code.Status),
+			code.CreatedAt.Format(time.RFC3339),
+			redeemedAt,
+			redeemedBy,
+		})
+	}
+	writer.Flush()
+}
+
+func filterCodesByStatus(codes []models.CouponCode, status string) []models.CouponCode {
+	if status == "" {
+		return codes
+	}
+	filtered := []models.CouponCode{}
+	for _, code := range codes {
+		if string(code.Status) == status {
+			filtered = append(filtered, code)
+		}
+	}
+	return filtered
+}
@@ -1,10 +1,15 @@
 package handlers
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"coupon-api/models"
+	"coupon-api/repositories"
+	"coupon-api/service/adapters"
 	"coupon-api/services"
 
 	"github.com/gin-gonic/gin"
@@ -24,20 +29,79 @@ func (h *CouponHandler) CreateCoupon(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.service.CreateCoupon(&coupon); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	who, ok := actor(c)
+	if !ok {
+		return
+	}
+	if err := h.service.CreateCoupon(&coupon, who); err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
+	setETag(c, &coupon)
 	c.JSON(http.StatusCreated, coupon)
 }
 
 func (h *CouponHandler) GetCoupons(c *gin.Context) {
-	coupons, err := h.service.GetAllCoupons()
+	query, err := parseCouponQuery(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, coupons)
+	page, err := h.service.ListCoupons(query)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// parseCouponQuery reads the listing filters. status takes a comma-separated
+// list; expiring_before/expiring_after are RFC 3339 timestamps.
+func parseCouponQuery(c *gin.Context) (models.CouponQuery, error) {
+	query := models.CouponQuery{
+		Type:            models.CouponType(c.Query("type")),
+		IncludeArchived: c.Query("include_archived") == "true",
+		Sort:            c.Query("sort"),
+		Cursor:          c.Query("cursor"),
+	}
+	if value := c.Query("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			switch status := models.CouponStatus(strings.TrimSpace(status)); status {
+			case models.CouponDraft, models.CouponScheduled, models.CouponActive,
+				models.CouponPaused, models.CouponExpired, models.CouponArchived:
+				query.Statuses = append(query.Statuses, status)
+			default:
+				return query, &paramError{name: "status", expected: "draft, scheduled, active, paused, expired or archived"}
+			}
+		}
+	}
+	var err error
+	if query.ExpiringBefore, err = parseTimeParam(c, "expiring_before"); err != nil {
+		return query, err
+	}
+	if query.ExpiringAfter, err = parseTimeParam(c, "expiring_after"); err != nil {
+		return query, err
+	}
+	if value := c.Query("has_remaining_uses"); value != "" {
+		remaining, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, &paramError{name: "has_remaining_uses", expected: "true or false"}
+		}
+		query.HasRemainingUses = &remaining
+	}
+	productID, err := parseIntParam(c, "product_id")
+	if err != nil {
+		return query, err
+	}
+	userID, err := parseIntParam(c, "user_id")
+	if err != nil {
+		return query, err
+	}
+	query.ProductID, query.UserID = uint(productID), uint(userID)
+	if query.Limit, err = parseIntParam(c, "limit"); err != nil {
+		return query, err
+	}
+	return query, nil
 }
 
 func (h *CouponHandler) GetCouponByID(c *gin.Context) {
@@ -51,6 +115,7 @@ func (h *CouponHandler) GetCouponByID(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "coupon not found"})
 		return
 	}
+	setETag(c, coupon)
 	c.JSON(http.StatusOK, coupon)
 }
 
@@ -65,11 +130,51 @@ func (h *CouponHandler) UpdateCoupon(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
 		return
 	}
+	version, ok := requireIfMatch(c)
+	if !ok {
+		return
+	}
+	who, ok := actor(c)
+	if !ok {
+		return
+	}
 	coupon.ID = uint(id)
-	if err := h.service.UpdateCoupon(&coupon); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	coupon.Version = version
+	if err := h.service.UpdateCoupon(&coupon, who); err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
 		return
 	}
+	setETag(c, &coupon)
+	c.JSON(http.StatusOK, coupon)
+}
+
+// PatchCoupon takes a JSON Merge Patch or a JSON Patch, chosen by the
+// Content-Type header.
+func (h *CouponHandler) PatchCoupon(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
+		return
+	}
+	version, ok := requireIfMatch(c)
+	if !ok {
+		return
+	}
+	who, ok := actor(c)
+	if !ok {
+		return
+	}
+	patch, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	coupon, err := h.service.PatchCoupon(uint(id), version, c.ContentType(), patch, who)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	setETag(c, coupon)
 	c.JSON(http.StatusOK, coupon)
 }
 
@@ -79,11 +184,19 @@ func (h *CouponHandler) DeleteCoupon(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
 		return
 	}
-	if err := h.service.DeleteCoupon(uint(id)); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	version, ok := requireIfMatch(c)
+	if !ok {
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "coupon deleted"})
+	who, ok := actor(c)
+	if !ok {
+		return
+	}
+	if err := h.service.DeleteCoupon(uint(id), version, who); err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "coupon archived"})
 }
 
 func (h *CouponHandler) GetApplicableCoupons(c *gin.Context) {
@@ -97,7 +210,47 @@ func (h *CouponHandler) GetApplicableCoupons(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"applicable_coupons": applicableCoupons})
+	nearMissCoupons, err := h.service.GetNearMissCoupons(&cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	response := gin.H{"applicable_coupons": applicableCoupons, "near_miss_coupons": nearMissCoupons}
+	if c.Query("verbose") == "true" {
+		ineligibleCoupons, err := h.service.GetIneligibleCoupons(&cart)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		response["ineligible_coupons"] = ineligibleCoupons
+	}
+	if c.Query("mode") == "best" {
+		bestDeal, err := h.service.GetBestDeal(&cart)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		response["best_deal"] = bestDeal
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *CouponHandler) ApplyBestDeal(c *gin.Context) {
+	var cart models.Cart
+	if err := c.ShouldBindJSON(&cart); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bestDeal, err := h.service.GetBestDeal(&cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if bestDeal == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrNoApplicableCoupons.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"best_deal": bestDeal})
 }
 
 func (h *CouponHandler) ApplyCoupon(c *gin.Context) {
@@ -113,8 +266,116 @@ func (h *CouponHandler) ApplyCoupon(c *gin.Context) {
 	}
 	updatedCart, err := h.service.ApplyCoupon(uint(id), &cart)
 	if err != nil {
+		respondApplyError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"updated_cart": updatedCart})
+}
+
+func (h *CouponHandler) ApplyCouponByCode(c *gin.Context) {
+	var cart models.Cart
+	if err := c.ShouldBindJSON(&cart); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	updatedCart, err := h.service.ApplyCouponByCode(c.Param("code"), &cart)
+	if err != nil {
+		respondApplyError(c, err)
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"updated_cart": updatedCart})
 }
+
+func (h *CouponHandler) ValidateCode(c *gin.Context) {
+	var cart models.Cart
+	if err := c.ShouldBindJSON(&cart); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	validation, err := h.service.ValidateCode(c.Param("code"), &cart)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, validation)
+}
+
+// actor identifies who made an admin change, for the coupon's history.
+// actor reads X-Actor for a write, and responds with an error if it names
+// one of the actors the service records for changes not made through the API.
+// Those are trusted to tell such changes apart, so a client may not use them.
+func actor(c *gin.Context) (string, bool) {
+	name := c.GetHeader("X-Actor")
+	if name == services.SyncActor || name == services.ReloadActor {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "X-Actor " + strconv.Quote(name) + " is reserved"})
+		return "", false
+	}
+	return name, true
+}
+
+func respondApplyError(c *gin.Context, err error) {
+	var ineligible *services.IneligibleError
+	if errors.As(err, &ineligible) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "reasons": ineligible.Reasons})
+		return
+	}
+	c.JSON(errorStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+}
+
+// GetReloadStatus reports whether the coupons file is watched for edits and
+// whether the last one could be loaded.
+func (h *CouponHandler) GetReloadStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.service.GetReloadStatus())
+}
+
+// errorStatus maps well-known errors to HTTP status codes and falls back to
+// the given status for everything else.
+func errorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, repositories.ErrCouponNotFound),
+		errors.Is(err, repositories.ErrReservationNotFound),
+		errors.Is(err, repositories.ErrRedemptionNotFound),
+		errors.Is(err, repositories.ErrRevisionNotFound),
+		errors.Is(err, services.ErrUnknownAdapter):
+		return http.StatusNotFound
+	case errors.Is(err, repositories.ErrReservationClosed),
+		errors.Is(err, services.ErrReservationExpired),
+		errors.Is(err, repositories.ErrRedemptionReversed):
+		return http.StatusConflict
+	case errors.Is(err, repositories.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, services.ErrUnsupportedPatch):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, services.ErrPatchFailed):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, repositories.ErrDuplicateCode),
+		errors.Is(err, repositories.ErrCouponChanged),
+		errors.Is(err, repositories.ErrUsageLimitReached),
+		errors.Is(err, repositories.ErrUserLimitReached),
+		errors.Is(err, services.ErrInvalidTransition):
+		return http.StatusConflict
+	case errors.Is(err, repositories.ErrDataFileChanged),
+		errors.Is(err, repositories.ErrDataFileLocked):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, services.ErrInvalidCode),
+		errors.Is(err, services.ErrInvalidStatus),
+		errors.Is(err, services.ErrInvalidSchedule),
+		errors.Is(err, services.ErrInvalidPatch),
+		errors.Is(err, services.ErrProtectedField),
+		errors.Is(err, services.ErrInvalidCoupon),
+		errors.Is(err, services.ErrInvalidPattern),
+		errors.Is(err, services.ErrInvalidAlphabet),
+		errors.Is(err, services.ErrCodeSpaceExhausted),
+		errors.Is(err, services.ErrInvalidTTL),
+		errors.Is(err, services.ErrNoApplicableCoupons),
+		errors.Is(err, repositories.ErrInvalidSort),
+		errors.Is(err, repositories.ErrInvalidCursor),
+		errors.Is(err, services.ErrUnsupportedFormat),
+		errors.Is(err, services.ErrInvalidImportMode),
+		errors.Is(err, services.ErrInvalidRow),
+		errors.Is(err, adapters.ErrInvalidRow),
+		errors.Is(err, repositories.ErrReversalExceeds):
+		return http.StatusBadRequest
+	}
+	return fallback
+}
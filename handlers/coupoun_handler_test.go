@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+	"coupon-api/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ineligibleService refuses every coupon for the reasons it holds.
+type ineligibleService struct {
+	services.CouponService
+	reasons []models.IneligibilityReason
+}
+
+func (s *ineligibleService) ApplyCoupon(couponID uint, cart *models.Cart) (*models.UpdatedCart, error) {
+	return nil, &services.IneligibleError{Reasons: s.reasons}
+}
+
+// codeService finds no coupon for any code and records the codes asked for.
+type codeService struct {
+	services.CouponService
+	codes []string
+}
+
+func (s *codeService) ApplyCouponByCode(code string, cart *models.Cart) (*models.UpdatedCart, error) {
+	s.codes = append(s.codes, code)
+	return nil, repositories.ErrCouponNotFound
+}
+
+func TestApplyCouponByUnknownCodeIsNotFound(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := &codeService{}
+	router := gin.New()
+	router.POST("/apply-coupon/code/:code", NewCouponHandler(service).ApplyCouponByCode)
+
+	request := httptest.NewRequest(http.MethodPost, "/apply-coupon/code/summer-10", strings.NewReader(`{"items":[{"product_id":1,"quantity":1,"price":40}]}`))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusNotFound)
+	}
+	if len(service.codes) != 1 || service.codes[0] != "summer-10" {
+		t.Fatalf("service asked for codes %q, want summer-10", service.codes)
+	}
+}
+
+func TestApplyCouponReturnsReasons(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := &ineligibleService{reasons: []models.IneligibilityReason{{Code: models.ReasonThresholdNotMet, Actual: 40.0, Required: 100.0}}}
+	router := gin.New()
+	router.POST("/apply-coupon/:id", NewCouponHandler(service).ApplyCoupon)
+
+	request := httptest.NewRequest(http.MethodPost, "/apply-coupon/1", strings.NewReader(`{"items":[{"product_id":1,"quantity":1,"price":40}]}`))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusBadRequest)
+	}
+	var body struct {
+		Reasons []models.IneligibilityReason `json:"reasons"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Reasons) != 1 || body.Reasons[0].Code != models.ReasonThresholdNotMet {
+		t.Fatalf("reasons = %+v, want one %s", body.Reasons, models.ReasonThresholdNotMet)
+	}
+}
+
+// patchService patches coupon 1, at version 2, with a merge patch only, and
+// records the patches it is asked to apply.
+type patchService struct {
+	services.CouponService
+	patches []string
+}
+
+func (s *patchService) PatchCoupon(id uint, version uint, patchType string, patch []byte, actor string) (*models.Coupon, error) {
+	s.patches = append(s.patches, string(patch))
+	switch {
+	case id != 1:
+		return nil, repositories.ErrCouponNotFound
+	case version != 2:
+		return nil, repositories.ErrVersionMismatch
+	case patchType != services.MergePatchType:
+		return nil, services.ErrUnsupportedPatch
+	}
+	return &models.Coupon{ID: id, Version: version + 1, Type: models.CartWise, Code: "SUMMER20"}, nil
+}
+
+func TestPatchCoupon(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := &patchService{}
+	router := gin.New()
+	router.PATCH("/coupons/:id", NewCouponHandler(service).PatchCoupon)
+
+	for _, test := range []struct {
+		path        string
+		ifMatch     string
+		contentType string
+		want        int
+	}{
+		{"/coupons/1", `"2"`, services.MergePatchType, http.StatusOK},
+		{"/coupons/1", `"1"`, services.MergePatchType, http.StatusPreconditionFailed},
+		{"/coupons/1", "", services.MergePatchType, http.StatusPreconditionRequired},
+		{"/coupons/1", `"2"`, "application/json", http.StatusUnsupportedMediaType},
+		{"/coupons/2", `"2"`, services.MergePatchType, http.StatusNotFound},
+	} {
+		request := httptest.NewRequest(http.MethodPatch, test.path, strings.NewReader(`{"code":"SUMMER20"}`))
+		request.Header.Set("Content-Type", test.contentType)
+		if test.ifMatch != "" {
+			request.Header.Set("If-Match", test.ifMatch)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != test.want {
+			t.Errorf("PATCH %s with If-Match %q and %s: status %d, want %d", test.path, test.ifMatch, test.contentType, response.Code, test.want)
+		}
+		if test.want == http.StatusOK && response.Header().Get("ETag") != `"3"` {
+			t.Errorf("ETag = %s, want \"3\"", response.Header().Get("ETag"))
+		}
+	}
+	if len(service.patches) != 4 || service.patches[0] != `{"code":"SUMMER20"}` {
+		t.Fatalf("service got patches %q, want the body of every request with If-Match", service.patches)
+	}
+}
+
+// listService records the query it is asked to list and finds nothing.
+type listService struct {
+	services.CouponService
+	query models.CouponQuery
+}
+
+func (s *listService) ListCoupons(query models.CouponQuery) (*models.CouponPage, error) {
+	s.query = query
+	return &models.CouponPage{Coupons: []models.Coupon{}}, nil
+}
+
+func TestGetCouponsReadsQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := &listService{}
+	router := gin.New()
+	router.GET("/coupons", NewCouponHandler(service).GetCoupons)
+
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/coupons?type=cart-wise&status=active,%20paused&has_remaining_uses=false&product_id=7&sort=-code&limit=5&expiring_before=2030-01-01T00:00:00Z", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusOK)
+	}
+	query := service.query
+	if query.Type != models.CartWise || len(query.Statuses) != 2 || query.Statuses[1] != models.CouponPaused ||
+		query.HasRemainingUses == nil || *query.HasRemainingUses || query.ProductID != 7 || query.Sort != "-code" ||
+		query.Limit != 5 || query.ExpiringBefore == nil || query.ExpiringBefore.Year() != 2030 {
+		t.Fatalf("query = %+v, want every parameter read", query)
+	}
+
+	for _, params := range []string{"status=gone", "has_remaining_uses=maybe", "limit=many", "expiring_after=tomorrow"} {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/coupons?"+params, nil))
+		if response.Code != http.StatusBadRequest {
+			t.Errorf("GET /coupons?%s: status %d, want %d", params, response.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// recordingService records the actor of each coupon created through it.
+type recordingService struct {
+	services.CouponService
+	actors []string
+}
+
+func (s *recordingService) CreateCoupon(coupon *models.Coupon, actor string) error {
+	s.actors = append(s.actors, actor)
+	coupon.ID, coupon.Version = 1, 1
+	return nil
+}
+
+func TestCreateCouponRejectsReservedActor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	service := &recordingService{}
+	router := gin.New()
+	router.POST("/coupons", NewCouponHandler(service).CreateCoupon)
+
+	for _, test := range []struct {
+		actor  string
+		status int
+	}{
+		{services.SyncActor, http.StatusBadRequest},
+		{services.ReloadActor, http.StatusBadRequest},
+		{"alice", http.StatusCreated},
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/coupons", strings.NewReader(`{"type":"cart-wise","details":{"threshold":10,"discount":10}}`))
+		request.Header.Set("X-Actor", test.actor)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("X-Actor %q: status %d, want %d", test.actor, response.Code, test.status)
+		}
+	}
+	if len(service.actors) != 1 || service.actors[0] != "alice" {
+		t.Fatalf("coupons created by %q, want only alice", service.actors)
+	}
+}
+
+// failingService fails every coupon creation with err.
+type failingService struct {
+	services.CouponService
+	err error
+}
+
+func (s *failingService) CreateCoupon(coupon *models.Coupon, actor string) error {
+	return s.err
+}
+
+func TestCreateCouponErrorStatus(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for _, test := range []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w: data/coupons.json", repositories.ErrDataFileChanged), http.StatusServiceUnavailable},
+		{fmt.Errorf("%w: data/coupons.lock", repositories.ErrDataFileLocked), http.StatusServiceUnavailable},
+		{repositories.ErrDuplicateCode, http.StatusConflict},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	} {
+		router := gin.New()
+		router.POST("/coupons", NewCouponHandler(&failingService{err: test.err}).CreateCoupon)
+		request := httptest.NewRequest(http.MethodPost, "/coupons", strings.NewReader(`{"type":"cart-wise","details":{"threshold":10,"discount":10}}`))
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != test.status {
+			t.Errorf("%v: status %d, want %d", test.err, response.Code, test.status)
+		}
+	}
+}
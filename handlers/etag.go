@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"coupon-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setETag sends the coupon's version as its entity tag.
+func setETag(c *gin.Context, coupon *models.Coupon) {
+	c.Header("ETag", strconv.Quote(strconv.FormatUint(uint64(coupon.Version), 10)))
+}
+
+// ifMatchVersion reads the version from an If-Match header. It returns 0 when
+// the header is missing or "*", which match any version.
+func ifMatchVersion(c *gin.Context) (uint, error) {
+	value := strings.TrimSpace(c.GetHeader("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+	value = strings.TrimPrefix(value, "W/")
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+	version, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || version == 0 {
+		return 0, &paramError{name: "If-Match", expected: "the ETag of the coupon"}
+	}
+	return uint(version), nil
+}
+
+// requireIfMatch reads If-Match for a write that must name the version it
+// was based on, and responds with an error if it cannot.
+func requireIfMatch(c *gin.Context) (uint, bool) {
+	if c.GetHeader("If-Match") == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header with the coupon's ETag is required"})
+		return 0, false
+	}
+	version, err := ifMatchVersion(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return 0, false
+	}
+	return version, true
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IdempotencyKeyHeader  = "Idempotency-Key"
+	maxIdempotencyKeySize = 255
+)
+
+// Idempotency makes a route safe to retry. A request that carries an
+// Idempotency-Key header is run once; a retry with the same key and the same
+// request gets the stored response replayed for as long as window lasts. A
+// reused key with a different request is rejected.
+func Idempotency(repo repositories.IdempotencyRepository, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeySize {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now().UTC()
+		record := &models.IdempotencyRecord{
+			Key:         key,
+			Fingerprint: requestFingerprint(c.Request.Method, c.Request.URL.Path, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(window),
+		}
+		existing, err := repo.BeginRequest(record)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != record.Fingerprint:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+			case existing.Status == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "a request with this Idempotency-Key is still in progress"})
+			default:
+				c.Header("Idempotent-Replayed", "true")
+				c.Data(existing.Status, "application/json; charset=utf-8", existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		// A handler that panics never answers, so the key is freed for a retry
+		// before the panic goes on to the recovery middleware.
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if err := repo.AbandonRequest(key); err != nil {
+					log.Printf("Failed to release idempotency key %q: %v", key, err)
+				}
+				panic(recovered)
+			}
+		}()
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+
+		// Server errors are not stored so that the client can retry them.
+		status := writer.Status()
+		if status >= http.StatusInternalServerError || !json.Valid(writer.body.Bytes()) {
+			err = repo.AbandonRequest(key)
+		} else {
+			err = repo.CompleteRequest(key, status, writer.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("Failed to store response for idempotency key %q: %v", key, err)
+		}
+	}
+}
+
+// requestFingerprint hashes what identifies a request. JSON bodies are
+// compacted first so that a retry that only differs in whitespace matches.
+func requestFingerprint(method string, path string, body []byte) string {
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, body); err == nil {
+		body = compacted.Bytes()
+	}
+	hash := sha256.New()
+	hash.Write([]byte(method + " " + path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recordingWriter keeps a copy of the response body as it is written.
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
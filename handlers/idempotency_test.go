@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"coupon-api/repositories"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	repo, err := repositories.NewIdempotencyRepository(filepath.Join(t.TempDir(), "idempotency_keys.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	router := gin.New()
+	router.POST("/reservations/:id/commit", Idempotency(repo, time.Hour), func(c *gin.Context) {
+		calls++
+		c.JSON(http.StatusOK, gin.H{"calls": calls})
+	})
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/reservations/1/commit", strings.NewReader(body))
+		request.Header.Set(IdempotencyKeyHeader, key)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	first := post("order-1", `{}`)
+	retry := post("order-1", `{}`)
+	if calls != 1 {
+		t.Fatalf("handler ran %d times for one key, want once", calls)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry got %d %s, want the first response %d %s replayed", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if reused := post("order-1", `{"other":true}`); reused.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("key reused with another body: status %d, want %d", reused.Code, http.StatusUnprocessableEntity)
+	}
+	if post("order-2", `{}`); calls != 2 {
+		t.Fatalf("handler ran %d times for two keys, want twice", calls)
+	}
+}
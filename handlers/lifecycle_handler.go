@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"coupon-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *CouponHandler) ActivateCoupon(c *gin.Context) {
+	h.changeStatus(c, h.service.ActivateCoupon)
+}
+
+func (h *CouponHandler) PauseCoupon(c *gin.Context) {
+	h.changeStatus(c, h.service.PauseCoupon)
+}
+
+func (h *CouponHandler) ResumeCoupon(c *gin.Context) {
+	h.changeStatus(c, h.service.ResumeCoupon)
+}
+
+func (h *CouponHandler) ArchiveCoupon(c *gin.Context) {
+	h.changeStatus(c, h.service.ArchiveCoupon)
+}
+
+func (h *CouponHandler) RestoreCoupon(c *gin.Context) {
+	h.changeStatus(c, h.service.RestoreCoupon)
+}
+
+func (h *CouponHandler) changeStatus(c *gin.Context, change func(id uint, version uint, actor string) (*models.Coupon, error)) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
+		return
+	}
+	version, ok := requireIfMatch(c)
+	if !ok {
+		return
+	}
+	who, ok := actor(c)
+	if !ok {
+		return
+	}
+	coupon, err := change(uint(id), version, who)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	setETag(c, coupon)
+	c.JSON(http.StatusOK, coupon)
+}
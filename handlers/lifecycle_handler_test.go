@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+	"coupon-api/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// lifecycleService only knows coupon 1, which is archived and at version 3.
+type lifecycleService struct {
+	services.CouponService
+}
+
+func (lifecycleService) ResumeCoupon(id uint, version uint, actor string) (*models.Coupon, error) {
+	if id != 1 {
+		return nil, repositories.ErrCouponNotFound
+	}
+	if version != 0 && version != 3 {
+		return nil, repositories.ErrVersionMismatch
+	}
+	return nil, fmt.Errorf("%w: coupon is archived and cannot become active", services.ErrInvalidTransition)
+}
+
+func TestChangeStatusErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/coupons/:id/resume", NewCouponHandler(lifecycleService{}).ResumeCoupon)
+
+	for _, test := range []struct {
+		path    string
+		ifMatch string
+		want    int
+	}{
+		{"/coupons/1/resume", `"3"`, http.StatusConflict},
+		{"/coupons/1/resume", "*", http.StatusConflict},
+		{"/coupons/1/resume", `"2"`, http.StatusPreconditionFailed},
+		{"/coupons/1/resume", "", http.StatusPreconditionRequired},
+		{"/coupons/1/resume", "latest", http.StatusBadRequest},
+		{"/coupons/2/resume", `"3"`, http.StatusNotFound},
+		{"/coupons/one/resume", `"3"`, http.StatusBadRequest},
+	} {
+		request := httptest.NewRequest(http.MethodPost, test.path, nil)
+		if test.ifMatch != "" {
+			request.Header.Set("If-Match", test.ifMatch)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != test.want {
+			t.Errorf("POST %s with If-Match %q: status %d, want %d", test.path, test.ifMatch, response.Code, test.want)
+		}
+	}
+}
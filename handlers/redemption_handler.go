@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"coupon-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *CouponHandler) GetCouponRedemptions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
+		return
+	}
+	query, err := parseRedemptionQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query.CouponID = uint(id)
+	h.listRedemptions(c, query)
+}
+
+func (h *CouponHandler) GetUserRedemptions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return
+	}
+	query, err := parseRedemptionQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	query.UserID = uint(id)
+	h.listRedemptions(c, query)
+}
+
+func (h *CouponHandler) GetRedemption(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid redemption ID"})
+		return
+	}
+	redemption, err := h.service.GetRedemption(uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, redemption)
+}
+
+func (h *CouponHandler) GetReversals(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid redemption ID"})
+		return
+	}
+	reversals, err := h.service.GetReversals(uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reversals": reversals})
+}
+
+// ReverseRedemption accepts an empty body to reverse everything that is left
+// of the redemption.
+func (h *CouponHandler) ReverseRedemption(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid redemption ID"})
+		return
+	}
+	var request models.ReversalRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	reversal, err := h.service.ReverseRedemption(uint(id), &request)
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, reversal)
+}
+
+func (h *CouponHandler) listRedemptions(c *gin.Context, query models.RedemptionQuery) {
+	page, err := h.service.ListRedemptions(query)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+// parseRedemptionQuery reads the from/to (RFC 3339) time range and the
+// offset/limit pagination parameters.
+func parseRedemptionQuery(c *gin.Context) (models.RedemptionQuery, error) {
+	var query models.RedemptionQuery
+	var err error
+	if query.From, err = parseTimeParam(c, "from"); err != nil {
+		return query, err
+	}
+	if query.To, err = parseTimeParam(c, "to"); err != nil {
+		return query, err
+	}
+	if query.Offset, err = parseIntParam(c, "offset"); err != nil {
+		return query, err
+	}
+	if query.Limit, err = parseIntParam(c, "limit"); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+func parseTimeParam(c *gin.Context, name string) (*time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, &paramError{name: name, expected: "an RFC 3339 timestamp"}
+	}
+	return &t, nil
+}
+
+func parseIntParam(c *gin.Context, name string) (int, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, &paramError{name: name, expected: "a non-negative integer"}
+	}
+	return n, nil
+}
+
+type paramError struct {
+	name     string
+	expected string
+}
+
+func (e *paramError) Error() string {
+	return "invalid " + e.name + ": expected " + e.expected
+}
@@ -0,0 +1,99 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"coupon-api/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+func (h *CouponHandler) ReserveCoupon(c *gin.Context) {
+	var request models.ReservationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid coupon ID"})
+		return
+	}
+	reservation, err := h.service.ReserveCoupon(uint(id), &request)
+	if err != nil {
+		respondApplyError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, reservation)
+}
+
+func (h *CouponHandler) ReserveCouponByCode(c *gin.Context) {
+	var request models.ReservationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	reservation, err := h.service.ReserveCouponByCode(c.Param("code"), &request)
+	if err != nil {
+		respondApplyError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, reservation)
+}
+
+func (h *CouponHandler) ReserveBestDeal(c *gin.Context) {
+	var request models.ReservationRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	bestDeal, err := h.service.ReserveBestDeal(&request)
+	if err != nil {
+		respondApplyError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"best_deal": bestDeal})
+}
+
+func (h *CouponHandler) GetReservation(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reservation ID"})
+		return
+	}
+	reservation, err := h.service.GetReservation(uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reservation)
+}
+
+func (h *CouponHandler) CommitReservation(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reservation ID"})
+		return
+	}
+	reservation, err := h.service.CommitReservation(uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reservation)
+}
+
+func (h *CouponHandler) ReleaseReservation(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid reservation ID"})
+		return
+	}
+	reservation, err := h.service.ReleaseReservation(uint(id))
+	if err != nil {
+		c.JSON(errorStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, reservation)
+}
@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"coupon-api/service/adapters"
 	"coupon-api/service/strategies"
 
 	"coupon-api/handlers"
@@ -13,17 +21,86 @@ import (
 )
 
 func main() {
-	// Initialize the repository
-	couponRepo, err := repositories.NewCouponRepository("data/coupons.json")
+	// Initialize the repository. STORAGE_BACKEND=sqlite keeps coupons in
+	// data/coupons.db instead of the JSON file; a new database starts with
+	// the coupons from the JSON file.
+	var couponRepo repositories.CouponRepository
+	var err error
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", "json":
+		couponRepo, err = repositories.NewCouponRepository("data/coupons.json", services.ValidateCoupon)
+	case "sqlite":
+		couponRepo, err = repositories.NewSQLiteCouponRepository("data/coupons.db", "data/coupons.json")
+	default:
+		log.Fatalf("Invalid STORAGE_BACKEND %q: expected json or sqlite", backend)
+	}
 	if err != nil {
 		log.Fatalf("Failed to initialize repository: %v", err)
 	}
 
+	// Initialize the single-use code repository
+	codeRepo, err := repositories.NewCouponCodeRepository("data/coupon_codes.jsonl")
+	if err != nil {
+		log.Fatalf("Failed to initialize code repository: %v", err)
+	}
+
+	// Initialize the redemption ledger
+	redemptionRepo, err := repositories.NewRedemptionRepository("data/redemptions.jsonl")
+	if err != nil {
+		log.Fatalf("Failed to initialize redemption repository: %v", err)
+	}
+
+	// Initialize the reservation repository
+	reservationRepo, err := repositories.NewReservationRepository("data/reservations.jsonl")
+	if err != nil {
+		log.Fatalf("Failed to initialize reservation repository: %v", err)
+	}
+
+	// Initialize the coupon version history
+	historyRepo, err := repositories.NewCouponHistoryRepository("data/coupon_revisions.jsonl")
+	if err != nil {
+		log.Fatalf("Failed to initialize history repository: %v", err)
+	}
+
+	// Initialize the idempotency key store
+	idempotencyRepo, err := repositories.NewIdempotencyRepository("data/idempotency_keys.jsonl")
+	if err != nil {
+		log.Fatalf("Failed to initialize idempotency repository: %v", err)
+	}
+
 	// Initialize the strategy factory
 	strategyFactory := strategies.NewCouponStrategyFactory()
 
+	// Initialize the import adapters, one per column-mapping file in
+	// IMPORT_MAPPINGS_DIR, or in the mappings shipped in docs/import_mappings
+	mappingDir := os.Getenv("IMPORT_MAPPINGS_DIR")
+	if mappingDir == "" {
+		mappingDir = "docs/import_mappings"
+	}
+	adapterRegistry, err := adapters.NewImportAdapterRegistry(mappingDir)
+	if err != nil {
+		log.Fatalf("Failed to load import mappings: %v", err)
+	}
+
 	// Initialize the service
-	couponService := services.NewCouponService(couponRepo, strategyFactory)
+	couponService := services.NewCouponService(couponRepo, codeRepo, redemptionRepo, reservationRepo, historyRepo, strategyFactory, adapterRegistry)
+
+	// "sync plan|apply <dir>" reconciles coupons with a directory of
+	// definitions instead of starting the server
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		code := runSync(couponService, os.Args[2:])
+		if err := couponRepo.Close(); err != nil {
+			log.Printf("Failed to close repository: %v", err)
+		}
+		os.Exit(code)
+	}
+
+	// Count only the uses held by recorded reservations, and reclaim those
+	// held by abandoned checkouts
+	if err := couponService.RestoreReservedUsage(); err != nil {
+		log.Fatalf("Failed to restore reserved coupon uses: %v", err)
+	}
+	stopSweeper := services.StartReservationSweeper(couponService, 30*time.Second)
 
 	// Initialize the handler
 	couponHandler := handlers.NewCouponHandler(couponService)
@@ -31,19 +108,80 @@ func main() {
 	// Set up the router
 	router := gin.Default()
 
+	// Stored responses are replayed for retries within this window
+	idempotencyWindow := 24 * time.Hour
+	if value := os.Getenv("IDEMPOTENCY_WINDOW"); value != "" {
+		idempotencyWindow, err = time.ParseDuration(value)
+		if err != nil || idempotencyWindow <= 0 {
+			log.Fatalf("Invalid IDEMPOTENCY_WINDOW %q", value)
+		}
+	}
+	idempotent := handlers.Idempotency(idempotencyRepo, idempotencyWindow)
+
 	// Define the routes
 	router.POST("/coupons", couponHandler.CreateCoupon)
 	router.GET("/coupons", couponHandler.GetCoupons)
+	router.POST("/coupons/import", couponHandler.ImportCoupons)
+	router.GET("/coupons/export", couponHandler.ExportCoupons)
+	router.GET("/coupons/import/adapters", couponHandler.GetImportAdapters)
+	router.POST("/coupons/import/:adapter", couponHandler.ImportFromPlatform)
 	router.GET("/coupons/:id", couponHandler.GetCouponByID)
 	router.PUT("/coupons/:id", couponHandler.UpdateCoupon)
+	router.PATCH("/coupons/:id", couponHandler.PatchCoupon)
 	router.DELETE("/coupons/:id", couponHandler.DeleteCoupon)
+	router.POST("/coupons/:id/activate", couponHandler.ActivateCoupon)
+	router.POST("/coupons/:id/pause", couponHandler.PauseCoupon)
+	router.POST("/coupons/:id/resume", couponHandler.ResumeCoupon)
+	router.POST("/coupons/:id/archive", couponHandler.ArchiveCoupon)
+	router.POST("/coupons/:id/restore", couponHandler.RestoreCoupon)
+	router.GET("/coupons/:id/versions", couponHandler.GetCouponVersions)
+	router.GET("/coupons/:id/versions/:version", couponHandler.GetCouponVersion)
+	router.POST("/coupons/:id/rollback", couponHandler.RollbackCoupon)
+	router.POST("/coupons/:id/codes", couponHandler.GenerateCodes)
+	router.GET("/coupons/:id/codes", couponHandler.GetCouponCodes)
+	router.GET("/coupons/:id/codes/export", couponHandler.ExportCouponCodes)
+	router.GET("/coupons/:id/redemptions", couponHandler.GetCouponRedemptions)
+	router.GET("/users/:id/redemptions", couponHandler.GetUserRedemptions)
+	router.GET("/redemptions/:id", couponHandler.GetRedemption)
+	router.GET("/redemptions/:id/reversals", couponHandler.GetReversals)
+	router.POST("/redemptions/:id/reversals", idempotent, couponHandler.ReverseRedemption)
 	router.POST("/applicable-coupons", couponHandler.GetApplicableCoupons)
-	router.POST("/apply-coupon/:id", couponHandler.ApplyCoupon)
+	router.POST("/apply-coupon/:id", idempotent, couponHandler.ApplyCoupon)
+	router.POST("/apply-coupon/code/:code", idempotent, couponHandler.ApplyCouponByCode)
+	router.POST("/validate-code/:code", couponHandler.ValidateCode)
+	router.POST("/apply-best-deal", idempotent, couponHandler.ApplyBestDeal)
+	router.POST("/coupons/:id/reservations", idempotent, couponHandler.ReserveCoupon)
+	router.POST("/reservations/code/:code", idempotent, couponHandler.ReserveCouponByCode)
+	router.POST("/reservations/best-deal", idempotent, couponHandler.ReserveBestDeal)
+	router.GET("/reservations/:id", couponHandler.GetReservation)
+	router.POST("/reservations/:id/commit", idempotent, couponHandler.CommitReservation)
+	router.POST("/reservations/:id/release", idempotent, couponHandler.ReleaseReservation)
+	router.GET("/admin/reload-status", couponHandler.GetReloadStatus)
 	// Serve the swagger.yaml file
 	router.Static("/docs", "./docs")
 
 	// Serve the Swagger UI files
 	router.Static("/swagger", "./swagger-ui")
 	// Start the server
-	router.Run(":8080")
+	server := &http.Server{Addr: ":8080", Handler: router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// On SIGINT or SIGTERM, finish the requests in progress and close the
+	// repository, so its data files are released for the next start
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish requests in progress: %v", err)
+	}
+	stopSweeper()
+	if err := couponRepo.Close(); err != nil {
+		log.Printf("Failed to close repository: %v", err)
+	}
 }
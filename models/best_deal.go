@@ -0,0 +1,10 @@
+package models
+
+type BestDeal struct {
+	CouponIDs      []uint             `json:"coupon_ids"`
+	TotalDiscount  float64            `json:"total_discount"`
+	Breakdown      []ApplicableCoupon `json:"breakdown"` // Each coupon's share of the total discount
+	UpdatedCart    *UpdatedCart       `json:"updated_cart"`
+	Exhaustive     bool               `json:"exhaustive"` // False when the search budget ran out before all combinations were tried
+	ReservationIDs []uint             `json:"reservation_ids,omitempty"`
+}
@@ -0,0 +1,42 @@
+package models
+
+type BulkFormat string
+
+const (
+	BulkCSV       BulkFormat = "csv"
+	BulkJSONLines BulkFormat = "jsonl"
+)
+
+// ImportMode decides what happens to the valid rows of an import that also
+// has invalid ones.
+type ImportMode string
+
+const (
+	ImportAllOrNothing ImportMode = "all_or_nothing"
+	ImportBestEffort   ImportMode = "best_effort"
+)
+
+type ImportOptions struct {
+	Format BulkFormat
+	Mode   ImportMode
+	DryRun bool // Validate every row but create nothing
+}
+
+type ImportRowError struct {
+	Line        int      `json:"line"` // Line of the row in the uploaded file
+	Code        string   `json:"code,omitempty"`
+	Error       string   `json:"error"`
+	Unsupported []string `json:"unsupported,omitempty"` // Rules of an external discount with no equivalent here
+}
+
+type ImportResult struct {
+	Format    BulkFormat       `json:"format,omitempty"`
+	Adapter   string           `json:"adapter,omitempty"` // Set for imports from another platform's export
+	Mode      ImportMode       `json:"mode"`
+	DryRun    bool             `json:"dry_run"`
+	Total     int              `json:"total"`
+	Valid     int              `json:"valid"`
+	Created   int              `json:"created"`
+	CouponIDs []uint           `json:"coupon_ids"`
+	Errors    []ImportRowError `json:"errors"`
+}
@@ -0,0 +1,10 @@
+package models
+
+type CodeValidation struct {
+	Code     string                `json:"code"`
+	Valid    bool                  `json:"valid"`
+	CouponID uint                  `json:"coupon_id,omitempty"`
+	Type     CouponType            `json:"type,omitempty"`
+	Discount float64               `json:"discount"`
+	Reasons  []IneligibilityReason `json:"reasons,omitempty"`
+}
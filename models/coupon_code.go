@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+type CodeStatus string
+
+const (
+	CodeAvailable CodeStatus = "available"
+	CodeReserved  CodeStatus = "reserved"
+	CodeRedeemed  CodeStatus = "redeemed"
+)
+
+// CouponCode is a single-use code that redeems its parent coupon once.
+type CouponCode struct {
+	Code       string     `json:"code"`
+	CouponID   uint       `json:"coupon_id"`
+	Status     CodeStatus `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RedeemedAt *time.Time `json:"redeemed_at,omitempty"`
+	RedeemedBy uint       `json:"redeemed_by,omitempty"`
+}
+
+type CodeGenerationRequest struct {
+	Count    int    `json:"count" binding:"required,min=1,max=100000"`
+	Pattern  string `json:"pattern,omitempty"`  // '#' is replaced by a random character; defaults to "####-####"
+	Alphabet string `json:"alphabet,omitempty"` // Defaults to letters and digits without look-alikes
+}
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// CouponQuery filters, sorts and pages the coupon listing. Zero values match
+// everything.
+type CouponQuery struct {
+	Type             CouponType
+	Statuses         []CouponStatus
+	ExpiringBefore   *time.Time
+	ExpiringAfter    *time.Time
+	HasRemainingUses *bool
+	ProductID        uint
+	UserID           uint
+	IncludeArchived  bool   // Archived coupons are left out unless asked for by status or this flag
+	Sort             string // A CouponSortField, prefixed with "-" for descending order
+	Cursor           string
+	Limit            int
+}
+
+type CouponSortField string
+
+const (
+	SortByID             CouponSortField = "id"
+	SortByCode           CouponSortField = "code"
+	SortByType           CouponSortField = "type"
+	SortByExpirationDate CouponSortField = "expiration_date"
+	SortByUsedCount      CouponSortField = "used_count"
+)
+
+type CouponPage struct {
+	Coupons    []Coupon `json:"coupons"`
+	Total      int      `json:"total"`                 // Matching coupons across all pages
+	NextCursor string   `json:"next_cursor,omitempty"` // Empty on the last page
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+type RevisionAction string
+
+const (
+	RevisionCreated       RevisionAction = "created"
+	RevisionUpdated       RevisionAction = "updated"
+	RevisionStatusChanged RevisionAction = "status_changed"
+	RevisionRolledBack    RevisionAction = "rolled_back"
+)
+
+// CouponRevision is one version of a coupon's definition. Usage counters are
+// not part of the definition and are left out of Coupon and Changes.
+type CouponRevision struct {
+	CouponID     uint           `json:"coupon_id"`
+	Version      uint           `json:"version"`
+	Action       RevisionAction `json:"action"`
+	Actor        string         `json:"actor,omitempty"`
+	CreatedAt    time.Time      `json:"created_at"`
+	RolledBackTo uint           `json:"rolled_back_to,omitempty"`
+	Changes      []FieldChange  `json:"changes,omitempty"` // Against the previous version
+	Coupon       Coupon         `json:"coupon"`
+}
+
+// FieldChange is one changed field. Nested fields, such as those in details,
+// are named with dots.
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+type RollbackRequest struct {
+	Version uint `json:"version" binding:"required"`
+}
@@ -1,6 +1,10 @@
 package models
 
-import "time"
+import (
+	"strings"
+	"time"
+	"unicode"
+)
 
 type CouponType string
 
@@ -15,12 +19,117 @@ const (
 	Referral       CouponType = "referral"
 )
 
+// CouponStatus is where a coupon is in its lifecycle. Draft, paused and
+// archived are set explicitly; scheduled, active and expired follow from
+// ValidFrom and ExpirationDate (see StatusAt).
+type CouponStatus string
+
+const (
+	CouponDraft     CouponStatus = "draft"
+	CouponScheduled CouponStatus = "scheduled"
+	CouponActive    CouponStatus = "active"
+	CouponPaused    CouponStatus = "paused"
+	CouponExpired   CouponStatus = "expired"
+	CouponArchived  CouponStatus = "archived"
+)
+
 type Coupon struct {
-	ID             uint        `json:"id"`
-	Type           CouponType  `json:"type" binding:"required"`
-	Details        interface{} `json:"details" binding:"required"`
-	ExpirationDate *time.Time  `json:"expiration_date"`
-	UsageLimit     uint        `json:"usage_limit,omitempty"`
-	UsedCount      uint        `json:"used_count,omitempty"`
-	Users          []uint      `json:"users,omitempty"` // User IDs for user-specific coupons
+	ID             uint         `json:"id"`
+	Code           string       `json:"code,omitempty"`
+	Type           CouponType   `json:"type" binding:"required"`
+	Status         CouponStatus `json:"status,omitempty"`
+	Version        uint         `json:"version"` // Revision of the definition, see CouponRevision
+	Details        interface{}  `json:"details" binding:"required"`
+	ValidFrom      *time.Time   `json:"valid_from,omitempty"`
+	ExpirationDate *time.Time   `json:"expiration_date"`
+	UsageLimit     uint         `json:"usage_limit,omitempty"`
+	UsedCount      uint         `json:"used_count,omitempty"`
+	ReservedCount  uint         `json:"reserved_count,omitempty"` // Uses held by pending reservations
+	PerUserLimit   uint         `json:"per_user_limit,omitempty"` // Maximum redemptions per user, 0 for no limit
+	Users          []uint       `json:"users,omitempty"`          // User IDs for user-specific coupons
+	Stackable      bool         `json:"stackable,omitempty"`      // Can be combined with other stackable coupons
+	ExternalKey    string       `json:"external_key,omitempty"`   // Key of the definition file a synced coupon is managed by
+}
+
+// StatusAt returns the coupon's status at the given time. Coupons saved
+// before statuses existed have none and count as active.
+func (c *Coupon) StatusAt(now time.Time) CouponStatus {
+	switch c.Status {
+	case CouponDraft, CouponPaused, CouponArchived:
+		return c.Status
+	}
+	if c.ExpirationDate != nil && now.After(*c.ExpirationDate) {
+		return CouponExpired
+	}
+	if c.ValidFrom != nil && now.Before(*c.ValidFrom) {
+		return CouponScheduled
+	}
+	return CouponActive
+}
+
+// HasRemainingUses reports whether the usage limit, if any, leaves room for
+// another use.
+func (c *Coupon) HasRemainingUses() bool {
+	return c.UsageLimit == 0 || c.UsedCount+c.ReservedCount < c.UsageLimit
+}
+
+// TargetsUser reports whether the coupon is assigned to the user.
+func (c *Coupon) TargetsUser(userID uint) bool {
+	for _, id := range c.Users {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// TargetsProduct reports whether the coupon's details name the product,
+// wherever a product_id appears in them.
+func (c *Coupon) TargetsProduct(productID uint) bool {
+	return mentionsProduct(c.Details, float64(productID))
+}
+
+func mentionsProduct(value interface{}, productID float64) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if id, ok := field.(float64); ok && key == "product_id" && id == productID {
+				return true
+			}
+			if mentionsProduct(field, productID) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if mentionsProduct(item, productID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NormalizeCode makes coupon codes case-insensitive and tolerant of the
+// spaces and dashes people add when reading a code off a flyer.
+func NormalizeCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, code)
+}
+
+// IsValidCode reports whether a normalized code only uses letters and digits.
+func IsValidCode(code string) bool {
+	if code == "" {
+		return false
+	}
+	for _, r := range code {
+		if !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// IdempotencyRecord remembers a request made with an Idempotency-Key so that
+// a retry gets the original response instead of running again.
+type IdempotencyRecord struct {
+	Key         string          `json:"key"`
+	Fingerprint string          `json:"fingerprint"`      // Hash of the method, path and body of the first request
+	Status      int             `json:"status,omitempty"` // Zero while the first request is in progress
+	Body        json.RawMessage `json:"body,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	ExpiresAt   time.Time       `json:"expires_at"`
+}
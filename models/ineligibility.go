@@ -0,0 +1,34 @@
+package models
+
+type ReasonCode string
+
+const (
+	ReasonExpired           ReasonCode = "EXPIRED"
+	ReasonNotYetValid       ReasonCode = "NOT_YET_VALID"
+	ReasonCouponInactive    ReasonCode = "COUPON_INACTIVE"
+	ReasonUsageExhausted    ReasonCode = "USAGE_EXHAUSTED"
+	ReasonUserNotEligible   ReasonCode = "USER_NOT_ELIGIBLE"
+	ReasonUserLimitReached  ReasonCode = "USER_LIMIT_REACHED"
+	ReasonThresholdNotMet   ReasonCode = "THRESHOLD_NOT_MET"
+	ReasonBuyQuantityNotMet ReasonCode = "BUY_QUANTITY_NOT_MET"
+	ReasonProductNotInCart  ReasonCode = "PRODUCT_NOT_IN_CART"
+	ReasonInvalidDetails    ReasonCode = "INVALID_DETAILS"
+	ReasonUnsupportedType   ReasonCode = "UNSUPPORTED_TYPE"
+	ReasonNoDiscount        ReasonCode = "NO_DISCOUNT"
+	ReasonCodeRedeemed      ReasonCode = "CODE_ALREADY_REDEEMED"
+	ReasonCodeReserved      ReasonCode = "CODE_RESERVED"
+)
+
+type IneligibilityReason struct {
+	Code      ReasonCode  `json:"code"`
+	Message   string      `json:"message"`
+	ProductID uint        `json:"product_id,omitempty"`
+	Actual    interface{} `json:"actual,omitempty"`
+	Required  interface{} `json:"required,omitempty"`
+}
+
+type IneligibleCoupon struct {
+	CouponID uint                  `json:"coupon_id"`
+	Type     CouponType            `json:"type"`
+	Reasons  []IneligibilityReason `json:"reasons"`
+}
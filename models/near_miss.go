@@ -0,0 +1,25 @@
+package models
+
+type RequirementKind string
+
+const (
+	CartTotalRequirement   RequirementKind = "cart_total"   // Cart total must exceed Required
+	BuyQuantityRequirement RequirementKind = "buy_quantity" // Cart must hold Required units of ProductID
+	ProductRequirement     RequirementKind = "product"      // ProductID must be in the cart
+)
+
+type MissingRequirement struct {
+	Kind      RequirementKind `json:"kind"`
+	ProductID uint            `json:"product_id,omitempty"`
+	Required  float64         `json:"required"`
+	Actual    float64         `json:"actual"`
+	Missing   float64         `json:"missing"`
+}
+
+type NearMissCoupon struct {
+	CouponID          uint                 `json:"coupon_id"`
+	Type              CouponType           `json:"type"`
+	Missing           []MissingRequirement `json:"missing"`
+	PotentialDiscount float64              `json:"potential_discount"`
+	DiscountPercent   float64              `json:"discount_percent,omitempty"`
+}
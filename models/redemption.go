@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+type RedemptionStatus string
+
+const (
+	RedemptionRedeemed          RedemptionStatus = "redeemed"
+	RedemptionPartiallyReversed RedemptionStatus = "partially_reversed"
+	RedemptionReversed          RedemptionStatus = "reversed"
+)
+
+type Redemption struct {
+	ID            uint             `json:"id"`
+	CouponID      uint             `json:"coupon_id"`
+	CouponVersion uint             `json:"coupon_version,omitempty"` // Version of the coupon that was redeemed
+	UserID        uint             `json:"user_id,omitempty"`
+	Code          string           `json:"code,omitempty"`
+	SingleUse     bool             `json:"single_use,omitempty"`    // Code is a single-use code
+	CountedUsage  bool             `json:"counted_usage,omitempty"` // Whether the use was counted against the coupon's limits
+	RedeemedAt    time.Time        `json:"redeemed_at"`
+	CartTotal     float64          `json:"cart_total"`
+	Discount      float64          `json:"discount"`
+	Lines         []RedemptionLine `json:"lines"`
+	// Status and ReversedDiscount are derived from the reversals recorded
+	// against the redemption; the ledger entry itself is never rewritten.
+	Status           RedemptionStatus `json:"status,omitempty"`
+	ReversedDiscount float64          `json:"reversed_discount,omitempty"`
+}
+
+// RedemptionLine is the share of a redemption's discount given to one cart
+// item. Cart-wise discounts are spread over the items by value.
+type RedemptionLine struct {
+	ProductID uint    `json:"product_id"`
+	Quantity  uint    `json:"quantity"`
+	Price     float64 `json:"price"`
+	Discount  float64 `json:"discount"`
+}
+
+type RedemptionQuery struct {
+	CouponID uint
+	UserID   uint
+	From     *time.Time
+	To       *time.Time
+	Offset   int
+	Limit    int
+}
+
+type RedemptionPage struct {
+	Redemptions []Redemption `json:"redemptions"`
+	Total       int          `json:"total"`
+	Offset      int          `json:"offset"`
+	Limit       int          `json:"limit"`
+}
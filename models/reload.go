@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// ReloadStatus describes the coupon data file watcher: when it last looked
+// at the file, and how its last attempt to reload it went.
+type ReloadStatus struct {
+	Watching      bool       `json:"watching"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	Coupons       int        `json:"coupons,omitempty"` // Coupons in the file at the last successful reload
+	Error         string     `json:"error,omitempty"`   // Why the last attempt failed, empty if it succeeded
+}
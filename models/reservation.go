@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+type ReservationStatus string
+
+const (
+	ReservationActive    ReservationStatus = "active"
+	ReservationCommitted ReservationStatus = "committed"
+	ReservationReleased  ReservationStatus = "released"
+	ReservationExpired   ReservationStatus = "expired"
+)
+
+// Reservation holds one use of a coupon for a cart until the order is placed
+// (commit) or abandoned (release or expiry).
+type Reservation struct {
+	ID            uint              `json:"id"`
+	CouponID      uint              `json:"coupon_id"`
+	CouponVersion uint              `json:"coupon_version,omitempty"` // Version of the coupon the discount was computed with
+	UserID        uint              `json:"user_id,omitempty"`
+	Code          string            `json:"code,omitempty"`
+	SingleUse     bool              `json:"single_use,omitempty"` // Code is a single-use code held by this reservation
+	Status        ReservationStatus `json:"status"`
+	HoldsUsage    bool              `json:"holds_usage"` // Whether a use was reserved against the coupon's limits
+	CartTotal     float64           `json:"cart_total"`
+	Discount      float64           `json:"discount"`
+	Lines         []RedemptionLine  `json:"lines"`
+	UpdatedCart   *UpdatedCart      `json:"updated_cart,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+	ClosedAt      *time.Time        `json:"closed_at,omitempty"`
+	RedemptionID  uint              `json:"redemption_id,omitempty"`
+}
+
+type ReservationRequest struct {
+	Cart       Cart `json:"cart" binding:"required"`
+	TTLSeconds int  `json:"ttl_seconds,omitempty"` // Defaults to 15 minutes
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Reversal returns all or part of a redemption when an order is cancelled or
+// refunded. The coupon use is given back once every discounted line of the
+// redemption has been reversed.
+type Reversal struct {
+	ID           uint           `json:"id"`
+	RedemptionID uint           `json:"redemption_id"`
+	CouponID     uint           `json:"coupon_id"`
+	UserID       uint           `json:"user_id,omitempty"`
+	Reason       string         `json:"reason,omitempty"`
+	ReversedAt   time.Time      `json:"reversed_at"`
+	Discount     float64        `json:"discount"`
+	Lines        []ReversalLine `json:"lines"`
+	Full         bool           `json:"full"` // Whether this reversal completed the redemption's reversal
+	// Pending is set on a full reversal until the coupon use and code have
+	// been given back.
+	Pending bool `json:"pending,omitempty"`
+}
+
+type ReversalLine struct {
+	ProductID uint    `json:"product_id"`
+	Quantity  uint    `json:"quantity"`
+	Discount  float64 `json:"discount"`
+}
+
+// ReversalRequest reverses the given lines, or everything not yet reversed
+// when no lines are given.
+type ReversalRequest struct {
+	Reason string                `json:"reason"`
+	Lines  []ReversalLineRequest `json:"lines" binding:"dive"`
+}
+
+type ReversalLineRequest struct {
+	ProductID uint `json:"product_id" binding:"required"`
+	Quantity  uint `json:"quantity" binding:"required,min=1"`
+}
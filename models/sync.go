@@ -0,0 +1,42 @@
+package models
+
+// CouponDefinition is a coupon as declared in a definition file. Key
+// identifies it across syncs, so the file can be renamed and the code changed
+// without the coupon being replaced.
+type CouponDefinition struct {
+	Key    string
+	Path   string // File the definition was read from
+	Coupon Coupon
+}
+
+type SyncAction string
+
+const (
+	SyncCreate  SyncAction = "create"
+	SyncUpdate  SyncAction = "update"
+	SyncArchive SyncAction = "archive"
+)
+
+type SyncChange struct {
+	Action   SyncAction    `json:"action"`
+	Key      string        `json:"key"`
+	CouponID uint          `json:"coupon_id,omitempty"` // Unset for a create
+	Coupon   Coupon        `json:"coupon"`              // The coupon as it will be after the change
+	Changes  []FieldChange `json:"changes,omitempty"`
+}
+
+// SyncDrift is a managed coupon that was changed other than by a sync since
+// the sync that last wrote it. Changes are against that sync's version.
+type SyncDrift struct {
+	Key      string        `json:"key"`
+	CouponID uint          `json:"coupon_id"`
+	Version  uint          `json:"version"`
+	Actor    string        `json:"actor,omitempty"` // Who made the latest change
+	Changes  []FieldChange `json:"changes"`
+}
+
+type SyncPlan struct {
+	Changes   []SyncChange `json:"changes"`
+	Drift     []SyncDrift  `json:"drift"`
+	Unchanged int          `json:"unchanged"`
+}
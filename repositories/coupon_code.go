@@ -0,0 +1,184 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"coupon-api/models"
+)
+
+var (
+	ErrCodeNotFound      = errors.New("coupon code not found")
+	ErrCodeStatusChanged = errors.New("coupon code is no longer in the expected state")
+)
+
+type CouponCodeRepository interface {
+	CreateCodes(codes []models.CouponCode) error
+	GetCode(code string) (*models.CouponCode, error)
+	GetCodesByCoupon(couponID uint) ([]models.CouponCode, error)
+	UpdateCodeStatus(code string, from, to models.CodeStatus, userID uint) (*models.CouponCode, error)
+}
+
+// codeCompactEvery is how many records the log must hold before it is
+// compacted while running.
+const codeCompactEvery = 1000
+
+// couponCodeRepository keeps codes in memory and persists them to a JSON-lines
+// log. Every change appends the code's new record, so generating or redeeming
+// a code costs one small append instead of rewriting the whole data set. The
+// last record for a code wins when the log is replayed, and the log is
+// compacted once most of its records are superseded.
+type couponCodeRepository struct {
+	filePath string
+	log      *journal
+	codes    map[string]*models.CouponCode
+	byCoupon map[uint][]string
+	mutex    sync.Mutex
+}
+
+func NewCouponCodeRepository(filePath string) (CouponCodeRepository, error) {
+	repo := &couponCodeRepository{
+		filePath: filePath,
+		codes:    make(map[string]*models.CouponCode),
+		byCoupon: make(map[uint][]string),
+	}
+	var err error
+	if repo.log, err = openRecordLog(filePath, repo.loadCode); err != nil {
+		return nil, err
+	}
+	if repo.log.records > len(repo.codes) {
+		if err := repo.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// compact rewrites the log with only the latest record of each code, keeping
+// each coupon's codes in the order they were created.
+func (r *couponCodeRepository) compact() error {
+	records := make([]interface{}, 0, len(r.codes))
+	for _, codes := range r.byCoupon {
+		for _, code := range codes {
+			records = append(records, r.codes[code])
+		}
+	}
+	return r.log.rewrite(records)
+}
+
+// compactIfStale compacts the log once it holds at least twice as many
+// records as there are codes. A failed compaction leaves the log as it was.
+func (r *couponCodeRepository) compactIfStale() {
+	if r.log.records < codeCompactEvery || r.log.records < 2*len(r.codes) {
+		return
+	}
+	if err := r.compact(); err != nil {
+		log.Printf("Failed to compact %s: %v", r.filePath, err)
+	}
+}
+
+func (r *couponCodeRepository) loadCode(record json.RawMessage) error {
+	var code models.CouponCode
+	if err := json.Unmarshal(record, &code); err != nil {
+		return err
+	}
+	r.put(code)
+	return nil
+}
+
+func (r *couponCodeRepository) put(code models.CouponCode) {
+	if _, exists := r.codes[code.Code]; !exists {
+		r.byCoupon[code.CouponID] = append(r.byCoupon[code.CouponID], code.Code)
+	}
+	r.codes[code.Code] = &code
+}
+
+func (r *couponCodeRepository) appendCodes(codes []models.CouponCode) error {
+	records := make([]interface{}, len(codes))
+	for i, code := range codes {
+		records[i] = code
+	}
+	return r.log.appendBatch(records)
+}
+
+// CreateCodes stores a batch of new codes. The batch is rejected as a whole if
+// any code already exists.
+func (r *couponCodeRepository) CreateCodes(codes []models.CouponCode) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	seen := make(map[string]bool, len(codes))
+	for i := range codes {
+		codes[i].Code = models.NormalizeCode(codes[i].Code)
+		if _, exists := r.codes[codes[i].Code]; exists || seen[codes[i].Code] {
+			return fmt.Errorf("%w: %s", ErrDuplicateCode, codes[i].Code)
+		}
+		seen[codes[i].Code] = true
+	}
+	if err := r.appendCodes(codes); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		r.put(code)
+	}
+	return nil
+}
+
+func (r *couponCodeRepository) GetCode(code string) (*models.CouponCode, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	stored, exists := r.codes[models.NormalizeCode(code)]
+	if !exists {
+		return nil, ErrCodeNotFound
+	}
+	result := *stored
+	return &result, nil
+}
+
+func (r *couponCodeRepository) GetCodesByCoupon(couponID uint) ([]models.CouponCode, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	codes := make([]models.CouponCode, 0, len(r.byCoupon[couponID]))
+	for _, code := range r.byCoupon[couponID] {
+		codes = append(codes, *r.codes[code])
+	}
+	return codes, nil
+}
+
+// UpdateCodeStatus moves a code from one status to another and fails with
+// ErrCodeStatusChanged if the code is not currently in the from status, so two
+// concurrent redemptions of the same code cannot both succeed.
+func (r *couponCodeRepository) UpdateCodeStatus(code string, from, to models.CodeStatus, userID uint) (*models.CouponCode, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stored, exists := r.codes[models.NormalizeCode(code)]
+	if !exists {
+		return nil, ErrCodeNotFound
+	}
+	if stored.Status != from {
+		return nil, ErrCodeStatusChanged
+	}
+
+	updated := *stored
+	updated.Status = to
+	if to == models.CodeRedeemed {
+		now := time.Now().UTC()
+		updated.RedeemedAt = &now
+		updated.RedeemedBy = userID
+	} else {
+		updated.RedeemedAt = nil
+		updated.RedeemedBy = 0
+	}
+	if err := r.appendCodes([]models.CouponCode{updated}); err != nil {
+		return nil, err
+	}
+	*stored = updated
+	r.compactIfStale()
+	result := updated
+	return &result, nil
+}
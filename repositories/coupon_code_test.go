@@ -0,0 +1,46 @@
+package repositories
+
+import (
+	"path/filepath"
+	"testing"
+
+	"coupon-api/models"
+)
+
+func TestCodeLogIsCompacted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coupon_codes.jsonl")
+	repo, err := NewCouponCodeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreateCodes([]models.CouponCode{
+		{Code: "KEEP", CouponID: 1, Status: models.CodeAvailable},
+		{Code: "FLIP", CouponID: 1, Status: models.CodeAvailable},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < codeCompactEvery; i++ {
+		from, to := models.CodeAvailable, models.CodeRedeemed
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		if _, err := repo.UpdateCodeStatus("FLIP", from, to, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records := repo.(*couponCodeRepository).log.records; records >= codeCompactEvery {
+		t.Fatalf("log holds %d records for 2 codes, want it compacted", records)
+	}
+
+	reopened, err := NewCouponCodeRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := reopened.GetCodesByCoupon(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != 2 || codes[0].Code != "KEEP" || codes[1].Code != "FLIP" || codes[1].Status != models.CodeAvailable {
+		t.Fatalf("codes after reopening = %+v, want KEEP then FLIP, both available", codes)
+	}
+}
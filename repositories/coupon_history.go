@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"coupon-api/models"
+)
+
+var ErrRevisionNotFound = errors.New("coupon version not found")
+
+type CouponHistoryRepository interface {
+	AddRevision(revision *models.CouponRevision) error
+	GetRevisions(couponID uint) ([]models.CouponRevision, error)
+	GetRevision(couponID uint, version uint) (*models.CouponRevision, error)
+}
+
+// couponHistoryRepository is an append-only log of coupon revisions stored
+// as JSON lines.
+type couponHistoryRepository struct {
+	filePath  string
+	log       *journal
+	revisions map[uint][]models.CouponRevision // coupon ID -> revisions, oldest first
+	mutex     sync.Mutex
+}
+
+func NewCouponHistoryRepository(filePath string) (CouponHistoryRepository, error) {
+	repo := &couponHistoryRepository{filePath: filePath, revisions: make(map[uint][]models.CouponRevision)}
+	var err error
+	if repo.log, err = openRecordLog(filePath, repo.loadRevision); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (r *couponHistoryRepository) loadRevision(record json.RawMessage) error {
+	var revision models.CouponRevision
+	if err := json.Unmarshal(record, &revision); err != nil {
+		return err
+	}
+	r.revisions[revision.CouponID] = append(r.revisions[revision.CouponID], revision)
+	return nil
+}
+
+func (r *couponHistoryRepository) AddRevision(revision *models.CouponRevision) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.log.append(revision); err != nil {
+		return err
+	}
+	r.revisions[revision.CouponID] = append(r.revisions[revision.CouponID], *revision)
+	return nil
+}
+
+func (r *couponHistoryRepository) GetRevisions(couponID uint) ([]models.CouponRevision, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	revisions := make([]models.CouponRevision, len(r.revisions[couponID]))
+	copy(revisions, r.revisions[couponID])
+	return revisions, nil
+}
+
+func (r *couponHistoryRepository) GetRevision(couponID uint, version uint) (*models.CouponRevision, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, revision := range r.revisions[couponID] {
+		if revision.Version == version {
+			return &revision, nil
+		}
+	}
+	return nil, ErrRevisionNotFound
+}
@@ -0,0 +1,205 @@
+package repositories
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"coupon-api/models"
+)
+
+var (
+	ErrInvalidSort   = errors.New("invalid sort field")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// couponCursor marks the last coupon of a page by its sort key and ID, so the
+// next page picks up after it even if coupons were added or changed since.
+type couponCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   uint   `json:"id"`
+}
+
+// ListCoupons returns one page of the coupons matching the query, in the
+// requested order, along with the number of matches across all pages. The
+// state filter uses each coupon's current status; the coupons returned keep
+// their stored one.
+func (r *couponRepository) ListCoupons(query models.CouponQuery) (*models.CouponPage, error) {
+	r.mutex.Lock()
+	coupons := make([]models.Coupon, len(r.coupons))
+	copy(coupons, r.coupons)
+	r.mutex.Unlock()
+	return pageCoupons(coupons, query)
+}
+
+// pageCoupons filters, sorts and pages coupons in memory. Backends that can
+// narrow the candidates down first may pass fewer coupons, as long as every
+// match is among them.
+func pageCoupons(coupons []models.Coupon, query models.CouponQuery) (*models.CouponPage, error) {
+	field, descending, after, err := parsePaging(query)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	matches := []models.Coupon{}
+	for _, coupon := range coupons {
+		if matchesQuery(&coupon, &query, now) {
+			matches = append(matches, coupon)
+		}
+	}
+
+	less := func(a, b *models.Coupon) bool {
+		return compareCoupons(sortKey(a, field), a.ID, sortKey(b, field), b.ID, descending) < 0
+	}
+	sort.Slice(matches, func(i, j int) bool { return less(&matches[i], &matches[j]) })
+
+	page := &models.CouponPage{Coupons: []models.Coupon{}, Total: len(matches)}
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			return compareCoupons(sortKey(&matches[i], field), matches[i].ID, after.Key, after.ID, descending) > 0
+		})
+	}
+	end := start + query.Limit
+	if end > len(matches) {
+		end = len(matches)
+	}
+	page.Coupons = append(page.Coupons, matches[start:end]...)
+	if end < len(matches) && end > start {
+		last := &matches[end-1]
+		page.NextCursor = encodeCursor(couponCursor{Sort: query.Sort, Key: sortKey(last, field), ID: last.ID})
+	}
+	return page, nil
+}
+
+func matchesQuery(coupon *models.Coupon, query *models.CouponQuery, now time.Time) bool {
+	if query.Type != "" && coupon.Type != query.Type {
+		return false
+	}
+	status := coupon.StatusAt(now)
+	if len(query.Statuses) > 0 {
+		found := false
+		for _, s := range query.Statuses {
+			if s == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	} else if status == models.CouponArchived && !query.IncludeArchived {
+		return false
+	}
+	// A coupon without an expiration date never expires: it is after any
+	// date and before none.
+	if query.ExpiringBefore != nil && (coupon.ExpirationDate == nil || !coupon.ExpirationDate.Before(*query.ExpiringBefore)) {
+		return false
+	}
+	if query.ExpiringAfter != nil && coupon.ExpirationDate != nil && !coupon.ExpirationDate.After(*query.ExpiringAfter) {
+		return false
+	}
+	if query.HasRemainingUses != nil && coupon.HasRemainingUses() != *query.HasRemainingUses {
+		return false
+	}
+	if query.ProductID != 0 && !coupon.TargetsProduct(query.ProductID) {
+		return false
+	}
+	if query.UserID != 0 && !coupon.TargetsUser(query.UserID) {
+		return false
+	}
+	return true
+}
+
+// parsePaging returns the query's sort order and the cursor to continue
+// after, which is nil for the first page.
+func parsePaging(query models.CouponQuery) (models.CouponSortField, bool, *couponCursor, error) {
+	field, descending, err := parseSort(query.Sort)
+	if err != nil {
+		return "", false, nil, err
+	}
+	if query.Cursor == "" {
+		return field, descending, nil, nil
+	}
+	after, err := decodeCursor(query.Cursor)
+	if err != nil {
+		return "", false, nil, err
+	}
+	if after.Sort != query.Sort {
+		return "", false, nil, fmt.Errorf("%w: it was issued for a different sort order", ErrInvalidCursor)
+	}
+	return field, descending, after, nil
+}
+
+func parseSort(value string) (models.CouponSortField, bool, error) {
+	descending := strings.HasPrefix(value, "-")
+	field := models.CouponSortField(strings.TrimPrefix(value, "-"))
+	switch field {
+	case "":
+		return models.SortByID, descending, nil
+	case models.SortByID, models.SortByCode, models.SortByType, models.SortByExpirationDate, models.SortByUsedCount:
+		return field, descending, nil
+	}
+	return "", false, fmt.Errorf("%w: %q", ErrInvalidSort, value)
+}
+
+// sortKey renders the sort field as a string that orders the same way as the
+// field itself: numbers are zero-padded and times use a fixed-width layout,
+// with coupons that never expire sorting last.
+func sortKey(coupon *models.Coupon, field models.CouponSortField) string {
+	switch field {
+	case models.SortByCode:
+		return models.NormalizeCode(coupon.Code)
+	case models.SortByType:
+		return string(coupon.Type)
+	case models.SortByExpirationDate:
+		if coupon.ExpirationDate == nil {
+			return "~"
+		}
+		return coupon.ExpirationDate.UTC().Format("2006-01-02T15:04:05.000000000Z")
+	case models.SortByUsedCount:
+		return fmt.Sprintf("%020d", coupon.UsedCount)
+	}
+	return ""
+}
+
+// compareCoupons orders by sort key and then by ID, which keeps the order
+// total so that a cursor always points at a single position.
+func compareCoupons(key string, id uint, otherKey string, otherID uint, descending bool) int {
+	result := strings.Compare(key, otherKey)
+	if result == 0 {
+		switch {
+		case id < otherID:
+			result = -1
+		case id > otherID:
+			result = 1
+		}
+	}
+	if descending {
+		return -result
+	}
+	return result
+}
+
+func encodeCursor(cursor couponCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*couponCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor couponCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
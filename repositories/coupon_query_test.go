@@ -0,0 +1,188 @@
+package repositories
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"coupon-api/models"
+)
+
+// listAll walks every page of the query and returns the IDs in order, and
+// the total the first page reported.
+func listAll(t *testing.T, repo CouponRepository, query models.CouponQuery) ([]uint, int) {
+	t.Helper()
+	var ids []uint
+	total := -1
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("paging does not end")
+		}
+		page, err := repo.ListCoupons(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total < 0 {
+			total = page.Total
+		}
+		for _, coupon := range page.Coupons {
+			ids = append(ids, coupon.ID)
+		}
+		if page.NextCursor == "" {
+			return ids, total
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func TestListCouponsFiltersSortsAndPages(t *testing.T) {
+	repo, err := NewCouponRepository(filepath.Join(t.TempDir(), "coupons.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, repo)
+	soon := time.Now().Add(time.Hour)
+	later := time.Now().Add(48 * time.Hour)
+	coupons := []*models.Coupon{
+		{Type: models.CartWise, Code: "CHARLIE", ExpirationDate: &later, Details: map[string]interface{}{"threshold": 10.0, "discount": 10.0}},
+		{Type: models.ProductWise, Code: "ALPHA", ExpirationDate: &soon, Details: map[string]interface{}{"product_id": 7.0, "discount": 10.0}},
+		{Type: models.CartWise, Code: "BRAVO", UsageLimit: 1, Users: []uint{3}, Details: map[string]interface{}{"threshold": 10.0, "discount": 10.0}},
+		{Type: models.CartWise, Code: "DELTA", Status: models.CouponArchived, Details: map[string]interface{}{"threshold": 10.0, "discount": 10.0}},
+	}
+	for _, coupon := range coupons {
+		if err := repo.CreateCoupon(coupon); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.ReserveUsage(coupons[2].ID, 3); err != nil {
+		t.Fatal(err)
+	}
+	no := false
+
+	for _, test := range []struct {
+		name  string
+		query models.CouponQuery
+		want  []uint
+	}{
+		{"default", models.CouponQuery{}, []uint{1, 2, 3}},
+		{"with archived", models.CouponQuery{IncludeArchived: true}, []uint{1, 2, 3, 4}},
+		{"archived by status", models.CouponQuery{Statuses: []models.CouponStatus{models.CouponArchived}}, []uint{4}},
+		{"by type", models.CouponQuery{Type: models.CartWise}, []uint{1, 3}},
+		{"by product", models.CouponQuery{ProductID: 7}, []uint{2}},
+		{"by user", models.CouponQuery{UserID: 3}, []uint{3}},
+		{"used up", models.CouponQuery{HasRemainingUses: &no}, []uint{3}},
+		{"expiring before", models.CouponQuery{ExpiringBefore: &later}, []uint{2}},
+		{"expiring after", models.CouponQuery{ExpiringAfter: &soon}, []uint{1, 3}},
+		{"by code", models.CouponQuery{Sort: "code"}, []uint{2, 3, 1}},
+		{"by code descending", models.CouponQuery{Sort: "-code"}, []uint{1, 3, 2}},
+		{"by expiration date", models.CouponQuery{Sort: "expiration_date"}, []uint{2, 1, 3}},
+	} {
+		for _, limit := range []int{1, 2, 10} {
+			query := test.query
+			query.Limit = limit
+			ids, total := listAll(t, repo, query)
+			if !reflect.DeepEqual(ids, test.want) || total != len(test.want) {
+				t.Errorf("%s, %d a page: got %v of %d, want %v", test.name, limit, ids, total, test.want)
+			}
+		}
+	}
+}
+
+func TestListCouponsPagesAlikeOnBothBackends(t *testing.T) {
+	repos := make([]CouponRepository, len(testBackends))
+	base := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, backend := range testBackends {
+		repo, err := backend.open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		closeWhenDone(t, repo)
+		for n := 0; n < 23; n++ {
+			coupon := &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 10}}
+			if n%3 != 0 {
+				coupon.Code = fmt.Sprintf("CODE%02d", (n*7)%23)
+			}
+			if n%4 == 0 {
+				coupon.Type = models.ProductWise
+				coupon.Details = map[string]interface{}{"product_id": 1, "discount": 10}
+			}
+			if n%5 != 0 {
+				expiration := base.Add(time.Duration(n%6) * time.Hour)
+				coupon.ExpirationDate = &expiration
+			}
+			if err := repo.CreateCoupon(coupon); err != nil {
+				t.Fatal(err)
+			}
+			for used := 0; used < n%4; used++ {
+				if err := repo.ReserveUsage(coupon.ID, 1); err != nil {
+					t.Fatal(err)
+				}
+				if err := repo.CommitUsage(coupon.ID, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n%7 == 3 {
+				if _, err := repo.SetCouponStatus(coupon.ID, coupon.Version, models.CouponArchived); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		repos[i] = repo
+	}
+
+	for _, sort := range []string{"", "id", "code", "type", "expiration_date", "used_count"} {
+		for _, order := range []string{"", "-"} {
+			for _, query := range []models.CouponQuery{
+				{Limit: 4},
+				{Limit: 5, IncludeArchived: true},
+				{Limit: 3, Type: models.CartWise},
+				{Limit: 4, Statuses: []models.CouponStatus{models.CouponActive}},
+			} {
+				query.Sort = order + sort
+				if query.Sort == "-" {
+					continue
+				}
+				wantIDs, wantTotal := listAll(t, repos[0], query)
+				gotIDs, gotTotal := listAll(t, repos[1], query)
+				if !reflect.DeepEqual(gotIDs, wantIDs) || gotTotal != wantTotal || len(wantIDs) != wantTotal {
+					t.Errorf("%+v: %s lists %v (total %d), %s lists %v (total %d)",
+						query, testBackends[1].name, gotIDs, gotTotal, testBackends[0].name, wantIDs, wantTotal)
+				}
+			}
+		}
+	}
+}
+
+func TestListCouponsRejectsBadSortAndCursor(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			repo, err := backend.open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeWhenDone(t, repo)
+			for n := 0; n < 3; n++ {
+				newTestCoupon(t, repo, &models.Coupon{})
+			}
+			page, err := repo.ListCoupons(models.CouponQuery{Sort: "code", Limit: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, test := range []struct {
+				query models.CouponQuery
+				want  error
+			}{
+				{models.CouponQuery{Sort: "price", Limit: 1}, ErrInvalidSort},
+				{models.CouponQuery{Cursor: "not a cursor", Limit: 1}, ErrInvalidCursor},
+				{models.CouponQuery{Sort: "-code", Cursor: page.NextCursor, Limit: 1}, ErrInvalidCursor},
+			} {
+				if _, err := repo.ListCoupons(test.query); !errors.Is(err, test.want) {
+					t.Errorf("ListCoupons(%+v) = %v, want %v", test.query, err, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"coupon-api/models"
+)
+
+var (
+	ErrInvalidDataFile = errors.New("invalid coupons file")
+	// ErrReloadConflict is returned when a coupon was edited in the coupons
+	// file and also changed through the API since the file was written.
+	ErrReloadConflict = errors.New("coupons file conflicts with changes not yet written to it")
+)
+
+const reloadPollInterval = 2 * time.Second
+
+var knownCouponTypes = map[models.CouponType]bool{
+	models.CartWise: true, models.ProductWise: true, models.BxGy: true, models.TimeBased: true,
+	models.FirstTimeBuyer: true, models.LimitedUse: true, models.UserSpecific: true, models.Referral: true,
+}
+
+var knownCouponStatuses = map[models.CouponStatus]bool{
+	"": true, models.CouponDraft: true, models.CouponScheduled: true, models.CouponActive: true,
+	models.CouponPaused: true, models.CouponExpired: true, models.CouponArchived: true,
+}
+
+// runWatcher polls the coupons file and reloads it when someone else changed
+// it, so that a coupon fixed by editing the file takes effect without a
+// restart.
+func (r *couponRepository) runWatcher() {
+	defer r.background.Done()
+	r.mutex.Lock()
+	r.reloadStatus.Watching = true
+	r.mutex.Unlock()
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.checkForReload()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// OnReload sets the function told about each coupon a reload changed.
+func (r *couponRepository) OnReload(changed func(before *models.Coupon, after *models.Coupon)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.onReload = changed
+}
+
+// ReloadStatus returns the state of the coupons file watcher.
+func (r *couponRepository) ReloadStatus() models.ReloadStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.reloadStatus
+}
+
+func (r *couponRepository) checkForReload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	r.reloadStatus.CheckedAt = &now
+	stamp, err := statFile(r.filePath)
+	if err != nil {
+		log.Printf("Failed to check %s for changes: %v", r.filePath, err)
+		return
+	}
+	// A file that failed to load is not tried again until it changes.
+	if stamp.same(r.stamp) || (r.failedStamp != nil && stamp.same(*r.failedStamp)) {
+		return
+	}
+	defer r.pauseUsage()()
+	r.reloadStatus.LastAttemptAt = &now
+	count, err := r.reload()
+	if err != nil {
+		r.failedStamp = &stamp
+		r.reloadStatus.Error = err.Error()
+		log.Printf("Failed to reload %s, keeping the coupons loaded before: %v", r.filePath, err)
+		return
+	}
+	r.failedStamp = nil
+	r.reloadStatus.Error = ""
+	r.reloadStatus.LastSuccessAt = &now
+	r.reloadStatus.Coupons = count
+	log.Printf("Reloaded %d coupons from %s", count, r.filePath)
+}
+
+// reload builds the state a restart would: the coupons file as it is now,
+// with the changes logged since the last snapshot replayed on top. It is
+// only swapped in once all of it loaded and the file passed validation.
+// Replaying a change over a coupon that was also edited in the file would
+// drop the edit, so such a file is refused instead. Usage changes must be
+// paused.
+func (r *couponRepository) reload() (int, error) {
+	next := &couponRepository{filePath: r.filePath, usagePath: r.usagePath, sequencePath: r.sequencePath}
+	if err := next.loadCoupons(); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidDataFile, err)
+	}
+	if !next.stamp.exists {
+		return 0, fmt.Errorf("%w: %s is missing", ErrInvalidDataFile, r.filePath)
+	}
+	count := len(next.coupons)
+	if err := validateDataFile(next.coupons, r.validate); err != nil {
+		return 0, err
+	}
+	for id, base := range r.journalBase {
+		var edited *models.Coupon
+		if i := next.indexOf(id); i >= 0 {
+			edited = &next.coupons[i]
+		}
+		if (base == nil) != (edited == nil) || (base != nil && !sameDefinition(base, edited)) {
+			return 0, fmt.Errorf("%w: coupon %d was edited in the file and changed through the API since the file was written", ErrReloadConflict, id)
+		}
+	}
+	if err := next.loadUserUsage(); err != nil {
+		return 0, err
+	}
+	if err := next.loadSequence(); err != nil {
+		return 0, err
+	}
+	if err := r.journal.replay(next.replayChange); err != nil {
+		return 0, err
+	}
+	next.useSnapshotCounts()
+	if err := r.usageLog.replay(next.replayUsage); err != nil {
+		return 0, err
+	}
+
+	// Coupons edited in the file move to a new version, so that writes
+	// based on what was loaded before are rejected as stale.
+	type edit struct{ before, after *models.Coupon }
+	var edits []edit
+	for i := range next.coupons {
+		coupon := &next.coupons[i]
+		j := r.indexOf(coupon.ID)
+		if j < 0 {
+			edits = append(edits, edit{nil, coupon})
+			continue
+		}
+		if sameDefinition(coupon, &r.coupons[j]) {
+			continue
+		}
+		if coupon.Version <= r.coupons[j].Version {
+			coupon.Version = r.coupons[j].Version + 1
+		}
+		before := r.coupons[j]
+		edits = append(edits, edit{&before, coupon})
+	}
+	if r.onReload != nil {
+		for _, e := range edits {
+			after := *e.after
+			r.onReload(e.before, &after)
+		}
+	}
+	if next.nextID < r.nextID {
+		next.nextID = r.nextID
+	}
+	r.coupons = next.coupons
+	r.codes = next.codes
+	r.userUsage = next.userUsage
+	r.nextID = next.nextID
+	r.stamp = next.stamp
+
+	// The logs were replayed into what was loaded, so they can be folded
+	// into a snapshot of it; if that fails the logs stay and are replayed
+	// again on the next fold or restart.
+	if err := r.compact(); err != nil {
+		log.Printf("Failed to fold %s and %s into the reloaded snapshot: %v", r.journal.path, r.usageLog.path, err)
+	}
+	return count, nil
+}
+
+// validateDataFile checks what the repository relies on, and each coupon with
+// validate if it is set. Codes are checked for duplicates as the file is
+// loaded.
+func validateDataFile(coupons []models.Coupon, validate func(coupon *models.Coupon) error) error {
+	ids := make(map[uint]bool)
+	for i, coupon := range coupons {
+		switch {
+		case coupon.ID == 0:
+			return fmt.Errorf("%w: coupon %d has no id", ErrInvalidDataFile, i+1)
+		case ids[coupon.ID]:
+			return fmt.Errorf("%w: coupon id %d is used more than once", ErrInvalidDataFile, coupon.ID)
+		case !knownCouponTypes[coupon.Type]:
+			return fmt.Errorf("%w: coupon %d has unknown type %q", ErrInvalidDataFile, coupon.ID, coupon.Type)
+		case !knownCouponStatuses[coupon.Status]:
+			return fmt.Errorf("%w: coupon %d has unknown status %q", ErrInvalidDataFile, coupon.ID, coupon.Status)
+		case coupon.Details == nil:
+			return fmt.Errorf("%w: coupon %d has no details", ErrInvalidDataFile, coupon.ID)
+		case coupon.Code != "" && !models.IsValidCode(models.NormalizeCode(coupon.Code)):
+			return fmt.Errorf("%w: coupon %d has invalid code %q", ErrInvalidDataFile, coupon.ID, coupon.Code)
+		}
+		if validate != nil {
+			if err := validate(&coupons[i]); err != nil {
+				return fmt.Errorf("%w: coupon %d: %v", ErrInvalidDataFile, coupon.ID, err)
+			}
+		}
+		ids[coupon.ID] = true
+	}
+	return nil
+}
+
+// sameDefinition compares two coupons, ignoring their version and counters.
+func sameDefinition(a *models.Coupon, b *models.Coupon) bool {
+	x, y := *a, *b
+	x.Version, x.UsedCount, x.ReservedCount = 0, 0, 0
+	y.Version, y.UsedCount, y.ReservedCount = 0, 0, 0
+	xData, _ := json.Marshal(x)
+	yData, _ := json.Marshal(y)
+	return string(xData) == string(yData)
+}
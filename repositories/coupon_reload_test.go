@@ -0,0 +1,139 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"coupon-api/models"
+)
+
+// editDataFile rewrites the coupons file as an operator would, passing each
+// coupon to edit.
+func editDataFile(t *testing.T, r *couponRepository, edit func(coupon *models.Coupon)) {
+	t.Helper()
+	data, err := ioutil.ReadFile(r.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coupons []models.Coupon
+	if err := json.Unmarshal(data, &coupons); err != nil {
+		t.Fatal(err)
+	}
+	for i := range coupons {
+		edit(&coupons[i])
+	}
+	if data, err = json.MarshalIndent(coupons, "", "    "); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(r.filePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// discount returns the discount in a cart-wise coupon's details.
+func discount(coupon *models.Coupon) string {
+	details, _ := coupon.Details.(map[string]interface{})
+	return fmt.Sprint(details["discount"])
+}
+
+func setDiscount(coupon *models.Coupon, value interface{}) {
+	coupon.Details = map[string]interface{}{"threshold": 10, "discount": value}
+}
+
+func TestReloadRefusesEditOfCouponChangedSinceWritten(t *testing.T) {
+	validate := func(coupon *models.Coupon) error {
+		details, _ := coupon.Details.(map[string]interface{})
+		if _, ok := details["discount"].(float64); !ok {
+			return errors.New("discount must be a number")
+		}
+		return nil
+	}
+	repo, err := NewCouponRepository(filepath.Join(t.TempDir(), "coupons.json"), validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, repo)
+	r := repo.(*couponRepository)
+	changed := newTestCoupon(t, repo, &models.Coupon{})
+	untouched := newTestCoupon(t, repo, &models.Coupon{})
+	r.fold()
+
+	changed.Code = "API"
+	if err := repo.UpdateCoupon(changed); err != nil {
+		t.Fatal(err)
+	}
+	editDataFile(t, r, func(coupon *models.Coupon) {
+		setDiscount(coupon, 25)
+	})
+	r.checkForReload()
+	if status := repo.ReloadStatus(); !strings.Contains(status.Error, ErrReloadConflict.Error()) {
+		t.Fatalf("reload error = %q, want a conflict", status.Error)
+	}
+	stored, _ := repo.GetCouponByID(changed.ID)
+	if stored.Code != "API" || discount(stored) != "10" {
+		t.Fatalf("coupon after refused reload = %+v, want the API change only", stored)
+	}
+
+	editDataFile(t, r, func(coupon *models.Coupon) {
+		setDiscount(coupon, 10)
+		if coupon.ID == untouched.ID {
+			setDiscount(coupon, "lots")
+		}
+	})
+	r.checkForReload()
+	if status := repo.ReloadStatus(); !strings.Contains(status.Error, "discount must be a number") {
+		t.Fatalf("reload error = %q, want the validation error", status.Error)
+	}
+
+	editDataFile(t, r, func(coupon *models.Coupon) {
+		if coupon.ID == untouched.ID {
+			setDiscount(coupon, 25)
+		}
+	})
+	r.checkForReload()
+	if status := repo.ReloadStatus(); status.Error != "" {
+		t.Fatalf("reload error = %q, want none", status.Error)
+	}
+	stored, _ = repo.GetCouponByID(changed.ID)
+	if stored.Code != "API" {
+		t.Fatalf("changed coupon has code %q after reload, want API", stored.Code)
+	}
+	stored, _ = repo.GetCouponByID(untouched.ID)
+	if discount(stored) != "25" {
+		t.Fatalf("edited coupon has discount %s after reload, want 25", discount(stored))
+	}
+}
+
+func TestReloadReportsEditedCoupons(t *testing.T) {
+	repo, err := NewCouponRepository(filepath.Join(t.TempDir(), "coupons.json"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, repo)
+	r := repo.(*couponRepository)
+	coupon := newTestCoupon(t, repo, &models.Coupon{})
+	newTestCoupon(t, repo, &models.Coupon{})
+	r.fold()
+
+	var before, after []*models.Coupon
+	repo.OnReload(func(b *models.Coupon, a *models.Coupon) {
+		before, after = append(before, b), append(after, a)
+	})
+	editDataFile(t, r, func(c *models.Coupon) {
+		if c.ID == coupon.ID {
+			setDiscount(c, 25)
+		}
+	})
+	r.checkForReload()
+	if len(after) != 1 {
+		t.Fatalf("reload reported %d coupons, want the edited one", len(after))
+	}
+	if discount(before[0]) != "10" || discount(after[0]) != "25" || after[0].Version != before[0].Version+1 {
+		t.Fatalf("reload reported %+v -> %+v, want discount 10 -> 25 at the next version", before[0], after[0])
+	}
+}
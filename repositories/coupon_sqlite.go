@@ -0,0 +1,559 @@
+package repositories
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"coupon-api/models"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// couponMigrations are applied in order, each once, and recorded in
+// schema_migrations. Add new ones at the end; never edit an applied one.
+var couponMigrations = []string{
+	`CREATE TABLE coupons (
+		id              INTEGER PRIMARY KEY AUTOINCREMENT,
+		code            TEXT,
+		type            TEXT NOT NULL,
+		status          TEXT NOT NULL DEFAULT '',
+		version         INTEGER NOT NULL DEFAULT 1,
+		expiration_date TEXT,
+		usage_limit     INTEGER NOT NULL DEFAULT 0,
+		per_user_limit  INTEGER NOT NULL DEFAULT 0,
+		used_count      INTEGER NOT NULL DEFAULT 0,
+		reserved_count  INTEGER NOT NULL DEFAULT 0,
+		definition      TEXT NOT NULL
+	);
+	CREATE UNIQUE INDEX coupons_code ON coupons (code);
+	CREATE INDEX coupons_type ON coupons (type);
+	CREATE INDEX coupons_expiration_date ON coupons (expiration_date);
+	CREATE TABLE coupon_user_usage (
+		coupon_id INTEGER NOT NULL REFERENCES coupons (id),
+		user_id   INTEGER NOT NULL,
+		used      INTEGER NOT NULL DEFAULT 0,
+		reserved  INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (coupon_id, user_id)
+	);`,
+	`CREATE INDEX coupons_code_order ON coupons (COALESCE(code, ''), id);
+	CREATE INDEX coupons_expiration_date_order ON coupons (COALESCE(expiration_date, '~'), id);`,
+}
+
+// expirationLayout is fixed-width so that expiration dates sort as text.
+const expirationLayout = "2006-01-02T15:04:05.000000000Z"
+
+const couponColumns = `id, status, version, used_count, reserved_count, definition`
+
+// sqliteCouponRepository keeps coupons in a SQLite database. The columns hold
+// what is searched on or updated atomically; definition holds the rest of
+// the coupon as JSON. AUTOINCREMENT keeps IDs from ever being reused.
+type sqliteCouponRepository struct {
+	db *sql.DB
+}
+
+// NewSQLiteCouponRepository opens the database at path. A new database is
+// filled from the JSON backend's coupons file at importPath, if there is one.
+func NewSQLiteCouponRepository(path string, importPath string) (CouponRepository, error) {
+	// Transactions take the write lock up front, so two that read and then
+	// write cannot deadlock; the busy timeout makes writers queue.
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	repo := &sqliteCouponRepository{db: db}
+	if err := repo.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if importPath != "" {
+		if err := repo.importJSONData(importPath); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+func (r *sqliteCouponRepository) migrate() error {
+	if _, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := r.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for i := applied; i < len(couponMigrations); i++ {
+		err := r.inTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(couponMigrations[i]); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, i+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+func (r *sqliteCouponRepository) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanCoupon(row rowScanner) (*models.Coupon, error) {
+	var coupon models.Coupon
+	var id, version, used, reserved uint
+	var status, definition string
+	if err := row.Scan(&id, &status, &version, &used, &reserved, &definition); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(definition), &coupon); err != nil {
+		return nil, err
+	}
+	coupon.ID = id
+	coupon.Status = models.CouponStatus(status)
+	coupon.Version = version
+	coupon.UsedCount = used
+	coupon.ReservedCount = reserved
+	return &coupon, nil
+}
+
+// couponRow returns the column values for the coupon, in the order of
+// writeColumns.
+func couponRow(coupon *models.Coupon) ([]interface{}, error) {
+	d := *coupon
+	d.ID, d.Version, d.UsedCount, d.ReservedCount = 0, 0, 0, 0
+	definition, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var code, expiration interface{}
+	if coupon.Code != "" {
+		code = models.NormalizeCode(coupon.Code)
+	}
+	if coupon.ExpirationDate != nil {
+		expiration = coupon.ExpirationDate.UTC().Format(expirationLayout)
+	}
+	return []interface{}{
+		code, string(coupon.Type), string(coupon.Status), expiration,
+		coupon.UsageLimit, coupon.PerUserLimit, string(definition),
+	}, nil
+}
+
+const writeColumns = `code, type, status, expiration_date, usage_limit, per_user_limit, definition`
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+}
+
+func insertCoupon(tx *sql.Tx, coupon *models.Coupon) error {
+	values, err := couponRow(coupon)
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(`INSERT INTO coupons (`+writeColumns+`, version) VALUES (?, ?, ?, ?, ?, ?, ?, 1)`, values...)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("%w: %s", ErrDuplicateCode, models.NormalizeCode(coupon.Code))
+	}
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	coupon.ID = uint(id)
+	coupon.Version = 1
+	return nil
+}
+
+func (r *sqliteCouponRepository) CreateCoupon(coupon *models.Coupon) error {
+	created := *coupon
+	if err := r.inTx(func(tx *sql.Tx) error { return insertCoupon(tx, &created) }); err != nil {
+		return err
+	}
+	*coupon = created
+	return nil
+}
+
+// CreateCoupons creates all of the coupons or, if any code is taken, none of
+// them.
+func (r *sqliteCouponRepository) CreateCoupons(coupons []*models.Coupon) error {
+	created := make([]models.Coupon, len(coupons))
+	err := r.inTx(func(tx *sql.Tx) error {
+		for i, coupon := range coupons {
+			created[i] = *coupon
+			if err := insertCoupon(tx, &created[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, coupon := range coupons {
+		*coupon = created[i]
+	}
+	return nil
+}
+
+func (r *sqliteCouponRepository) queryCoupons(where string, args ...interface{}) ([]models.Coupon, error) {
+	return r.queryCouponsOrdered(where, "id", args...)
+}
+
+func (r *sqliteCouponRepository) queryCouponsOrdered(where string, orderBy string, args ...interface{}) ([]models.Coupon, error) {
+	rows, err := r.db.Query(`SELECT `+couponColumns+` FROM coupons `+where+` ORDER BY `+orderBy, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	coupons := []models.Coupon{}
+	for rows.Next() {
+		coupon, err := scanCoupon(rows)
+		if err != nil {
+			return nil, err
+		}
+		coupons = append(coupons, *coupon)
+	}
+	return coupons, rows.Err()
+}
+
+func (r *sqliteCouponRepository) GetAllCoupons() ([]models.Coupon, error) {
+	return r.queryCoupons("")
+}
+
+// sqlSortKeys are the SQL forms of sortKey, so that rows come back in the
+// same order, and cursors mean the same, as with the JSON backend. All but
+// used_count can be read in order from an index.
+var sqlSortKeys = map[models.CouponSortField]string{
+	models.SortByID:             ``,
+	models.SortByCode:           `COALESCE(code, '')`,
+	models.SortByType:           `type`,
+	models.SortByExpirationDate: `COALESCE(expiration_date, '~')`,
+	models.SortByUsedCount:      `printf('%020d', used_count)`,
+}
+
+// ListCoupons filters, sorts and pages in SQL. The state, product and user
+// filters need the whole coupon, so a query using them is narrowed down by
+// the other filters and then paged by pageCoupons.
+func (r *sqliteCouponRepository) ListCoupons(query models.CouponQuery) (*models.CouponPage, error) {
+	var conditions []string
+	var args []interface{}
+	if query.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, string(query.Type))
+	}
+	if query.ExpiringBefore != nil {
+		conditions = append(conditions, "expiration_date < ?")
+		args = append(args, query.ExpiringBefore.UTC().Format(expirationLayout))
+	}
+	if query.ExpiringAfter != nil {
+		conditions = append(conditions, "(expiration_date IS NULL OR expiration_date > ?)")
+		args = append(args, query.ExpiringAfter.UTC().Format(expirationLayout))
+	}
+	if query.HasRemainingUses != nil {
+		condition := "(usage_limit = 0 OR used_count + reserved_count < usage_limit)"
+		if !*query.HasRemainingUses {
+			condition = "NOT " + condition
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(query.Statuses) > 0 || query.ProductID != 0 || query.UserID != 0 {
+		coupons, err := r.queryCoupons(whereClause(conditions), args...)
+		if err != nil {
+			return nil, err
+		}
+		return pageCoupons(coupons, query)
+	}
+	// Only a stored status makes a coupon archived.
+	if !query.IncludeArchived {
+		conditions = append(conditions, "status <> ?")
+		args = append(args, string(models.CouponArchived))
+	}
+
+	field, descending, after, err := parsePaging(query)
+	if err != nil {
+		return nil, err
+	}
+	page := &models.CouponPage{Coupons: []models.Coupon{}}
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM coupons `+whereClause(conditions), args...).Scan(&page.Total); err != nil {
+		return nil, err
+	}
+	key, direction, comparison := sqlSortKeys[field], "ASC", ">"
+	if descending {
+		direction, comparison = "DESC", "<"
+	}
+	orderBy := fmt.Sprintf("id %s", direction)
+	if key != "" {
+		orderBy = fmt.Sprintf("%s %s, %s", key, direction, orderBy)
+	}
+	// The cursor condition is written so that it bounds the key on its own,
+	// which lets SQLite seek the index to the cursor.
+	switch {
+	case after != nil && key == "":
+		conditions = append(conditions, fmt.Sprintf("id %s ?", comparison))
+		args = append(args, after.ID)
+	case after != nil:
+		conditions = append(conditions, fmt.Sprintf("%[1]s %[2]s= ? AND (%[1]s %[2]s ? OR id %[2]s ?)", key, comparison))
+		args = append(args, after.Key, after.Key, after.ID)
+	}
+	// One more than a page tells whether there is a next one.
+	coupons, err := r.queryCouponsOrdered(whereClause(conditions), fmt.Sprintf("%s LIMIT %d", orderBy, query.Limit+1), args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(coupons) > query.Limit {
+		coupons = coupons[:query.Limit]
+		if len(coupons) > 0 {
+			last := &coupons[len(coupons)-1]
+			page.NextCursor = encodeCursor(couponCursor{Sort: query.Sort, Key: sortKey(last, field), ID: last.ID})
+		}
+	}
+	page.Coupons = append(page.Coupons, coupons...)
+	return page, nil
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conditions, " AND ")
+}
+
+func (r *sqliteCouponRepository) GetCouponByID(id uint) (*models.Coupon, error) {
+	coupon, err := scanCoupon(r.db.QueryRow(`SELECT `+couponColumns+` FROM coupons WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCouponNotFound
+	}
+	return coupon, err
+}
+
+func (r *sqliteCouponRepository) GetCouponByCode(code string) (*models.Coupon, error) {
+	coupon, err := scanCoupon(r.db.QueryRow(`SELECT `+couponColumns+` FROM coupons WHERE code = ?`, models.NormalizeCode(code)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrCouponNotFound
+	}
+	return coupon, err
+}
+
+// UpdateCoupon replaces the coupon's definition if it is still at
+// coupon.Version. The usage counters are kept as stored.
+func (r *sqliteCouponRepository) UpdateCoupon(coupon *models.Coupon) error {
+	updated := *coupon
+	err := r.inTx(func(tx *sql.Tx) error {
+		var version uint
+		err := tx.QueryRow(`SELECT version, used_count, reserved_count FROM coupons WHERE id = ?`, coupon.ID).
+			Scan(&version, &updated.UsedCount, &updated.ReservedCount)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCouponNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if version != coupon.Version {
+			return ErrVersionMismatch
+		}
+		values, err := couponRow(&updated)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE coupons SET (`+writeColumns+`) = (?, ?, ?, ?, ?, ?, ?), version = version + 1 WHERE id = ?`,
+			append(values, coupon.ID)...)
+		if isUniqueViolation(err) {
+			return ErrDuplicateCode
+		}
+		updated.Version = version + 1
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	*coupon = updated
+	return nil
+}
+
+// SetCouponStatus changes the stored status of a coupon, provided it is
+// still at version. Nothing else about the coupon is touched.
+func (r *sqliteCouponRepository) SetCouponStatus(id uint, version uint, status models.CouponStatus) (*models.Coupon, error) {
+	var coupon *models.Coupon
+	err := r.inTx(func(tx *sql.Tx) error {
+		result, err := tx.Exec(`UPDATE coupons SET status = ?, version = version + 1 WHERE id = ? AND version = ?`, string(status), id, version)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			var exists bool
+			if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM coupons WHERE id = ?)`, id).Scan(&exists); err != nil {
+				return err
+			}
+			if !exists {
+				return ErrCouponNotFound
+			}
+			return ErrVersionMismatch
+		}
+		coupon, err = scanCoupon(tx.QueryRow(`SELECT `+couponColumns+` FROM coupons WHERE id = ?`, id))
+		return err
+	})
+	return coupon, err
+}
+
+// ReserveUsage holds one use of the coupon for a pending checkout. The limits
+// are checked and the counts updated in one transaction, so concurrent
+// callers can never hold more uses than the limits allow.
+func (r *sqliteCouponRepository) ReserveUsage(id uint, userID uint) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		var usageLimit, perUserLimit, used, reserved uint
+		err := tx.QueryRow(`SELECT usage_limit, per_user_limit, used_count, reserved_count FROM coupons WHERE id = ?`, id).
+			Scan(&usageLimit, &perUserLimit, &used, &reserved)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrCouponNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if usageLimit > 0 && used+reserved >= usageLimit {
+			return ErrUsageLimitReached
+		}
+		if perUserLimit > 0 {
+			count, err := userUsageCount(tx, id, userID)
+			if err != nil {
+				return err
+			}
+			if count >= perUserLimit {
+				return ErrUserLimitReached
+			}
+		}
+		return updateUsageTx(tx, id, userID, 1, 0)
+	})
+}
+
+// ReleaseUsage gives a held use back.
+func (r *sqliteCouponRepository) ReleaseUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, -1, 0)
+}
+
+// CommitUsage turns a held use into a used one.
+func (r *sqliteCouponRepository) CommitUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, -1, 1)
+}
+
+// UncommitUsage turns a used use back into a held one, for a commit that
+// could not be completed.
+func (r *sqliteCouponRepository) UncommitUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, 1, -1)
+}
+
+// ReturnUsage gives back a used use, for a redemption that was reversed.
+func (r *sqliteCouponRepository) ReturnUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, 0, -1)
+}
+
+func (r *sqliteCouponRepository) adjustUsage(id uint, userID uint, reserved int, used int) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		return updateUsageTx(tx, id, userID, reserved, used)
+	})
+}
+
+// updateUsageTx moves the coupon's counters and the user's together. Counts
+// never go below zero.
+func updateUsageTx(tx *sql.Tx, id uint, userID uint, reserved int, used int) error {
+	result, err := tx.Exec(`UPDATE coupons SET reserved_count = MAX(reserved_count + ?, 0), used_count = MAX(used_count + ?, 0) WHERE id = ?`,
+		reserved, used, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrCouponNotFound
+	}
+	if userID == 0 {
+		return nil
+	}
+	if _, err := tx.Exec(`INSERT INTO coupon_user_usage (coupon_id, user_id, reserved, used) VALUES (?, ?, MAX(?, 0), MAX(?, 0))
+		ON CONFLICT (coupon_id, user_id) DO UPDATE SET reserved = MAX(reserved + ?, 0), used = MAX(used + ?, 0)`,
+		id, userID, reserved, used, reserved, used); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM coupon_user_usage WHERE coupon_id = ? AND user_id = ? AND reserved = 0 AND used = 0`, id, userID)
+	return err
+}
+
+func (r *sqliteCouponRepository) SetReservedUsage(held map[uint]map[uint]uint) error {
+	return r.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE coupons SET reserved_count = 0`); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE coupon_user_usage SET reserved = 0`); err != nil {
+			return err
+		}
+		for id, users := range held {
+			for userID, count := range users {
+				if err := updateUsageTx(tx, id, userID, int(count), 0); err != nil && !errors.Is(err, ErrCouponNotFound) {
+					return err
+				}
+			}
+		}
+		_, err := tx.Exec(`DELETE FROM coupon_user_usage WHERE reserved = 0 AND used = 0`)
+		return err
+	})
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func userUsageCount(q queryRower, id uint, userID uint) (uint, error) {
+	var count uint
+	err := q.QueryRow(`SELECT used + reserved FROM coupon_user_usage WHERE coupon_id = ? AND user_id = ?`, id, userID).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return count, err
+}
+
+// GetUserUsageCount returns the uses a user has committed plus those they
+// currently hold in reservations.
+func (r *sqliteCouponRepository) GetUserUsageCount(id uint, userID uint) (uint, error) {
+	return userUsageCount(r.db, id, userID)
+}
+
+// ReloadStatus reports that nothing is watched: the database is the only
+// copy of the coupons, so there is no file to reload.
+func (r *sqliteCouponRepository) ReloadStatus() models.ReloadStatus {
+	return models.ReloadStatus{}
+}
+
+// OnReload has nothing to do, since nothing is reloaded.
+func (r *sqliteCouponRepository) OnReload(changed func(before *models.Coupon, after *models.Coupon)) {
+}
+
+// Close releases the database.
+func (r *sqliteCouponRepository) Close() error {
+	return r.db.Close()
+}
@@ -0,0 +1,125 @@
+package repositories
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// importJSONData copies the coupons, usage counts and ID sequence of the
+// JSON backend at jsonPath into an empty database, so that switching
+// backends keeps the coupons. It is skipped once the database has had a
+// coupon, and when there is nothing to import.
+func (r *sqliteCouponRepository) importJSONData(jsonPath string) error {
+	var used bool
+	if err := r.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM coupons) OR EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'coupons')`).Scan(&used); err != nil {
+		return err
+	}
+	if used {
+		return nil
+	}
+	// Until its first fold, the JSON backend's coupons may only be in its
+	// journal.
+	base := strings.TrimSuffix(jsonPath, filepath.Ext(jsonPath))
+	if !fileExists(jsonPath) && !fileExists(base+".journal") {
+		return nil
+	}
+
+	// The JSON backend must not be writing the files while they are read.
+	lock, err := lockDataFile(base + ".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	source, err := readJSONData(jsonPath)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", jsonPath, err)
+	}
+	if len(source.coupons) == 0 {
+		return nil
+	}
+
+	err = r.inTx(func(tx *sql.Tx) error {
+		for i := range source.coupons {
+			coupon := &source.coupons[i]
+			values, err := couponRow(coupon)
+			if err != nil {
+				return err
+			}
+			values = append(values, coupon.ID, coupon.Version, coupon.UsedCount, coupon.ReservedCount)
+			if _, err := tx.Exec(`INSERT INTO coupons (`+writeColumns+`, id, version, used_count, reserved_count) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, values...); err != nil {
+				return fmt.Errorf("coupon %d: %w", coupon.ID, err)
+			}
+		}
+		for _, counts := range []struct {
+			column string
+			counts userCounts
+		}{{"used", source.userUsage.Used}, {"reserved", source.userUsage.Reserved}} {
+			for id, users := range counts.counts {
+				for userID, count := range users {
+					_, err := tx.Exec(`INSERT INTO coupon_user_usage (coupon_id, user_id, `+counts.column+`) VALUES (?, ?, ?)
+						ON CONFLICT (coupon_id, user_id) DO UPDATE SET `+counts.column+` = excluded.`+counts.column, id, userID, count)
+					if err != nil {
+						return fmt.Errorf("usage of coupon %d by user %d: %w", id, userID, err)
+					}
+				}
+			}
+		}
+		// IDs given out by the JSON backend are not given out again.
+		_, err := tx.Exec(`UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = 'coupons'`, source.nextID-1)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("importing %s: %w", jsonPath, err)
+	}
+	log.Printf("Imported %d coupons from %s", len(source.coupons), jsonPath)
+	return nil
+}
+
+// readJSONData reads the state of the JSON backend as it would load it,
+// without changing any of its files.
+func readJSONData(filePath string) (*couponRepository, error) {
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	source := &couponRepository{filePath: filePath, usagePath: base + ".usage.json", sequencePath: base + ".sequence.json"}
+	if err := source.loadCoupons(); err != nil {
+		return nil, err
+	}
+	if err := source.loadUserUsage(); err != nil {
+		return nil, err
+	}
+	if err := source.loadSequence(); err != nil {
+		return nil, err
+	}
+	if err := replayLogFile(base+".journal", source.replayChange); err != nil {
+		return nil, err
+	}
+	source.useSnapshotCounts()
+	if err := replayLogFile(base+".usage.log", source.replayUsage); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+// replayLogFile replays a journal without opening it for appending, so a
+// torn last record is skipped rather than cut off.
+func replayLogFile(path string, replay func(record json.RawMessage) error) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, _, err = (&journal{path: path, checksummed: true}).replayData(data, replay)
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
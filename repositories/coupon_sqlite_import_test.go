@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"coupon-api/models"
+)
+
+func TestSQLiteImportsJSONDataOnce(t *testing.T) {
+	dir := t.TempDir()
+	jsonPath := filepath.Join(dir, "coupons.json")
+	source, err := NewCouponRepository(jsonPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var coupons []*models.Coupon
+	for i := 0; i < 3; i++ {
+		coupons = append(coupons, newTestCoupon(t, source, &models.Coupon{PerUserLimit: 2}))
+	}
+	if err := source.ReserveUsage(coupons[1].ID, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.CommitUsage(coupons[1].ID, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := source.ReserveUsage(coupons[1].ID, 6); err != nil {
+		t.Fatal(err)
+	}
+	want, err := source.GetAllCoupons()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stands in for stopping the server that used the JSON backend.
+	if err := source.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dbPath := filepath.Join(dir, "coupons.db")
+	repo, err := NewSQLiteCouponRepository(dbPath, jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, repo)
+	got, err := repo.GetAllCoupons()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotData, _ := json.Marshal(got)
+	wantData, _ := json.Marshal(want)
+	if string(gotData) != string(wantData) {
+		t.Fatalf("imported coupons = %+v, want %+v", got, want)
+	}
+	for userID, count := range map[uint]uint{5: 1, 6: 1, 7: 0} {
+		if n, err := repo.GetUserUsageCount(coupons[1].ID, userID); err != nil || n != count {
+			t.Fatalf("usage by user %d = %d, %v; want %d", userID, n, err, count)
+		}
+	}
+	created := newTestCoupon(t, repo, &models.Coupon{})
+	if created.ID != 4 {
+		t.Fatalf("new coupon has ID %d, want 4", created.ID)
+	}
+
+	repo, err = NewSQLiteCouponRepository(dbPath, jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, repo)
+	if got, _ = repo.GetAllCoupons(); len(got) != 4 {
+		t.Fatalf("%d coupons after reopening, want 4", len(got))
+	}
+}
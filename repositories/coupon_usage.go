@@ -0,0 +1,200 @@
+package repositories
+
+import (
+	"log"
+	"time"
+)
+
+// Usage counters change on every checkout, so they are not written through
+// the journal. A change is applied in memory under the repository lock,
+// where the limits are checked, and then handed to a writer goroutine that
+// appends it to the usage log. The writer takes every change that arrived
+// while it was syncing the previous batch, so concurrent checkouts share a
+// single sync. The usage log is folded into the snapshot in the background.
+const (
+	maxUsageBatch = 256
+	foldInterval  = 30 * time.Second
+)
+
+// usageDelta is a usage log record: how much one change moved the coupon's
+// counters and the user's. The amounts are the ones actually applied, after
+// counters were kept from going below zero, so undoing a change is exact.
+// Records are numbered in the order they are written.
+type usageDelta struct {
+	Seq          uint64 `json:"seq,omitempty"`
+	CouponID     uint   `json:"coupon_id"`
+	UserID       uint   `json:"user_id,omitempty"`
+	Reserved     int    `json:"reserved,omitempty"`
+	Used         int    `json:"used,omitempty"`
+	UserReserved int    `json:"user_reserved,omitempty"`
+	UserUsed     int    `json:"user_used,omitempty"`
+}
+
+func (d usageDelta) inverse() usageDelta {
+	return usageDelta{
+		CouponID:     d.CouponID,
+		UserID:       d.UserID,
+		Reserved:     -d.Reserved,
+		Used:         -d.Used,
+		UserReserved: -d.UserReserved,
+		UserUsed:     -d.UserUsed,
+	}
+}
+
+type usageAppend struct {
+	delta usageDelta
+	done  chan error
+}
+
+// applyUsage moves the counters of the coupon and, if userID is set, of the
+// user, and returns the change that was made.
+func (r *couponRepository) applyUsage(id uint, userID uint, reserved int, used int) (usageDelta, error) {
+	i := r.indexOf(id)
+	if i < 0 {
+		return usageDelta{}, ErrCouponNotFound
+	}
+	c := &r.coupons[i]
+	delta := usageDelta{CouponID: id, UserID: userID}
+	delta.Reserved = countChange(c.ReservedCount, reserved)
+	delta.Used = countChange(c.UsedCount, used)
+	c.ReservedCount = addCount(c.ReservedCount, delta.Reserved)
+	c.UsedCount = addCount(c.UsedCount, delta.Used)
+	if userID != 0 {
+		delta.UserReserved = countChange(r.userUsage.Reserved[id][userID], reserved)
+		delta.UserUsed = countChange(r.userUsage.Used[id][userID], used)
+		r.userUsage.Reserved.add(id, userID, delta.UserReserved)
+		r.userUsage.Used.add(id, userID, delta.UserUsed)
+	}
+	return delta, nil
+}
+
+func (r *couponRepository) applyDelta(delta usageDelta) {
+	r.applyUsage(delta.CouponID, 0, delta.Reserved, delta.Used)
+	if delta.UserID != 0 {
+		r.userUsage.Reserved.add(delta.CouponID, delta.UserID, delta.UserReserved)
+		r.userUsage.Used.add(delta.CouponID, delta.UserID, delta.UserUsed)
+	}
+}
+
+// countChange returns how much adding delta to count actually changes it.
+func countChange(count uint, delta int) int {
+	return int(addCount(count, delta)) - int(count)
+}
+
+// updateUsage applies a usage change and waits until it is in the usage log.
+// The lock is held on entry and on return, but not while waiting, so other
+// checkouts can be applied and join the same batch. If the change cannot be
+// logged it is undone.
+func (r *couponRepository) updateUsage(id uint, userID uint, reserved int, used int) error {
+	delta, err := r.applyUsage(id, userID, reserved, used)
+	if err != nil {
+		return err
+	}
+	r.usageSeq++
+	delta.Seq = r.usageSeq
+	done := make(chan error, 1)
+	r.usageInFlight++
+	r.usageAppends <- usageAppend{delta: delta, done: done}
+	r.mutex.Unlock()
+	err = <-done
+	r.mutex.Lock()
+	if err != nil {
+		r.applyDelta(delta.inverse())
+	}
+	r.usageInFlight--
+	if r.usageInFlight == 0 {
+		r.usageIdle.Broadcast()
+	}
+	return err
+}
+
+// lockUsage takes the lock for a usage change, waiting out a fold or reload
+// in progress.
+func (r *couponRepository) lockUsage() {
+	r.mutex.Lock()
+	for r.usagePaused {
+		r.usageIdle.Wait()
+	}
+}
+
+// pauseUsage stops new usage changes and waits until every one already
+// applied in memory is also in the usage log. The lock must be held; it is
+// released while waiting. The returned function lets usage changes resume.
+func (r *couponRepository) pauseUsage() func() {
+	r.usagePaused = true
+	for r.usageInFlight > 0 {
+		r.usageIdle.Wait()
+	}
+	return func() {
+		r.usagePaused = false
+		r.usageIdle.Broadcast()
+	}
+}
+
+func (r *couponRepository) runUsageWriter() {
+	defer close(r.writerDone)
+	for first := range r.usageAppends {
+		batch := []usageAppend{first}
+	drain:
+		for len(batch) < maxUsageBatch {
+			select {
+			case next := <-r.usageAppends:
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+		records := make([]interface{}, len(batch))
+		for i, pending := range batch {
+			records[i] = pending.delta
+		}
+		err := r.usageLog.appendBatch(records)
+		// Once the callers hear back, a fold may reset the log, so its size
+		// is read first.
+		full := err == nil && r.usageLog.records >= journalCompactEvery
+		for _, pending := range batch {
+			pending.done <- err
+		}
+		if full {
+			r.requestFold()
+		}
+	}
+}
+
+func (r *couponRepository) requestFold() {
+	select {
+	case r.foldRequests <- struct{}{}:
+	default:
+	}
+}
+
+func (r *couponRepository) runFolder() {
+	defer r.background.Done()
+	ticker := time.NewTicker(foldInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.foldRequests:
+		case <-ticker.C:
+		case <-r.stop:
+			return
+		}
+		r.fold()
+	}
+}
+
+// fold writes a new snapshot once every usage change applied in memory is
+// also in the usage log, so the snapshot holds exactly what the logs it
+// replaces held. Usage changes wait while it runs.
+func (r *couponRepository) fold() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	defer r.pauseUsage()()
+	if r.journal.records == 0 && r.usageLog.records == 0 {
+		return
+	}
+	// A failed fold leaves both logs in place and is retried next time.
+	if err := r.compact(); err != nil {
+		log.Printf("Failed to fold %s and %s into the snapshot: %v", r.journal.path, r.usageLog.path, err)
+	}
+}
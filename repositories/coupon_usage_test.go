@@ -0,0 +1,334 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"coupon-api/models"
+)
+
+var testBackends = []struct {
+	name string
+	open func(dir string) (CouponRepository, error)
+}{
+	{"json", func(dir string) (CouponRepository, error) {
+		return NewCouponRepository(filepath.Join(dir, "coupons.json"), nil)
+	}},
+	{"sqlite", func(dir string) (CouponRepository, error) {
+		return NewSQLiteCouponRepository(filepath.Join(dir, "coupons.db"), "")
+	}},
+}
+
+func newTestCoupon(t testing.TB, repo CouponRepository, coupon *models.Coupon) *models.Coupon {
+	t.Helper()
+	coupon.Type = models.CartWise
+	coupon.Details = map[string]interface{}{"threshold": 10, "discount": 10}
+	if err := repo.CreateCoupon(coupon); err != nil {
+		t.Fatal(err)
+	}
+	return coupon
+}
+
+// reserveConcurrently calls ReserveUsage from a goroutine per user and
+// returns how many calls succeeded.
+func reserveConcurrently(t *testing.T, repo CouponRepository, id uint, users []uint, limitErr error) int {
+	t.Helper()
+	var wg sync.WaitGroup
+	errs := make([]error, len(users))
+	for i, userID := range users {
+		wg.Add(1)
+		go func(i int, userID uint) {
+			defer wg.Done()
+			errs[i] = repo.ReserveUsage(id, userID)
+		}(i, userID)
+	}
+	wg.Wait()
+	reserved := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			reserved++
+		case !errors.Is(err, limitErr):
+			t.Fatalf("ReserveUsage = %v, want nil or %v", err, limitErr)
+		}
+	}
+	return reserved
+}
+
+func TestReserveUsageConcurrently(t *testing.T) {
+	const attempts, limit = 200, 50
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			repo, err := backend.open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeWhenDone(t, repo)
+
+			coupon := newTestCoupon(t, repo, &models.Coupon{UsageLimit: limit})
+			users := make([]uint, attempts)
+			for i := range users {
+				users[i] = uint(i + 1)
+			}
+			if reserved := reserveConcurrently(t, repo, coupon.ID, users, ErrUsageLimitReached); reserved != limit {
+				t.Fatalf("%d of %d reservations succeeded, want %d", reserved, attempts, limit)
+			}
+			stored, err := repo.GetCouponByID(coupon.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.ReservedCount != limit {
+				t.Fatalf("reserved count = %d, want %d", stored.ReservedCount, limit)
+			}
+
+			const perUser = 3
+			coupon = newTestCoupon(t, repo, &models.Coupon{PerUserLimit: perUser})
+			sameUser := make([]uint, attempts)
+			for i := range sameUser {
+				sameUser[i] = 42
+			}
+			if reserved := reserveConcurrently(t, repo, coupon.ID, sameUser, ErrUserLimitReached); reserved != perUser {
+				t.Fatalf("%d of %d reservations by one user succeeded, want %d", reserved, attempts, perUser)
+			}
+			if count, err := repo.GetUserUsageCount(coupon.ID, 42); err != nil || count != perUser {
+				t.Fatalf("user usage count = %d, %v; want %d", count, err, perUser)
+			}
+		})
+	}
+}
+
+// reopen closes repo, which leaves its files as a crash would since the
+// logs are not folded, and opens them again.
+func reopen(t testing.TB, repo *couponRepository) *couponRepository {
+	t.Helper()
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewCouponRepository(repo.filePath, repo.validate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, reopened)
+	return reopened.(*couponRepository)
+}
+
+// closeWhenDone closes repo at the end of the test, so that its background
+// work stops before the test's files are removed.
+func closeWhenDone(t testing.TB, repo CouponRepository) {
+	t.Cleanup(func() {
+		if err := repo.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestUsageCountedOnceAfterCrashDuringCompaction(t *testing.T) {
+	crashes := map[string]func(r *couponRepository) error{
+		"after the usage file": func(r *couponRepository) error {
+			return r.saveUserUsage()
+		},
+		"before emptying the logs": func(r *couponRepository) error {
+			if err := r.saveUserUsage(); err != nil {
+				return err
+			}
+			return r.saveCoupons()
+		},
+	}
+	for name, crash := range crashes {
+		t.Run(name, func(t *testing.T) {
+			repo, err := NewCouponRepository(filepath.Join(t.TempDir(), "coupons.json"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			coupon := newTestCoupon(t, repo, &models.Coupon{})
+			for userID := uint(1); userID <= 3; userID++ {
+				if err := repo.ReserveUsage(coupon.ID, userID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := repo.CommitUsage(coupon.ID, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			r := repo.(*couponRepository)
+			r.mutex.Lock()
+			err = crash(r)
+			r.mutex.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Usage changed after the crashed compaction must still count.
+			if err := repo.ReserveUsage(coupon.ID, 4); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened := reopen(t, r)
+			stored, err := reopened.GetCouponByID(coupon.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.UsedCount != 1 || stored.ReservedCount != 3 {
+				t.Fatalf("used %d, reserved %d after reopening; want 1 and 3", stored.UsedCount, stored.ReservedCount)
+			}
+			if count, err := reopened.GetUserUsageCount(coupon.ID, 1); err != nil || count != 1 {
+				t.Fatalf("user usage count = %d, %v; want 1", count, err)
+			}
+		})
+	}
+}
+
+// benchmarkCoupons is how many coupons the usage benchmarks store, since the
+// cost of rewriting the coupons file grows with it.
+const benchmarkCoupons = 1000
+
+func newBenchmarkRepository(b *testing.B) (*couponRepository, *models.Coupon) {
+	repo, err := NewCouponRepository(filepath.Join(b.TempDir(), "coupons.json"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	closeWhenDone(b, repo)
+	var coupon *models.Coupon
+	for i := 0; i < benchmarkCoupons; i++ {
+		coupon = newTestCoupon(b, repo, &models.Coupon{})
+	}
+	return repo.(*couponRepository), coupon
+}
+
+func BenchmarkReserveUsage(b *testing.B) {
+	repo, coupon := newBenchmarkRepository(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := repo.ReserveUsage(coupon.ID, uint(i%1000+1)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReserveUsageParallel measures reservations that share the usage
+// log's syncs.
+func BenchmarkReserveUsageParallel(b *testing.B) {
+	repo, coupon := newBenchmarkRepository(b)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for userID := uint(1); pb.Next(); userID = userID%1000 + 1 {
+			if err := repo.ReserveUsage(coupon.ID, userID); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// rewriteFilePerUse counts a use the way IncrementUsageCount used to: by
+// rewriting the whole coupons file while holding the lock. It writes a copy,
+// so that the repository does not take it for an edit of its file.
+func rewriteFilePerUse(r *couponRepository, id uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.coupons[r.indexOf(id)].UsedCount++
+	data, err := json.MarshalIndent(r.coupons, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.filePath+".rewritten", data, 0644)
+}
+
+// BenchmarkRewriteFilePerUse is the path ReserveUsage replaced, for
+// comparison.
+func BenchmarkRewriteFilePerUse(b *testing.B) {
+	repo, coupon := newBenchmarkRepository(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := rewriteFilePerUse(repo, coupon.ID); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRewriteFilePerUseParallel(b *testing.B) {
+	repo, coupon := newBenchmarkRepository(b)
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := rewriteFilePerUse(repo, coupon.ID); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkCompact(b *testing.B) {
+	repo, err := NewCouponRepository(filepath.Join(b.TempDir(), "coupons.json"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	closeWhenDone(b, repo)
+	for i := 0; i < 1000; i++ {
+		coupon := newTestCoupon(b, repo, &models.Coupon{})
+		if err := repo.ReserveUsage(coupon.ID, uint(i+1)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	r := repo.(*couponRepository)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.mutex.Lock()
+		err := r.compact()
+		r.mutex.Unlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSetReservedUsage(t *testing.T) {
+	for _, backend := range testBackends {
+		t.Run(backend.name, func(t *testing.T) {
+			repo, err := backend.open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			closeWhenDone(t, repo)
+			coupon := newTestCoupon(t, repo, &models.Coupon{})
+			other := newTestCoupon(t, repo, &models.Coupon{})
+			for _, userID := range []uint{1, 2, 2} {
+				if err := repo.ReserveUsage(coupon.ID, userID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := repo.ReserveUsage(other.ID, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.CommitUsage(other.ID, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := repo.SetReservedUsage(map[uint]map[uint]uint{coupon.ID: {2: 1, 0: 1}}); err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := repo.GetCouponByID(coupon.ID)
+			if stored.ReservedCount != 2 {
+				t.Fatalf("reserved count = %d, want 2", stored.ReservedCount)
+			}
+			stored, _ = repo.GetCouponByID(other.ID)
+			if stored.ReservedCount != 0 || stored.UsedCount != 1 {
+				t.Fatalf("other coupon used %d, reserved %d; want 1 and 0", stored.UsedCount, stored.ReservedCount)
+			}
+			for userID, want := range map[uint]uint{1: 0, 2: 1} {
+				if count, err := repo.GetUserUsageCount(coupon.ID, userID); err != nil || count != want {
+					t.Fatalf("usage of user %d = %d, %v; want %d", userID, count, err, want)
+				}
+			}
+			if count, err := repo.GetUserUsageCount(other.ID, 1); err != nil || count != 1 {
+				t.Fatalf("used count of user 1 = %d, %v; want 1", count, err)
+			}
+		})
+	}
+}
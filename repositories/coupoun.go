@@ -3,45 +3,276 @@ package repositories
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
 
 	"coupon-api/models"
 )
 
+var (
+	ErrCouponNotFound = errors.New("coupon not found")
+	ErrDuplicateCode  = errors.New("coupon code already exists")
+	ErrCouponChanged  = errors.New("coupon was changed by another request")
+	// ErrVersionMismatch is returned when a write expects a version of the
+	// coupon that is no longer the current one.
+	ErrVersionMismatch = errors.New("coupon has been modified since the given version")
+	// ErrUsageLimitReached and ErrUserLimitReached are returned by
+	// ReserveUsage when holding another use would exceed a limit.
+	ErrUsageLimitReached = errors.New("coupon usage limit has been reached")
+	ErrUserLimitReached  = errors.New("user has reached the per-user limit for this coupon")
+)
+
 type CouponRepository interface {
 	CreateCoupon(coupon *models.Coupon) error
+	CreateCoupons(coupons []*models.Coupon) error
 	GetAllCoupons() ([]models.Coupon, error)
+	ListCoupons(query models.CouponQuery) (*models.CouponPage, error)
 	GetCouponByID(id uint) (*models.Coupon, error)
+	GetCouponByCode(code string) (*models.Coupon, error)
 	UpdateCoupon(coupon *models.Coupon) error
-	DeleteCoupon(id uint) error
-	IncrementUsageCount(id uint) error
+	SetCouponStatus(id uint, version uint, status models.CouponStatus) (*models.Coupon, error)
+	ReserveUsage(id uint, userID uint) error
+	ReleaseUsage(id uint, userID uint) error
+	CommitUsage(id uint, userID uint) error
+	UncommitUsage(id uint, userID uint) error
+	ReturnUsage(id uint, userID uint) error
+	GetUserUsageCount(id uint, userID uint) (uint, error)
+	// SetReservedUsage replaces every reserved counter with the given
+	// counts: coupon ID -> user ID -> uses held, with user 0 for uses held
+	// without a user.
+	SetReservedUsage(held map[uint]map[uint]uint) error
+	ReloadStatus() models.ReloadStatus
+	// OnReload sets a function called for each coupon that a reload of
+	// coupons edited outside the API changed, with before nil for a coupon
+	// that was added. It is called with the repository locked.
+	OnReload(changed func(before *models.Coupon, after *models.Coupon))
+	// Close stops the repository's background work and releases its files.
+	Close() error
 }
 
+// couponRepository keeps its state in a snapshot (the coupons file plus the
+// usage and sequence files next to it), a journal of the coupon changes made
+// since, and a usage log of the counter changes made since. Every change is
+// logged before it is reported done, and the logs are folded into a new
+// snapshot in the background every journalCompactEvery records.
 type couponRepository struct {
-	filePath string
-	coupons  []models.Coupon
-	mutex    sync.Mutex
+	filePath     string
+	usagePath    string
+	sequencePath string
+	journal      *journal
+	usageLog     *journal
+	lock         *os.File
+	validate     func(coupon *models.Coupon) error
+	onReload     func(before *models.Coupon, after *models.Coupon)
+	stamp        fileStamp // coupons file as last read or written
+	coupons      []models.Coupon
+	codes        map[string]uint // normalized code -> coupon ID
+	userUsage    userUsage
+	nextID       uint
+	usageSeq     uint64 // last usage log record written or replayed
+	snapshotSeq  uint64 // last usage log record in the usage file
+	// Coupon counters read from the usage file, until the journal is
+	// replayed and they can be set.
+	snapshotCounts map[uint]usageCounts
+	// The coupons changed in the journal, as the snapshot has them; nil
+	// for the ones created since.
+	journalBase map[uint]*models.Coupon
+	mutex       sync.Mutex
+
+	usageAppends  chan usageAppend
+	usageInFlight int
+	usageIdle     *sync.Cond
+	usagePaused   bool
+	foldRequests  chan struct{}
+	stop          chan struct{}  // closed by Close
+	background    sync.WaitGroup // the folder and watcher
+	writerDone    chan struct{}  // closed when the usage writer returns
+
+	reloadStatus models.ReloadStatus
+	failedStamp  *fileStamp // coupons file that last failed to reload
+}
+
+const journalCompactEvery = 1000
+
+// couponChange is a journal record. It holds the new state of what changed
+// rather than the change itself, so replaying a record that is already in
+// the snapshot leaves the state as it was. The usage counters of a coupon
+// that already exists are left alone; they come from the usage log.
+type couponChange struct {
+	Coupons []models.Coupon `json:"coupons,omitempty"`
+	NextID  uint            `json:"next_id,omitempty"`
+}
+
+// userCounts maps coupon ID -> user ID -> count.
+type userCounts map[uint]map[uint]uint
+
+func (c userCounts) add(id uint, userID uint, delta int) {
+	if c[id] == nil {
+		c[id] = make(map[uint]uint)
+	}
+	c.set(id, userID, addCount(c[id][userID], delta))
+}
+
+func (c userCounts) set(id uint, userID uint, count uint) {
+	if c[id] == nil {
+		c[id] = make(map[uint]uint)
+	}
+	c[id][userID] = count
+	if count == 0 {
+		delete(c[id], userID)
+	}
+	if len(c[id]) == 0 {
+		delete(c, id)
+	}
+}
+
+type userUsage struct {
+	Used     userCounts `json:"used"`
+	Reserved userCounts `json:"reserved"`
+}
+
+// usageFile is the usage snapshot. It holds the coupons' counters as well as
+// the users', together with the sequence number of the last usage log record
+// they include, so the counters and the point to replay the log from are
+// always written together.
+type usageFile struct {
+	userUsage
+	Coupons map[uint]usageCounts `json:"coupons,omitempty"`
+	Seq     uint64               `json:"seq,omitempty"`
+}
+
+type usageCounts struct {
+	Used     uint `json:"used,omitempty"`
+	Reserved uint `json:"reserved,omitempty"`
+}
+
+func addCount(count uint, delta int) uint {
+	if delta < 0 && uint(-delta) > count {
+		return 0
+	}
+	return uint(int(count) + delta)
 }
 
-func NewCouponRepository(filePath string) (CouponRepository, error) {
-	repo := &couponRepository{filePath: filePath}
-	err := repo.loadCoupons()
+// NewCouponRepository opens the coupons in filePath. validate checks each
+// coupon of a coupons file edited while the repository is open, before it is
+// reloaded; it may be nil.
+func NewCouponRepository(filePath string, validate func(coupon *models.Coupon) error) (CouponRepository, error) {
+	base := strings.TrimSuffix(filePath, filepath.Ext(filePath))
+	repo := &couponRepository{
+		filePath:     filePath,
+		validate:     validate,
+		usagePath:    base + ".usage.json",
+		sequencePath: base + ".sequence.json",
+		usageAppends: make(chan usageAppend, maxUsageBatch),
+		foldRequests: make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		writerDone:   make(chan struct{}),
+	}
+	repo.usageIdle = sync.NewCond(&repo.mutex)
+	// Two processes each keeping their own copy of the coupons would
+	// overwrite each other's changes, so only one may use the files.
+	lock, err := lockDataFile(base + ".lock")
 	if err != nil {
 		return nil, err
 	}
+	repo.lock = lock
+	if err := repo.loadCoupons(); err != nil {
+		return nil, err
+	}
+	if err := repo.loadUserUsage(); err != nil {
+		return nil, err
+	}
+	if err := repo.loadSequence(); err != nil {
+		return nil, err
+	}
+	if repo.journal, err = openJournal(base+".journal", repo.replayChange); err != nil {
+		return nil, err
+	}
+	repo.useSnapshotCounts()
+	if repo.usageLog, err = openJournal(base+".usage.log", repo.replayUsage); err != nil {
+		return nil, err
+	}
+	// Start from a fresh snapshot so the logs only ever hold changes made
+	// by this process.
+	if repo.journal.records > 0 || repo.usageLog.records > 0 {
+		if err := repo.compact(); err != nil {
+			return nil, err
+		}
+	}
+	go repo.runUsageWriter()
+	repo.background.Add(2)
+	go repo.runFolder()
+	go repo.runWatcher()
 	return repo, nil
 }
 
+// Close stops folding and watching the coupons file, waits until every
+// usage change is in the usage log, and closes the logs and the lock file.
+// The logs are left for the next start to fold. The repository must not be
+// used after.
+func (r *couponRepository) Close() error {
+	close(r.stop)
+	r.background.Wait()
+	r.mutex.Lock()
+	r.pauseUsage()
+	r.mutex.Unlock()
+	close(r.usageAppends)
+	<-r.writerDone
+	err := r.journal.close()
+	if usageErr := r.usageLog.close(); err == nil {
+		err = usageErr
+	}
+	if lockErr := r.lock.Close(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+func (r *couponRepository) replayChange(record json.RawMessage) error {
+	var change couponChange
+	if err := json.Unmarshal(record, &change); err != nil {
+		return err
+	}
+	r.apply(&change)
+	return nil
+}
+
+func (r *couponRepository) replayUsage(record json.RawMessage) error {
+	var delta usageDelta
+	if err := json.Unmarshal(record, &delta); err != nil {
+		return err
+	}
+	if delta.Seq > r.usageSeq {
+		r.usageSeq = delta.Seq
+	}
+	// Records written before the usage file are already counted in it.
+	if delta.Seq != 0 && delta.Seq <= r.snapshotSeq {
+		return nil
+	}
+	r.applyDelta(delta)
+	return nil
+}
+
 func (r *couponRepository) loadCoupons() error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
+	// The stamp is taken before reading, so a change made while reading
+	// is still noticed.
+	var err error
+	if r.stamp, err = statFile(r.filePath); err != nil {
+		return err
+	}
 	file, err := os.Open(r.filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			r.coupons = []models.Coupon{}
+			r.codes = make(map[string]uint)
 			return nil
 		}
 		return err
@@ -51,29 +282,298 @@ func (r *couponRepository) loadCoupons() error {
 	if err != nil {
 		return err
 	}
-	return json.Unmarshal(data, &r.coupons)
+	if err := json.Unmarshal(data, &r.coupons); err != nil {
+		return err
+	}
+	for i := range r.coupons {
+		// Coupons saved before versions existed start at the first one.
+		if r.coupons[i].Version == 0 {
+			r.coupons[i].Version = 1
+		}
+	}
+	return r.rebuildCodeIndex()
+}
+
+func (r *couponRepository) rebuildCodeIndex() error {
+	r.codes = make(map[string]uint)
+	for _, coupon := range r.coupons {
+		if coupon.Code == "" {
+			continue
+		}
+		code := models.NormalizeCode(coupon.Code)
+		if _, exists := r.codes[code]; exists {
+			return fmt.Errorf("%w: %s", ErrDuplicateCode, code)
+		}
+		r.codes[code] = coupon.ID
+	}
+	return nil
+}
+
+// codeTaken reports whether code belongs to a coupon other than id.
+func (r *couponRepository) codeTaken(code string, id uint) bool {
+	if code == "" {
+		return false
+	}
+	owner, exists := r.codes[models.NormalizeCode(code)]
+	return exists && owner != id
 }
 
+// saveCoupons writes the coupons file, unless it changed since it was last
+// read or written here, in which case the other writer's changes are left
+// for an operator to reconcile rather than silently overwritten.
 func (r *couponRepository) saveCoupons() error {
+	stamp, err := statFile(r.filePath)
+	if err != nil {
+		return err
+	}
+	if !stamp.same(r.stamp) {
+		return fmt.Errorf("%w: %s", ErrDataFileChanged, r.filePath)
+	}
 	data, err := json.MarshalIndent(r.coupons, "", "  ")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(r.filePath, data, 0644)
+	if err := writeFileAtomic(r.filePath, data); err != nil {
+		return err
+	}
+	r.stamp, err = statFile(r.filePath)
+	return err
+}
+
+// loadUserUsage reads the usage counters, which are kept next to the coupons
+// file so that the coupons file keeps its plain array format. The coupons'
+// counters in the usage file are set by useSnapshotCounts.
+func (r *couponRepository) loadUserUsage() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.userUsage = userUsage{Used: userCounts{}, Reserved: userCounts{}}
+	data, err := ioutil.ReadFile(r.usagePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var file usageFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	r.userUsage = file.userUsage
+	r.snapshotSeq = file.Seq
+	r.usageSeq = file.Seq
+	r.snapshotCounts = file.Coupons
+	if r.userUsage.Used == nil {
+		r.userUsage.Used = userCounts{}
+	}
+	if r.userUsage.Reserved == nil {
+		r.userUsage.Reserved = userCounts{}
+	}
+	return nil
+}
+
+func (r *couponRepository) saveUserUsage() error {
+	file := usageFile{userUsage: r.userUsage, Coupons: make(map[uint]usageCounts), Seq: r.usageSeq}
+	for _, coupon := range r.coupons {
+		file.Coupons[coupon.ID] = usageCounts{Used: coupon.UsedCount, Reserved: coupon.ReservedCount}
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.usagePath, data); err != nil {
+		return err
+	}
+	r.snapshotSeq = r.usageSeq
+	return nil
+}
+
+// useSnapshotCounts sets the coupons' counters to the ones in the usage file,
+// which take precedence over the coupons file because that may have been
+// written after it. It runs once the journal has added the coupons created
+// since the coupons file was written. Usage files written before they held
+// the coupons' counters leave them as the coupons file has them.
+func (r *couponRepository) useSnapshotCounts() {
+	if r.snapshotCounts == nil {
+		return
+	}
+	for i := range r.coupons {
+		counts := r.snapshotCounts[r.coupons[i].ID]
+		r.coupons[i].UsedCount = counts.Used
+		r.coupons[i].ReservedCount = counts.Reserved
+	}
+	r.snapshotCounts = nil
+}
+
+type sequence struct {
+	NextID uint `json:"next_id"`
+}
+
+// loadSequence reads the next coupon ID. IDs are never reused, so the
+// sequence is kept in its own file and never goes below the highest ID in
+// use, which also covers coupons files written before it existed.
+func (r *couponRepository) loadSequence() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var seq sequence
+	data, err := ioutil.ReadFile(r.sequencePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &seq); err != nil {
+			return err
+		}
+	}
+	r.nextID = seq.NextID
+	for _, coupon := range r.coupons {
+		if coupon.ID >= r.nextID {
+			r.nextID = coupon.ID + 1
+		}
+	}
+	if r.nextID == 0 {
+		r.nextID = 1
+	}
+	return nil
+}
+
+func (r *couponRepository) saveSequence() error {
+	data, err := json.MarshalIndent(sequence{NextID: r.nextID}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(r.sequencePath, data)
+}
+
+// compact writes the current state as the new snapshot and empties the
+// logs. Each file is replaced atomically and the logs are only emptied once
+// all of them are written, so a crash part way leaves the old logs to
+// replay on top of whichever files were already replaced. That is safe for
+// the journal, whose records hold new states. Usage log records hold
+// changes, so only those after the sequence number in the usage file are
+// replayed, and the usage file is written first and holds the coupons'
+// counters too, so they are never taken from a coupons file that is newer
+// than it. Usage changes must not be in flight.
+func (r *couponRepository) compact() error {
+	if err := r.saveUserUsage(); err != nil {
+		return err
+	}
+	if err := r.saveCoupons(); err != nil {
+		return err
+	}
+	if err := r.saveSequence(); err != nil {
+		return err
+	}
+	if err := r.journal.reset(); err != nil {
+		return err
+	}
+	r.journalBase = nil
+	return r.usageLog.reset()
+}
+
+// commit makes a change durable by appending it to the journal, and only
+// then applies it in memory, so a change that fails to persist is never
+// visible.
+func (r *couponRepository) commit(change *couponChange) error {
+	if err := r.journal.append(change); err != nil {
+		return err
+	}
+	if r.journalBase == nil {
+		r.journalBase = make(map[uint]*models.Coupon)
+	}
+	for _, coupon := range change.Coupons {
+		if _, seen := r.journalBase[coupon.ID]; seen {
+			continue
+		}
+		var base *models.Coupon
+		if i := r.indexOf(coupon.ID); i >= 0 {
+			existing := r.coupons[i]
+			base = &existing
+		}
+		r.journalBase[coupon.ID] = base
+	}
+	r.apply(change)
+	if r.journal.records >= journalCompactEvery {
+		r.requestFold()
+	}
+	return nil
+}
+
+func (r *couponRepository) apply(change *couponChange) {
+	for _, coupon := range change.Coupons {
+		if i := r.indexOf(coupon.ID); i >= 0 {
+			if r.coupons[i].Code != "" {
+				delete(r.codes, models.NormalizeCode(r.coupons[i].Code))
+			}
+			coupon.UsedCount = r.coupons[i].UsedCount
+			coupon.ReservedCount = r.coupons[i].ReservedCount
+			r.coupons[i] = coupon
+		} else {
+			r.coupons = append(r.coupons, coupon)
+		}
+		if coupon.Code != "" {
+			r.codes[models.NormalizeCode(coupon.Code)] = coupon.ID
+		}
+	}
+	if change.NextID > r.nextID {
+		r.nextID = change.NextID
+	}
+}
+
+func (r *couponRepository) indexOf(id uint) int {
+	for i := range r.coupons {
+		if r.coupons[i].ID == id {
+			return i
+		}
+	}
+	return -1
 }
 
 func (r *couponRepository) CreateCoupon(coupon *models.Coupon) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	coupon.ID = uint(len(r.coupons) + 1)
-	r.coupons = append(r.coupons, *coupon)
-	return r.saveCoupons()
+	if r.codeTaken(coupon.Code, 0) {
+		return ErrDuplicateCode
+	}
+	coupon.ID = r.nextID
+	coupon.Version = 1
+	return r.commit(&couponChange{Coupons: []models.Coupon{*coupon}, NextID: coupon.ID + 1})
+}
+
+// CreateCoupons creates all of the coupons or, if any code is taken, none of
+// them.
+func (r *couponRepository) CreateCoupons(coupons []*models.Coupon) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	seen := make(map[string]bool)
+	for _, coupon := range coupons {
+		if coupon.Code == "" {
+			continue
+		}
+		code := models.NormalizeCode(coupon.Code)
+		if r.codeTaken(code, 0) || seen[code] {
+			return fmt.Errorf("%w: %s", ErrDuplicateCode, code)
+		}
+		seen[code] = true
+	}
+	change := &couponChange{NextID: r.nextID}
+	for _, coupon := range coupons {
+		coupon.ID = change.NextID
+		coupon.Version = 1
+		change.NextID++
+		change.Coupons = append(change.Coupons, *coupon)
+	}
+	return r.commit(change)
 }
 
 func (r *couponRepository) GetAllCoupons() ([]models.Coupon, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	return r.coupons, nil
+	// A copy, so that callers can neither see nor make changes behind the lock.
+	coupons := make([]models.Coupon, len(r.coupons))
+	copy(coupons, r.coupons)
+	return coupons, nil
 }
 
 func (r *couponRepository) GetCouponByID(id uint) (*models.Coupon, error) {
@@ -84,41 +584,147 @@ func (r *couponRepository) GetCouponByID(id uint) (*models.Coupon, error) {
 			return &coupon, nil
 		}
 	}
-	return nil, errors.New("coupon not found")
+	return nil, ErrCouponNotFound
+}
+
+func (r *couponRepository) GetCouponByCode(code string) (*models.Coupon, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	id, exists := r.codes[models.NormalizeCode(code)]
+	if !exists {
+		return nil, ErrCouponNotFound
+	}
+	for _, coupon := range r.coupons {
+		if coupon.ID == id {
+			return &coupon, nil
+		}
+	}
+	return nil, ErrCouponNotFound
 }
 
+// UpdateCoupon replaces the coupon if coupon.Version is still the stored
+// version, and moves it to the next version. The usage counters are kept
+// from the stored coupon; they only change through the usage methods.
 func (r *couponRepository) UpdateCoupon(coupon *models.Coupon) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	for i, c := range r.coupons {
+	for _, c := range r.coupons {
 		if c.ID == coupon.ID {
-			r.coupons[i] = *coupon
-			return r.saveCoupons()
+			if c.Version != coupon.Version {
+				return ErrVersionMismatch
+			}
+			if r.codeTaken(coupon.Code, coupon.ID) {
+				return ErrDuplicateCode
+			}
+			coupon.UsedCount = c.UsedCount
+			coupon.ReservedCount = c.ReservedCount
+			coupon.Version = c.Version + 1
+			return r.commit(&couponChange{Coupons: []models.Coupon{*coupon}})
 		}
 	}
-	return errors.New("coupon not found")
+	return ErrCouponNotFound
 }
 
-func (r *couponRepository) DeleteCoupon(id uint) error {
+// SetCouponStatus changes the stored status of a coupon, provided it is
+// still at version. Nothing else about the coupon is touched.
+func (r *couponRepository) SetCouponStatus(id uint, version uint, status models.CouponStatus) (*models.Coupon, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	for i, c := range r.coupons {
+	for _, c := range r.coupons {
 		if c.ID == id {
-			r.coupons = append(r.coupons[:i], r.coupons[i+1:]...)
-			return r.saveCoupons()
+			if c.Version != version {
+				return nil, ErrVersionMismatch
+			}
+			c.Status = status
+			c.Version++
+			if err := r.commit(&couponChange{Coupons: []models.Coupon{c}}); err != nil {
+				return nil, err
+			}
+			return &c, nil
+		}
+	}
+	return nil, ErrCouponNotFound
+}
+
+// ReserveUsage holds one use of the coupon for a pending checkout. The limits
+// are checked against the stored counts under the same lock that updates
+// them, so concurrent callers can never hold more uses than the limits allow.
+func (r *couponRepository) ReserveUsage(id uint, userID uint) error {
+	r.lockUsage()
+	defer r.mutex.Unlock()
+	for _, c := range r.coupons {
+		if c.ID != id {
+			continue
 		}
+		if c.UsageLimit > 0 && c.UsedCount+c.ReservedCount >= c.UsageLimit {
+			return ErrUsageLimitReached
+		}
+		if c.PerUserLimit > 0 && r.userUsage.Used[id][userID]+r.userUsage.Reserved[id][userID] >= c.PerUserLimit {
+			return ErrUserLimitReached
+		}
+		break
 	}
-	return errors.New("coupon not found")
+	return r.updateUsage(id, userID, 1, 0)
+}
+
+// ReleaseUsage gives a held use back.
+func (r *couponRepository) ReleaseUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, -1, 0)
+}
+
+// CommitUsage turns a held use into a used one.
+func (r *couponRepository) CommitUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, -1, 1)
 }
 
-func (r *couponRepository) IncrementUsageCount(id uint) error {
+// UncommitUsage turns a used use back into a held one, for a commit that
+// could not be completed.
+func (r *couponRepository) UncommitUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, 1, -1)
+}
+
+// ReturnUsage gives back a used use, for a redemption that was reversed.
+func (r *couponRepository) ReturnUsage(id uint, userID uint) error {
+	return r.adjustUsage(id, userID, 0, -1)
+}
+
+func (r *couponRepository) adjustUsage(id uint, userID uint, reserved int, used int) error {
+	r.lockUsage()
+	defer r.mutex.Unlock()
+	return r.updateUsage(id, userID, reserved, used)
+}
+
+// GetUserUsageCount returns the uses a user has committed plus those they
+// currently hold in reservations.
+func (r *couponRepository) GetUserUsageCount(id uint, userID uint) (uint, error) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
-	for i, c := range r.coupons {
-		if c.ID == id {
-			r.coupons[i].UsedCount++
-			return r.saveCoupons()
+	return r.userUsage.Used[id][userID] + r.userUsage.Reserved[id][userID], nil
+}
+
+// SetReservedUsage writes the new counters as a snapshot rather than through
+// the usage log, since they replace the logged ones.
+func (r *couponRepository) SetReservedUsage(held map[uint]map[uint]uint) error {
+	r.lockUsage()
+	defer r.mutex.Unlock()
+	defer r.pauseUsage()()
+	reserved := userCounts{}
+	changed := false
+	for i := range r.coupons {
+		total := uint(0)
+		for userID, count := range held[r.coupons[i].ID] {
+			total += count
+			if userID != 0 {
+				reserved.set(r.coupons[i].ID, userID, count)
+			}
 		}
+		changed = changed || r.coupons[i].ReservedCount != total
+		r.coupons[i].ReservedCount = total
+	}
+	changed = changed || !reflect.DeepEqual(reserved, r.userUsage.Reserved)
+	r.userUsage.Reserved = reserved
+	if !changed {
+		return nil
 	}
-	return errors.New("coupon not found")
+	return r.compact()
 }
@@ -0,0 +1,39 @@
+package repositories
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var (
+	// ErrDataFileLocked is returned when another process already writes
+	// to the same data files.
+	ErrDataFileLocked = errors.New("data file is locked by another process")
+	// ErrDataFileChanged is returned instead of overwriting a data file
+	// that something else changed since it was last read or written.
+	ErrDataFileChanged = errors.New("data file was changed by another process and was not overwritten")
+)
+
+// fileStamp identifies one version of a file's contents well enough to notice
+// that someone else wrote it.
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func (s fileStamp) same(other fileStamp) bool {
+	return s.exists == other.exists && s.size == other.size && s.modTime.Equal(other.modTime)
+}
+
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fileStamp{}, nil
+	}
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{exists: true, size: info.Size(), modTime: info.ModTime()}, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package repositories
+
+import "os"
+
+// lockDataFile only creates the lock file on platforms without flock, so
+// nothing stops a second process there.
+func lockDataFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+}
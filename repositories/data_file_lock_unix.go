@@ -0,0 +1,26 @@
+//go:build unix
+
+package repositories
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDataFile takes an exclusive advisory lock on path, which is held until
+// the returned file is closed or the process exits.
+func lockDataFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%w: %s", ErrDataFileLocked, path)
+		}
+		return nil, err
+	}
+	return file, nil
+}
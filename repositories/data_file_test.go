@@ -0,0 +1,54 @@
+package repositories
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"coupon-api/models"
+)
+
+func TestDataFilesUsedByOneRepositoryAtATime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coupons.json")
+	repo, err := NewCouponRepository(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCouponRepository(path, nil); !errors.Is(err, ErrDataFileLocked) {
+		t.Fatalf("opening locked files = %v, want %v", err, ErrDataFileLocked)
+	}
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+	repo, err = NewCouponRepository(path, nil)
+	if err != nil {
+		t.Fatalf("opening files after close: %v", err)
+	}
+	closeWhenDone(t, repo)
+}
+
+func TestCouponsFileChangedOnDiskIsNotOverwritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coupons.json")
+	repo, err := NewCouponRepository(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, repo)
+	newTestCoupon(t, repo, &models.Coupon{})
+	edited := []byte(`[]`)
+	if err := ioutil.WriteFile(path, edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := repo.(*couponRepository)
+	r.mutex.Lock()
+	err = r.compact()
+	r.mutex.Unlock()
+	if !errors.Is(err, ErrDataFileChanged) {
+		t.Fatalf("compacting over an edited file = %v, want %v", err, ErrDataFileChanged)
+	}
+	if data, _ := ioutil.ReadFile(path); string(data) != string(edited) {
+		t.Fatalf("coupons file is %q, want the edit kept", data)
+	}
+}
@@ -0,0 +1,152 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"coupon-api/models"
+)
+
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+type IdempotencyRepository interface {
+	// BeginRequest stores record unless its key is already in use. It returns
+	// the stored record when the key is in use and nil when record was stored.
+	BeginRequest(record *models.IdempotencyRecord) (*models.IdempotencyRecord, error)
+	CompleteRequest(key string, status int, body []byte) error
+	// AbandonRequest forgets a key so that the request can be retried.
+	AbandonRequest(key string) error
+}
+
+// idempotencyCompactEvery is how many records the log must hold before it
+// is compacted while running.
+const idempotencyCompactEvery = 1000
+
+// idempotencyRepository persists keys as a JSON-lines log where the last
+// record for a key wins. A key is forgotten by writing it back already
+// expired. Expired keys are dropped when the log is loaded, along with keys
+// whose request was still in progress: that request died with the process
+// and must not block retries. The log is compacted again once most of its
+// records are superseded.
+type idempotencyRepository struct {
+	filePath string
+	log      *journal
+	records  map[string]models.IdempotencyRecord
+	mutex    sync.Mutex
+}
+
+func NewIdempotencyRepository(filePath string) (IdempotencyRepository, error) {
+	repo := &idempotencyRepository{filePath: filePath, records: make(map[string]models.IdempotencyRecord)}
+	if err := repo.loadRecords(); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (r *idempotencyRepository) loadRecords() error {
+	var err error
+	r.log, err = openRecordLog(r.filePath, func(data json.RawMessage) error {
+		var record models.IdempotencyRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		r.records[record.Key] = record
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for key, record := range r.records {
+		if record.Status == 0 {
+			delete(r.records, key)
+		}
+	}
+	r.dropExpired(time.Now())
+	if r.log.records > len(r.records) {
+		return r.compact()
+	}
+	return nil
+}
+
+func (r *idempotencyRepository) dropExpired(now time.Time) {
+	for key, record := range r.records {
+		if !now.Before(record.ExpiresAt) {
+			delete(r.records, key)
+		}
+	}
+}
+
+// compact rewrites the log with only the live records.
+func (r *idempotencyRepository) compact() error {
+	records := make([]interface{}, 0, len(r.records))
+	for _, record := range r.records {
+		records = append(records, record)
+	}
+	return r.log.rewrite(records)
+}
+
+// compactIfStale compacts the log once it holds at least twice as many
+// records as there are keys. A failed compaction leaves the log as it was.
+func (r *idempotencyRepository) compactIfStale() {
+	if r.log.records < idempotencyCompactEvery || r.log.records < 2*len(r.records) {
+		return
+	}
+	r.dropExpired(time.Now())
+	if err := r.compact(); err != nil {
+		log.Printf("Failed to compact %s: %v", r.filePath, err)
+	}
+}
+
+func (r *idempotencyRepository) appendRecord(record models.IdempotencyRecord) error {
+	return r.log.append(record)
+}
+
+func (r *idempotencyRepository) BeginRequest(record *models.IdempotencyRecord) (*models.IdempotencyRecord, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if existing, exists := r.records[record.Key]; exists && time.Now().Before(existing.ExpiresAt) {
+		return &existing, nil
+	}
+	if err := r.appendRecord(*record); err != nil {
+		return nil, err
+	}
+	r.records[record.Key] = *record
+	r.compactIfStale()
+	return nil, nil
+}
+
+func (r *idempotencyRepository) CompleteRequest(key string, status int, body []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	record, exists := r.records[key]
+	if !exists {
+		return ErrIdempotencyKeyNotFound
+	}
+	record.Status = status
+	record.Body = body
+	if err := r.appendRecord(record); err != nil {
+		return err
+	}
+	r.records[key] = record
+	r.compactIfStale()
+	return nil
+}
+
+func (r *idempotencyRepository) AbandonRequest(key string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	record, exists := r.records[key]
+	if !exists {
+		return ErrIdempotencyKeyNotFound
+	}
+	record.ExpiresAt = time.Now().UTC()
+	if err := r.appendRecord(record); err != nil {
+		return err
+	}
+	delete(r.records, key)
+	r.compactIfStale()
+	return nil
+}
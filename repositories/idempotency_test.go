@@ -0,0 +1,61 @@
+package repositories
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"coupon-api/models"
+)
+
+func beginTestRequest(t *testing.T, repo IdempotencyRepository, key string) *models.IdempotencyRecord {
+	t.Helper()
+	now := time.Now().UTC()
+	existing, err := repo.BeginRequest(&models.IdempotencyRecord{Key: key, Fingerprint: "f", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return existing
+}
+
+func TestIdempotencyDropsRequestsInProgressOnLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "idempotency.jsonl")
+	repo, err := NewIdempotencyRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beginTestRequest(t, repo, "done")
+	if err := repo.CompleteRequest("done", 201, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	beginTestRequest(t, repo, "crashed")
+
+	repo, err = NewIdempotencyRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing := beginTestRequest(t, repo, "crashed"); existing != nil {
+		t.Fatalf("key of a request in progress at shutdown is still held: %+v", existing)
+	}
+	if existing := beginTestRequest(t, repo, "done"); existing == nil || existing.Status != 201 {
+		t.Fatalf("completed key = %+v, want its stored response", existing)
+	}
+}
+
+func TestIdempotencyCompactsWhileRunning(t *testing.T) {
+	repo, err := NewIdempotencyRepository(filepath.Join(t.TempDir(), "idempotency.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < idempotencyCompactEvery; i++ {
+		key := fmt.Sprint(i)
+		beginTestRequest(t, repo, key)
+		if err := repo.AbandonRequest(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if records := repo.(*idempotencyRepository).log.records; records >= idempotencyCompactEvery {
+		t.Fatalf("log holds %d records for no live keys", records)
+	}
+}
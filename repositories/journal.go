@@ -0,0 +1,235 @@
+package repositories
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var ErrJournalCorrupt = errors.New("journal is corrupt")
+
+// journal is an append-only log of records, one JSON line each. The lines
+// of a checksummed journal carry a checksum of their record so that a write
+// torn by a crash can be told apart from a complete one. The others hold the
+// bare record, which keeps the JSON-lines stores readable by other tools; a
+// torn line there shows as one that does not parse or does not end.
+type journal struct {
+	path        string
+	checksummed bool
+	file        *os.File
+	size        int64
+	records     int
+}
+
+type journalLine struct {
+	CRC    uint32          `json:"crc"`
+	Record json.RawMessage `json:"record"`
+}
+
+// openJournal replays the journal's records in order and opens it for
+// appending. A bad last record is what a crash during an append leaves
+// behind; it is discarded. A bad record followed by good ones is not, and
+// is reported instead of guessed at.
+func openJournal(path string, replay func(record json.RawMessage) error) (*journal, error) {
+	return openLog(&journal{path: path, checksummed: true}, replay)
+}
+
+// openRecordLog opens a JSON-lines store the way openJournal opens a
+// journal.
+func openRecordLog(path string, replay func(record json.RawMessage) error) (*journal, error) {
+	return openLog(&journal{path: path}, replay)
+}
+
+func openLog(j *journal, replay func(record json.RawMessage) error) (*journal, error) {
+	path := j.path
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if j.size, j.records, err = j.replayData(data, replay); err != nil {
+		return nil, err
+	}
+	if int(j.size) < len(data) {
+		log.Printf("Discarding torn record at the end of %s (%d bytes)", path, len(data)-int(j.size))
+		if err := os.Truncate(path, j.size); err != nil {
+			return nil, err
+		}
+	}
+	j.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// replay reads the journal's records again, for rebuilding the state they
+// were applied to.
+func (j *journal) replay(replay func(record json.RawMessage) error) error {
+	data, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		return err
+	}
+	_, _, err = j.replayData(data[:j.size], replay)
+	return err
+}
+
+// replayData passes each complete record in data to replay, and returns how
+// many bytes and records that covered.
+func (j *journal) replayData(data []byte, replay func(record json.RawMessage) error) (int64, int, error) {
+	var size int64
+	records := 0
+	for int(size) < len(data) {
+		rest := data[size:]
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			break
+		}
+		if len(bytes.TrimSpace(rest[:end])) == 0 {
+			size += int64(end + 1)
+			continue
+		}
+		record, ok := j.decodeLine(rest[:end])
+		if !ok {
+			if end+1 < len(rest) {
+				return 0, 0, fmt.Errorf("%w: %s: bad record at offset %d", ErrJournalCorrupt, j.path, size)
+			}
+			break
+		}
+		if err := replay(record); err != nil {
+			return 0, 0, fmt.Errorf("%s: record at offset %d: %w", j.path, size, err)
+		}
+		size += int64(end + 1)
+		records++
+	}
+	return size, records, nil
+}
+
+func (j *journal) decodeLine(line []byte) (json.RawMessage, bool) {
+	if !j.checksummed {
+		return json.RawMessage(line), json.Valid(line)
+	}
+	var decoded journalLine
+	if err := json.Unmarshal(line, &decoded); err != nil || crc32.ChecksumIEEE(decoded.Record) != decoded.CRC {
+		return nil, false
+	}
+	return decoded.Record, true
+}
+
+func (j *journal) encodeLines(records []interface{}) ([]byte, error) {
+	var lines []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		if j.checksummed {
+			if line, err = json.Marshal(journalLine{CRC: crc32.ChecksumIEEE(line), Record: line}); err != nil {
+				return nil, err
+			}
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	return lines, nil
+}
+
+// append writes the record and waits until it is on disk.
+func (j *journal) append(record interface{}) error {
+	return j.appendBatch([]interface{}{record})
+}
+
+// appendBatch writes the records with a single write and sync. If the write
+// fails part way, the journal is cut back so later records are not appended
+// to a broken one, and none of the records count as written.
+func (j *journal) appendBatch(records []interface{}) error {
+	lines, err := j.encodeLines(records)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(lines); err != nil {
+		j.file.Truncate(j.size)
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		j.file.Truncate(j.size)
+		return err
+	}
+	j.size += int64(len(lines))
+	j.records += len(records)
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// reset empties the journal once its records are in a snapshot.
+func (j *journal) reset() error {
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.size = 0
+	j.records = 0
+	return nil
+}
+
+// rewrite atomically replaces the journal's contents with records, for
+// stores that compact their log by writing out only the live records.
+func (j *journal) rewrite(records []interface{}) error {
+	lines, err := j.encodeLines(records)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(j.path, lines); err != nil {
+		return err
+	}
+	// The open file is the one that was replaced.
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	j.file.Close()
+	j.file = file
+	j.size = int64(len(lines))
+	j.records = len(records)
+	return nil
+}
+
+// writeFileAtomic replaces path with data so that readers, and the file
+// after a crash, see either the old contents or the new, never a mix.
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	// The rename itself is only durable once the directory is synced.
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
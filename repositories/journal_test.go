@@ -0,0 +1,124 @@
+package repositories
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"coupon-api/models"
+)
+
+type testRecord struct {
+	N int `json:"n"`
+}
+
+// writeTestJournal writes records 1 to count to a new journal at path.
+func writeTestJournal(t *testing.T, path string, count int) {
+	t.Helper()
+	j, err := openJournal(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= count; n++ {
+		if err := j.append(testRecord{N: n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replayTestJournal opens the journal at path and returns the records it
+// replayed.
+func replayTestJournal(path string) (*journal, []int, error) {
+	var replayed []int
+	j, err := openJournal(path, func(record json.RawMessage) error {
+		var r testRecord
+		if err := json.Unmarshal(record, &r); err != nil {
+			return err
+		}
+		replayed = append(replayed, r.N)
+		return nil
+	})
+	return j, replayed, err
+}
+
+func TestJournalDropsTornLastRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	writeTestJournal(t, path, 3)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	j, replayed, err := replayTestJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replayed) != 2 || j.records != 2 {
+		t.Fatalf("replayed %v (%d records), want the first 2", replayed, j.records)
+	}
+	// The torn record is cut off, so the next one starts on a line of its own.
+	if err := j.append(testRecord{N: 4}); err != nil {
+		t.Fatal(err)
+	}
+	j.close()
+	if _, replayed, err = replayTestJournal(path); err != nil || len(replayed) != 3 || replayed[2] != 4 {
+		t.Fatalf("after appending replayed %v, %v; want 1, 2 and 4", replayed, err)
+	}
+}
+
+func TestJournalReportsBadRecordBeforeGoodOnes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.journal")
+	writeTestJournal(t, path, 3)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Change a digit of the second record's checksum.
+	second := bytes.IndexByte(data, '\n') + 1
+	digit := second + len(`{"crc":`)
+	data[digit] = '0' + (data[digit]-'0'+1)%10
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := replayTestJournal(path); !errors.Is(err, ErrJournalCorrupt) {
+		t.Fatalf("opening journal with a bad middle record = %v, want %v", err, ErrJournalCorrupt)
+	}
+}
+
+func TestCouponChangesReplayedFromJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coupons.json")
+	repo, err := NewCouponRepository(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	coupon := newTestCoupon(t, repo, &models.Coupon{Code: "FIRST"})
+	coupon.Code = "SECOND"
+	if err := repo.UpdateCoupon(coupon); err != nil {
+		t.Fatal(err)
+	}
+	// Too few changes for a fold, so they are only in the journal.
+	if err := repo.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err = NewCouponRepository(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeWhenDone(t, repo)
+	stored, err := repo.GetCouponByCode("SECOND")
+	if err != nil || stored.ID != coupon.ID || stored.Version != 2 {
+		t.Fatalf("coupon after reopening = %+v, %v; want version 2 of coupon %d", stored, err, coupon.ID)
+	}
+}
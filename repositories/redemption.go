@@ -0,0 +1,233 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"coupon-api/models"
+)
+
+var (
+	ErrRedemptionNotFound = errors.New("redemption not found")
+	ErrRedemptionReversed = errors.New("redemption has already been fully reversed")
+	ErrReversalExceeds    = errors.New("reversal exceeds what is left of the redemption")
+)
+
+type RedemptionRepository interface {
+	CreateRedemption(redemption *models.Redemption) error
+	GetRedemptionByID(id uint) (*models.Redemption, error)
+	ListRedemptions(query models.RedemptionQuery) (*models.RedemptionPage, error)
+	// CreateReversal records a reversal if every line fits in the quantity
+	// not yet reversed, and sets Full when it leaves nothing to reverse.
+	CreateReversal(reversal *models.Reversal) error
+	// CompleteReversal clears Pending once a full reversal's coupon use and
+	// code have been given back.
+	CompleteReversal(id uint) error
+	GetReversals(redemptionID uint) ([]models.Reversal, error)
+}
+
+// redemptionRepository is an append-only ledger stored as JSON lines. Entries
+// are never rewritten, so recording a redemption is a single append.
+// Reversals go to their own ledger next to it.
+type redemptionRepository struct {
+	filePath      string
+	reversalsPath string
+	log           *journal
+	reversalsLog  *journal
+	redemptions   []models.Redemption
+	reversals     []models.Reversal
+	reversed      map[uint]map[uint]uint // redemption ID -> product ID -> reversed quantity
+	mutex         sync.Mutex
+}
+
+func NewRedemptionRepository(filePath string) (RedemptionRepository, error) {
+	repo := &redemptionRepository{
+		filePath:      filePath,
+		reversalsPath: strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".reversals.jsonl",
+		reversed:      make(map[uint]map[uint]uint),
+	}
+	var err error
+	if repo.log, err = openRecordLog(repo.filePath, repo.loadRedemption); err != nil {
+		return nil, err
+	}
+	if repo.reversalsLog, err = openRecordLog(repo.reversalsPath, repo.loadReversal); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+func (r *redemptionRepository) loadRedemption(record json.RawMessage) error {
+	var redemption models.Redemption
+	if err := json.Unmarshal(record, &redemption); err != nil {
+		return err
+	}
+	redemption.Status = models.RedemptionRedeemed
+	r.redemptions = append(r.redemptions, redemption)
+	return nil
+}
+
+func (r *redemptionRepository) loadReversal(record json.RawMessage) error {
+	var reversal models.Reversal
+	if err := json.Unmarshal(record, &reversal); err != nil {
+		return err
+	}
+	// A reversal written again only changed Pending.
+	if reversal.ID != 0 && reversal.ID <= uint(len(r.reversals)) {
+		r.reversals[reversal.ID-1] = reversal
+		return nil
+	}
+	r.reversals = append(r.reversals, reversal)
+	r.applyReversal(reversal)
+	return nil
+}
+
+func (r *redemptionRepository) applyReversal(reversal models.Reversal) {
+	if r.reversed[reversal.RedemptionID] == nil {
+		r.reversed[reversal.RedemptionID] = make(map[uint]uint)
+	}
+	for _, line := range reversal.Lines {
+		r.reversed[reversal.RedemptionID][line.ProductID] += line.Quantity
+	}
+	if reversal.RedemptionID == 0 || reversal.RedemptionID > uint(len(r.redemptions)) {
+		return
+	}
+	redemption := &r.redemptions[reversal.RedemptionID-1]
+	redemption.ReversedDiscount += reversal.Discount
+	redemption.Status = models.RedemptionPartiallyReversed
+	if reversal.Full {
+		redemption.Status = models.RedemptionReversed
+	}
+}
+
+func (r *redemptionRepository) CreateRedemption(redemption *models.Redemption) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	redemption.ID = uint(len(r.redemptions) + 1)
+	redemption.Status = ""
+	if err := r.log.append(redemption); err != nil {
+		return err
+	}
+	redemption.Status = models.RedemptionRedeemed
+	r.redemptions = append(r.redemptions, *redemption)
+	return nil
+}
+
+func (r *redemptionRepository) GetRedemptionByID(id uint) (*models.Redemption, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id == 0 || id > uint(len(r.redemptions)) {
+		return nil, ErrRedemptionNotFound
+	}
+	redemption := r.redemptions[id-1]
+	return &redemption, nil
+}
+
+// ListRedemptions returns the matching redemptions, oldest first. From is
+// inclusive and To is exclusive.
+func (r *redemptionRepository) ListRedemptions(query models.RedemptionQuery) (*models.RedemptionPage, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	page := &models.RedemptionPage{Redemptions: []models.Redemption{}, Offset: query.Offset, Limit: query.Limit}
+	for _, redemption := range r.redemptions {
+		if query.CouponID != 0 && redemption.CouponID != query.CouponID {
+			continue
+		}
+		if query.UserID != 0 && redemption.UserID != query.UserID {
+			continue
+		}
+		if query.From != nil && redemption.RedeemedAt.Before(*query.From) {
+			continue
+		}
+		if query.To != nil && !redemption.RedeemedAt.Before(*query.To) {
+			continue
+		}
+		if page.Total >= query.Offset && len(page.Redemptions) < query.Limit {
+			page.Redemptions = append(page.Redemptions, redemption)
+		}
+		page.Total++
+	}
+	return page, nil
+}
+
+func (r *redemptionRepository) CreateReversal(reversal *models.Reversal) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if reversal.RedemptionID == 0 || reversal.RedemptionID > uint(len(r.redemptions)) {
+		return ErrRedemptionNotFound
+	}
+	redemption := r.redemptions[reversal.RedemptionID-1]
+	if redemption.Status == models.RedemptionReversed {
+		return ErrRedemptionReversed
+	}
+
+	// A redemption can have several lines for the same product, so what is
+	// left is counted per product.
+	redeemed := make(map[uint]uint)
+	for _, line := range redemption.Lines {
+		redeemed[line.ProductID] += line.Quantity
+	}
+	requested := make(map[uint]uint)
+	for _, line := range reversal.Lines {
+		if _, exists := redeemed[line.ProductID]; !exists {
+			return ErrReversalExceeds
+		}
+		requested[line.ProductID] += line.Quantity
+	}
+	full := true
+	for productID, quantity := range redeemed {
+		left := uint(0)
+		if reversed := r.reversed[redemption.ID][productID]; reversed < quantity {
+			left = quantity - reversed
+		}
+		if requested[productID] > left {
+			return ErrReversalExceeds
+		}
+		if requested[productID] < left {
+			full = false
+		}
+	}
+
+	reversal.ID = uint(len(r.reversals) + 1)
+	reversal.Full = full
+	reversal.Pending = full
+	if err := r.reversalsLog.append(reversal); err != nil {
+		return err
+	}
+	r.reversals = append(r.reversals, *reversal)
+	r.applyReversal(*reversal)
+	return nil
+}
+
+func (r *redemptionRepository) CompleteReversal(id uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id == 0 || id > uint(len(r.reversals)) {
+		return ErrRedemptionNotFound
+	}
+	completed := r.reversals[id-1]
+	completed.Pending = false
+	if err := r.reversalsLog.append(completed); err != nil {
+		return err
+	}
+	r.reversals[id-1] = completed
+	return nil
+}
+
+func (r *redemptionRepository) GetReversals(redemptionID uint) ([]models.Reversal, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if redemptionID == 0 || redemptionID > uint(len(r.redemptions)) {
+		return nil, ErrRedemptionNotFound
+	}
+	reversals := []models.Reversal{}
+	for _, reversal := range r.reversals {
+		if reversal.RedemptionID == redemptionID {
+			reversals = append(reversals, reversal)
+		}
+	}
+	return reversals, nil
+}
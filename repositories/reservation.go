@@ -0,0 +1,201 @@
+package repositories
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"coupon-api/models"
+)
+
+var (
+	ErrReservationNotFound = errors.New("reservation not found")
+	ErrReservationClosed   = errors.New("reservation is no longer active")
+)
+
+type ReservationRepository interface {
+	CreateReservation(reservation *models.Reservation) error
+	GetReservationByID(id uint) (*models.Reservation, error)
+	CloseReservation(id uint, status models.ReservationStatus) (*models.Reservation, error)
+	// ReopenReservation makes a reservation active again after closing it
+	// failed part way.
+	ReopenReservation(id uint) error
+	AttachRedemption(id uint, redemptionID uint) error
+	GetExpiredReservations(now time.Time) ([]models.Reservation, error)
+	GetActiveReservations() ([]models.Reservation, error)
+}
+
+// reservationCompactEvery is how many records the log must hold before it is
+// compacted while running.
+const reservationCompactEvery = 1000
+
+// reservationRepository persists reservations as a JSON-lines log where the
+// last record for an ID wins, like the single-use code store, and compacts
+// it the same way.
+type reservationRepository struct {
+	filePath     string
+	log          *journal
+	reservations []models.Reservation
+	mutex        sync.Mutex
+}
+
+func NewReservationRepository(filePath string) (ReservationRepository, error) {
+	repo := &reservationRepository{filePath: filePath}
+	var err error
+	if repo.log, err = openRecordLog(filePath, repo.loadReservation); err != nil {
+		return nil, err
+	}
+	if repo.log.records > len(repo.reservations) {
+		if err := repo.compact(); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// compact rewrites the log with only the latest record of each reservation.
+func (r *reservationRepository) compact() error {
+	records := make([]interface{}, 0, len(r.reservations))
+	for _, reservation := range r.reservations {
+		if reservation.ID != 0 {
+			records = append(records, reservation)
+		}
+	}
+	return r.log.rewrite(records)
+}
+
+// compactIfStale compacts the log once it holds at least twice as many
+// records as there are reservations. A failed compaction leaves the log as
+// it was.
+func (r *reservationRepository) compactIfStale() {
+	if r.log.records < reservationCompactEvery || r.log.records < 2*len(r.reservations) {
+		return
+	}
+	if err := r.compact(); err != nil {
+		log.Printf("Failed to compact %s: %v", r.filePath, err)
+	}
+}
+
+func (r *reservationRepository) loadReservation(record json.RawMessage) error {
+	var reservation models.Reservation
+	if err := json.Unmarshal(record, &reservation); err != nil {
+		return err
+	}
+	if reservation.ID == 0 {
+		return nil
+	}
+	for uint(len(r.reservations)) < reservation.ID {
+		r.reservations = append(r.reservations, models.Reservation{})
+	}
+	r.reservations[reservation.ID-1] = reservation
+	return nil
+}
+
+func (r *reservationRepository) appendRecord(reservation models.Reservation) error {
+	return r.log.append(reservation)
+}
+
+func (r *reservationRepository) CreateReservation(reservation *models.Reservation) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reservation.ID = uint(len(r.reservations) + 1)
+	if err := r.appendRecord(*reservation); err != nil {
+		return err
+	}
+	r.reservations = append(r.reservations, *reservation)
+	return nil
+}
+
+func (r *reservationRepository) GetReservationByID(id uint) (*models.Reservation, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id == 0 || id > uint(len(r.reservations)) || r.reservations[id-1].ID == 0 {
+		return nil, ErrReservationNotFound
+	}
+	reservation := r.reservations[id-1]
+	return &reservation, nil
+}
+
+// CloseReservation moves an active reservation to its final status. Only one
+// caller can close a given reservation; the others get ErrReservationClosed.
+func (r *reservationRepository) CloseReservation(id uint, status models.ReservationStatus) (*models.Reservation, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id == 0 || id > uint(len(r.reservations)) || r.reservations[id-1].ID == 0 {
+		return nil, ErrReservationNotFound
+	}
+	if r.reservations[id-1].Status != models.ReservationActive {
+		return nil, ErrReservationClosed
+	}
+
+	closed := r.reservations[id-1]
+	now := time.Now().UTC()
+	closed.Status = status
+	closed.ClosedAt = &now
+	if err := r.appendRecord(closed); err != nil {
+		return nil, err
+	}
+	r.reservations[id-1] = closed
+	r.compactIfStale()
+	return &closed, nil
+}
+
+func (r *reservationRepository) ReopenReservation(id uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id == 0 || id > uint(len(r.reservations)) || r.reservations[id-1].ID == 0 {
+		return ErrReservationNotFound
+	}
+	reopened := r.reservations[id-1]
+	reopened.Status = models.ReservationActive
+	reopened.ClosedAt = nil
+	if err := r.appendRecord(reopened); err != nil {
+		return err
+	}
+	r.reservations[id-1] = reopened
+	r.compactIfStale()
+	return nil
+}
+
+// AttachRedemption links a committed reservation to its ledger entry.
+func (r *reservationRepository) AttachRedemption(id uint, redemptionID uint) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if id == 0 || id > uint(len(r.reservations)) || r.reservations[id-1].ID == 0 {
+		return ErrReservationNotFound
+	}
+	updated := r.reservations[id-1]
+	updated.RedemptionID = redemptionID
+	if err := r.appendRecord(updated); err != nil {
+		return err
+	}
+	r.reservations[id-1] = updated
+	r.compactIfStale()
+	return nil
+}
+
+func (r *reservationRepository) GetActiveReservations() ([]models.Reservation, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	active := []models.Reservation{}
+	for _, reservation := range r.reservations {
+		if reservation.Status == models.ReservationActive {
+			active = append(active, reservation)
+		}
+	}
+	return active, nil
+}
+
+func (r *reservationRepository) GetExpiredReservations(now time.Time) ([]models.Reservation, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	expired := []models.Reservation{}
+	for _, reservation := range r.reservations {
+		if reservation.Status == models.ReservationActive && !now.Before(reservation.ExpiresAt) {
+			expired = append(expired, reservation)
+		}
+	}
+	return expired, nil
+}
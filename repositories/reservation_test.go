@@ -0,0 +1,51 @@
+package repositories
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"coupon-api/models"
+)
+
+func TestReservationLogIsCompacted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reservations.jsonl")
+	repo, err := NewReservationRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour).UTC()
+	for i := 0; i < 2; i++ {
+		if err := repo.CreateReservation(&models.Reservation{CouponID: 1, Status: models.ReservationActive, ExpiresAt: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < reservationCompactEvery/2; i++ {
+		if _, err := repo.CloseReservation(2, models.ReservationReleased); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.ReopenReservation(2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.CloseReservation(2, models.ReservationCommitted); err != nil {
+		t.Fatal(err)
+	}
+	if records := repo.(*reservationRepository).log.records; records >= reservationCompactEvery {
+		t.Fatalf("log holds %d records for 2 reservations, want it compacted", records)
+	}
+
+	reopened, err := NewReservationRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, status := range map[uint]models.ReservationStatus{1: models.ReservationActive, 2: models.ReservationCommitted} {
+		reservation, err := reopened.GetReservationByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reservation.Status != status {
+			t.Fatalf("reservation %d is %s after reopening, want %s", id, reservation.Status, status)
+		}
+	}
+}
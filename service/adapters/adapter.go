@@ -0,0 +1,69 @@
+package adapters
+
+import (
+	"errors"
+	"io"
+	"sort"
+
+	"coupon-api/models"
+)
+
+var ErrInvalidRow = errors.New("invalid row")
+
+// Conversion is one discount from an external export. Coupon is nil when the
+// row could not be read at all. Unsupported lists every rule of the external
+// discount that has no equivalent here; such rows are reported rather than
+// imported without those rules.
+type Conversion struct {
+	Line        int
+	Coupon      *models.Coupon
+	Unsupported []string
+	Err         error
+}
+
+// ImportAdapter converts another platform's discount export into coupons.
+type ImportAdapter interface {
+	Convert(r io.Reader) ([]Conversion, error)
+}
+
+type ImportAdapterRegistry interface {
+	GetAdapter(name string) ImportAdapter
+	Names() []string
+}
+
+type adapterRegistry struct {
+	adapters map[string]ImportAdapter
+}
+
+// NewImportAdapterRegistry registers a generic CSV adapter for every mapping
+// file in mappingDir, under the mapping's name.
+func NewImportAdapterRegistry(mappingDir string) (ImportAdapterRegistry, error) {
+	registry := &adapterRegistry{
+		adapters: make(map[string]ImportAdapter),
+	}
+	mappings, err := LoadCSVMappings(mappingDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, mapping := range mappings {
+		if _, exists := registry.adapters[mapping.Name]; exists {
+			return nil, errors.New("duplicate import mapping name: " + mapping.Name)
+		}
+		registry.adapters[mapping.Name] = NewCSVMappingAdapter(mapping)
+	}
+	// Adapters for specific platforms can be registered here
+	return registry, nil
+}
+
+func (r *adapterRegistry) GetAdapter(name string) ImportAdapter {
+	return r.adapters[name]
+}
+
+func (r *adapterRegistry) Names() []string {
+	names := make([]string, 0, len(r.adapters))
+	for name := range r.adapters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
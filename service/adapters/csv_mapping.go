@@ -0,0 +1,457 @@
+package adapters
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/service/strategies"
+)
+
+// CSVMapping describes another platform's CSV export: which of its columns
+// hold which part of a discount, and how its values read.
+type CSVMapping struct {
+	Name          string `json:"name"`
+	Delimiter     string `json:"delimiter,omitempty"`      // Defaults to ","
+	ListSeparator string `json:"list_separator,omitempty"` // Separates product and user IDs, defaults to ";"
+	TimeLayout    string `json:"time_layout,omitempty"`    // Go time layout, defaults to RFC 3339
+	// Columns maps the fields below to the export's column headers.
+	Columns map[string]string `json:"columns"`
+	// Types maps the export's discount types to coupon types. Any other
+	// discount type is reported as unsupported.
+	Types map[string]models.CouponType `json:"types"`
+	// PercentValueTypes are the value_type values meaning a percentage. When
+	// value_type is mapped, any other value is reported as unsupported.
+	PercentValueTypes []string `json:"percent_value_types,omitempty"`
+	// Ignore lists columns that are known not to matter. Any other unmapped
+	// column with a value is reported as an unsupported rule.
+	Ignore []string `json:"ignore,omitempty"`
+}
+
+// Fields a mapping can fill in. Which of them a coupon type uses is listed in
+// typeFields; the rest are shared by every type.
+const (
+	fieldCode            = "code"
+	fieldType            = "type"
+	fieldValue           = "value"
+	fieldValueType       = "value_type"
+	fieldMinimumSubtotal = "minimum_subtotal"
+	fieldProductIDs      = "product_ids"
+	fieldBuyProductIDs   = "buy_product_ids"
+	fieldBuyQuantity     = "buy_quantity"
+	fieldGetProductIDs   = "get_product_ids"
+	fieldGetQuantity     = "get_quantity"
+	fieldGetDiscount     = "get_discount"
+	fieldRepetitionLimit = "repetition_limit"
+	fieldStartsAt        = "starts_at"
+	fieldEndsAt          = "ends_at"
+	fieldUsageLimit      = "usage_limit"
+	fieldPerUserLimit    = "per_user_limit"
+	fieldUsers           = "users"
+	fieldStackable       = "stackable"
+)
+
+var commonFields = []string{
+	fieldCode, fieldType, fieldValueType, fieldStartsAt, fieldEndsAt,
+	fieldUsageLimit, fieldPerUserLimit, fieldUsers, fieldStackable,
+}
+
+var typeFields = map[models.CouponType][]string{
+	models.CartWise:    {fieldValue, fieldMinimumSubtotal},
+	models.ProductWise: {fieldValue, fieldProductIDs},
+	models.BxGy: {
+		fieldBuyProductIDs, fieldBuyQuantity, fieldGetProductIDs,
+		fieldGetQuantity, fieldGetDiscount, fieldRepetitionLimit,
+	},
+}
+
+// LoadCSVMappings reads every *.json file in dir. A missing directory means
+// no mappings.
+func LoadCSVMappings(dir string) ([]*CSVMapping, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var mappings []*CSVMapping
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var mapping CSVMapping
+		if err := json.Unmarshal(data, &mapping); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if mapping.Name == "" {
+			mapping.Name = strings.TrimSuffix(filepath.Base(path), ".json")
+		}
+		if err := mapping.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		mappings = append(mappings, &mapping)
+	}
+	return mappings, nil
+}
+
+func (m *CSVMapping) validate() error {
+	known := make(map[string]bool)
+	for _, field := range commonFields {
+		known[field] = true
+	}
+	for _, fields := range typeFields {
+		for _, field := range fields {
+			known[field] = true
+		}
+	}
+	for field := range m.Columns {
+		if !known[field] {
+			return fmt.Errorf("unknown field %q in columns", field)
+		}
+	}
+	if m.Columns[fieldType] == "" {
+		return errors.New("columns must map type")
+	}
+	for source, couponType := range m.Types {
+		if _, ok := typeFields[couponType]; !ok {
+			return fmt.Errorf("type %q maps to %q, expected cart-wise, product-wise or bxgy", source, couponType)
+		}
+	}
+	if len([]rune(m.Delimiter)) > 1 {
+		return errors.New("delimiter must be a single character")
+	}
+	return nil
+}
+
+type csvMappingAdapter struct {
+	mapping *CSVMapping
+	fields  []string        // Mapped fields, sorted so reports are stable
+	mapped  map[string]bool // Mapped column headers
+}
+
+func NewCSVMappingAdapter(mapping *CSVMapping) ImportAdapter {
+	adapter := &csvMappingAdapter{mapping: mapping, mapped: make(map[string]bool)}
+	for field, column := range mapping.Columns {
+		adapter.fields = append(adapter.fields, field)
+		adapter.mapped[column] = true
+	}
+	sort.Strings(adapter.fields)
+	return adapter
+}
+
+func (a *csvMappingAdapter) Convert(r io.Reader) ([]Conversion, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	if a.mapping.Delimiter != "" {
+		reader.Comma = []rune(a.mapping.Delimiter)[0]
+	}
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRow, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for field, column := range a.mapping.Columns {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("%w: column %q for %s is missing", ErrInvalidRow, column, field)
+		}
+	}
+
+	var conversions []Conversion
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return conversions, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			conversions = append(conversions, Conversion{Line: parseErr.Line, Err: fmt.Errorf("%w: %v", ErrInvalidRow, err)})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		conversion := a.convertRecord(header, record)
+		conversion.Line = line
+		conversions = append(conversions, conversion)
+	}
+}
+
+// csvRow reads a record through the mapping.
+type csvRow struct {
+	mapping *CSVMapping
+	header  []string
+	record  []string
+}
+
+func (r *csvRow) get(field string) string {
+	column, ok := r.mapping.Columns[field]
+	if !ok {
+		return ""
+	}
+	for i, name := range r.header {
+		if strings.TrimSpace(name) == column && i < len(r.record) {
+			return strings.TrimSpace(r.record[i])
+		}
+	}
+	return ""
+}
+
+func (a *csvMappingAdapter) convertRecord(header []string, record []string) Conversion {
+	row := &csvRow{mapping: a.mapping, header: header, record: record}
+	coupon := &models.Coupon{Code: row.get(fieldCode)}
+	conversion := Conversion{Coupon: coupon}
+	unsupported := func(format string, args ...interface{}) {
+		conversion.Unsupported = append(conversion.Unsupported, fmt.Sprintf(format, args...))
+	}
+
+	sourceType := row.get(fieldType)
+	couponType, ok := a.mapping.Types[sourceType]
+	if !ok {
+		unsupported("discount type %q has no equivalent coupon type", sourceType)
+	}
+	coupon.Type = couponType
+
+	var err error
+	if coupon.ValidFrom, err = row.time(fieldStartsAt); err == nil {
+		coupon.ExpirationDate, err = row.time(fieldEndsAt)
+	}
+	if err == nil {
+		coupon.UsageLimit, err = row.uint(fieldUsageLimit)
+	}
+	if err == nil {
+		coupon.PerUserLimit, err = row.uint(fieldPerUserLimit)
+	}
+	if err == nil {
+		coupon.Users, err = row.uints(fieldUsers)
+	}
+	if err == nil {
+		if stackable := row.get(fieldStackable); stackable != "" {
+			if coupon.Stackable, err = strconv.ParseBool(stackable); err != nil {
+				err = fmt.Errorf("%w: %s must be true or false", ErrInvalidRow, fieldStackable)
+			}
+		}
+	}
+	if err != nil {
+		conversion.Err = err
+		return conversion
+	}
+	if valueType := row.get(fieldValueType); valueType != "" && !contains(a.mapping.PercentValueTypes, valueType) {
+		unsupported("%q discounts (only percentages are supported)", valueType)
+	}
+
+	switch couponType {
+	case models.CartWise:
+		conversion.Err = a.cartWise(row, coupon)
+	case models.ProductWise:
+		conversion.Err = a.productWise(row, coupon, unsupported)
+	case models.BxGy:
+		conversion.Err = a.bxgy(row, coupon, unsupported)
+	}
+	if conversion.Err != nil {
+		return conversion
+	}
+
+	// Fields that the coupon type has no use for, and columns the mapping
+	// does not mention, would otherwise be lost.
+	if ok {
+		used := make(map[string]bool)
+		for _, field := range typeFields[couponType] {
+			used[field] = true
+		}
+		for _, field := range a.fields {
+			if contains(commonFields, field) || used[field] {
+				continue
+			}
+			if value := row.get(field); value != "" {
+				unsupported("%s %q does not apply to %s coupons", field, value, couponType)
+			}
+		}
+	}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if a.mapped[name] || contains(a.mapping.Ignore, name) || i >= len(record) {
+			continue
+		}
+		if value := strings.TrimSpace(record[i]); value != "" {
+			unsupported("column %q (%s) is not mapped", name, value)
+		}
+	}
+	return conversion
+}
+
+func (a *csvMappingAdapter) cartWise(row *csvRow, coupon *models.Coupon) error {
+	value, err := row.float(fieldValue, true)
+	if err != nil {
+		return err
+	}
+	threshold, err := row.float(fieldMinimumSubtotal, false)
+	if err != nil {
+		return err
+	}
+	coupon.Details = genericDetails(strategies.CartWiseDetails{Threshold: threshold, Discount: value})
+	return nil
+}
+
+func (a *csvMappingAdapter) productWise(row *csvRow, coupon *models.Coupon, unsupported func(string, ...interface{})) error {
+	value, err := row.float(fieldValue, true)
+	if err != nil {
+		return err
+	}
+	products, err := row.uints(fieldProductIDs)
+	if err != nil {
+		return err
+	}
+	switch {
+	case len(products) == 0:
+		return fmt.Errorf("%w: %s is required for product-wise coupons", ErrInvalidRow, fieldProductIDs)
+	case len(products) > 1:
+		unsupported("discount on %d products (a product-wise coupon covers one)", len(products))
+	}
+	coupon.Details = genericDetails(strategies.ProductWiseDetails{ProductID: products[0], Discount: value})
+	return nil
+}
+
+func (a *csvMappingAdapter) bxgy(row *csvRow, coupon *models.Coupon, unsupported func(string, ...interface{})) error {
+	var details strategies.BxGyDetails
+	var err error
+	if details.BuyProducts, err = row.productQuantities(fieldBuyProductIDs, fieldBuyQuantity); err != nil {
+		return err
+	}
+	if details.GetProducts, err = row.productQuantities(fieldGetProductIDs, fieldGetQuantity); err != nil {
+		return err
+	}
+	if details.RepetitionLimit, err = row.uint(fieldRepetitionLimit); err != nil {
+		return err
+	}
+	discount, err := row.float(fieldGetDiscount, false)
+	if err != nil {
+		return err
+	}
+	if row.get(fieldGetDiscount) != "" && discount != 100 {
+		unsupported("get products at %v%% off (only free items are supported)", discount)
+	}
+	coupon.Details = genericDetails(details)
+	return nil
+}
+
+func (r *csvRow) productQuantities(idsField, quantityField string) ([]strategies.ProductQuantity, error) {
+	ids, err := r.uints(idsField)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: %s is required for bxgy coupons", ErrInvalidRow, idsField)
+	}
+	quantity, err := r.uint(quantityField)
+	if err != nil {
+		return nil, err
+	}
+	if quantity == 0 {
+		quantity = 1
+	}
+	products := make([]strategies.ProductQuantity, len(ids))
+	for i, id := range ids {
+		products[i] = strategies.ProductQuantity{ProductID: id, Quantity: quantity}
+	}
+	return products, nil
+}
+
+func (r *csvRow) float(field string, required bool) (float64, error) {
+	value := strings.TrimSuffix(r.get(field), "%")
+	if value == "" {
+		if required {
+			return 0, fmt.Errorf("%w: %s is required", ErrInvalidRow, field)
+		}
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%w: %s must be a non-negative number", ErrInvalidRow, field)
+	}
+	return n, nil
+}
+
+func (r *csvRow) uint(field string) (uint, error) {
+	value := r.get(field)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be a non-negative integer", ErrInvalidRow, field)
+	}
+	return uint(n), nil
+}
+
+func (r *csvRow) uints(field string) ([]uint, error) {
+	value := r.get(field)
+	if value == "" {
+		return nil, nil
+	}
+	separator := r.mapping.ListSeparator
+	if separator == "" {
+		separator = ";"
+	}
+	var ids []uint
+	for _, item := range strings.Split(value, separator) {
+		n, err := strconv.ParseUint(strings.TrimSpace(item), 10, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s must be a list of IDs", ErrInvalidRow, field)
+		}
+		ids = append(ids, uint(n))
+	}
+	return ids, nil
+}
+
+func (r *csvRow) time(field string) (*time.Time, error) {
+	value := r.get(field)
+	if value == "" {
+		return nil, nil
+	}
+	layout := r.mapping.TimeLayout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s must match %s", ErrInvalidRow, field, layout)
+	}
+	return &t, nil
+}
+
+// genericDetails turns typed details into the plain JSON values that coupons
+// created through the API carry.
+func genericDetails(details interface{}) interface{} {
+	var generic interface{}
+	data, _ := json.Marshal(details)
+	json.Unmarshal(data, &generic)
+	return generic
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package adapters
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"coupon-api/models"
+)
+
+func exampleAdapter(t *testing.T) ImportAdapter {
+	t.Helper()
+	registry, err := NewImportAdapterRegistry(filepath.Join("..", "..", "docs", "import_mappings"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	adapter := registry.GetAdapter("example")
+	if adapter == nil {
+		t.Fatalf("adapters = %v, want example", registry.Names())
+	}
+	return adapter
+}
+
+const exampleExport = `Discount Code,Discount Type,Amount,Amount Type,Minimum Order,Product IDs,Buy Product IDs,Buy Quantity,Get Product IDs,Get Quantity,Get Discount,Starts,Ends,Usage Limit,Limit Per Customer,Internal Notes,Region
+TENOFF,order,10,percentage,50,,,,,,,2030-01-01,2030-02-01,100,1,launch,
+SHOES,product,15%,percentage,,7|8,,,,,,,,,,,
+FIVER,order,5,fixed_amount,,,,,,,,,,,,,
+B2G1,buy_x_get_y,,,,,1|2,2,3,1,100,,,,,,
+HALF,buy_x_get_y,,,,,1,1,3,1,50,,,,,,EU
+SHIP,free_shipping,,,,,,,,,,,,,,,
+BAD,order,lots,percentage,,,,,,,,,,,,,
+`
+
+func TestCSVMappingConvertsExport(t *testing.T) {
+	conversions, err := exampleAdapter(t).Convert(strings.NewReader(exampleExport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conversions) != 7 {
+		t.Fatalf("got %d conversions, want 7", len(conversions))
+	}
+
+	tenOff := conversions[0]
+	if tenOff.Err != nil || len(tenOff.Unsupported) != 0 || tenOff.Line != 2 {
+		t.Fatalf("TENOFF = %+v, want it converted from line 2", tenOff)
+	}
+	coupon := tenOff.Coupon
+	wantDetails := map[string]interface{}{"threshold": 50.0, "discount": 10.0}
+	if coupon.Type != models.CartWise || !reflect.DeepEqual(coupon.Details, wantDetails) ||
+		coupon.UsageLimit != 100 || coupon.PerUserLimit != 1 || coupon.ValidFrom.Month() != 1 || coupon.ExpirationDate.Month() != 2 {
+		t.Fatalf("TENOFF coupon = %+v, want a cart-wise 10%% off orders of 50 in January", coupon)
+	}
+	if b2g1 := conversions[3]; b2g1.Err != nil || len(b2g1.Unsupported) != 0 || b2g1.Coupon.Type != models.BxGy {
+		t.Fatalf("B2G1 = %+v, want a bxgy coupon", b2g1)
+	}
+
+	for i, want := range map[int][]string{
+		1: {"discount on 2 products (a product-wise coupon covers one)"},
+		2: {`"fixed_amount" discounts (only percentages are supported)`},
+		4: {"get products at 50% off (only free items are supported)", `column "Region" (EU) is not mapped`},
+		5: {`discount type "free_shipping" has no equivalent coupon type`},
+	} {
+		if !reflect.DeepEqual(conversions[i].Unsupported, want) {
+			t.Errorf("%s unsupported = %q, want %q", conversions[i].Coupon.Code, conversions[i].Unsupported, want)
+		}
+	}
+	if bad := conversions[6]; !errors.Is(bad.Err, ErrInvalidRow) {
+		t.Fatalf("BAD error = %v, want %v", bad.Err, ErrInvalidRow)
+	}
+}
+
+func TestCSVMappingRequiresMappedColumns(t *testing.T) {
+	_, err := exampleAdapter(t).Convert(strings.NewReader("Discount Code,Discount Type\nTENOFF,order\n"))
+	if !errors.Is(err, ErrInvalidRow) {
+		t.Fatalf("Convert = %v, want %v", err, ErrInvalidRow)
+	}
+}
+
+func TestLoadCSVMappingsRejectsBadMappings(t *testing.T) {
+	for name, mapping := range map[string]string{
+		"unknown field": `{"columns":{"type":"Type","colour":"Colour"}}`,
+		"no type":       `{"columns":{"code":"Code"}}`,
+		"bad type":      `{"columns":{"type":"Type"},"types":{"order":"free-shipping"}}`,
+		"delimiter":     `{"columns":{"type":"Type"},"delimiter":"||"}`,
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "platform.json"), []byte(mapping), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadCSVMappings(dir); err == nil {
+			t.Errorf("%s: LoadCSVMappings succeeded, want an error", name)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package strategies
 
 import (
-	"encoding/json"
 	"errors"
 	"math"
 
@@ -23,13 +22,8 @@ type ProductQuantity struct {
 
 func (s *BxGyStrategy) CalculateDiscount(coupon *models.Coupon, cart *models.Cart) (float64, error) {
 	var details BxGyDetails
-	data, err := json.Marshal(coupon.Details)
-	if err != nil {
-		return 0, errors.New("invalid coupon details")
-	}
-	err = json.Unmarshal(data, &details)
-	if err != nil {
-		return 0, errors.New("invalid coupon details")
+	if err := decodeDetails(coupon, &details); err != nil {
+		return 0, err
 	}
 
 	timesApplicable := s.calculateTimesApplicable(details, cart)
@@ -43,13 +37,8 @@ func (s *BxGyStrategy) CalculateDiscount(coupon *models.Coupon, cart *models.Car
 
 func (s *BxGyStrategy) ApplyCoupon(coupon *models.Coupon, cart *models.Cart) (*models.UpdatedCart, error) {
 	var details BxGyDetails
-	data, err := json.Marshal(coupon.Details)
-	if err != nil {
-		return nil, errors.New("invalid coupon details")
-	}
-	err = json.Unmarshal(data, &details)
-	if err != nil {
-		return nil, errors.New("invalid coupon details")
+	if err := decodeDetails(coupon, &details); err != nil {
+		return nil, err
 	}
 
 	timesApplicable := s.calculateTimesApplicable(details, cart)
@@ -75,6 +64,33 @@ func (s *BxGyStrategy) ApplyCoupon(coupon *models.Coupon, cart *models.Cart) (*m
 	return updatedCart, nil
 }
 
+func (s *BxGyStrategy) NearMiss(coupon *models.Coupon, cart *models.Cart) (*models.NearMissCoupon, error) {
+	var details BxGyDetails
+	if err := decodeDetails(coupon, &details); err != nil {
+		return nil, err
+	}
+
+	if s.calculateTimesApplicable(details, cart) > 0 {
+		return nil, nil
+	}
+
+	nearMiss := &models.NearMissCoupon{}
+	for _, bp := range details.BuyProducts {
+		quantityInCart := s.getQuantityInCart(bp.ProductID, cart)
+		if quantityInCart < bp.Quantity {
+			nearMiss.Missing = append(nearMiss.Missing, models.MissingRequirement{
+				Kind:      models.BuyQuantityRequirement,
+				ProductID: bp.ProductID,
+				Required:  float64(bp.Quantity),
+				Actual:    float64(quantityInCart),
+				Missing:   float64(bp.Quantity - quantityInCart),
+			})
+		}
+	}
+	nearMiss.PotentialDiscount = s.calculateTotalDiscount(details, cart, 1)
+	return nearMiss, nil
+}
+
 func (s *BxGyStrategy) calculateTimesApplicable(details BxGyDetails, cart *models.Cart) uint {
 	minTimes := uint(math.MaxUint32)
 	for _, bp := range details.BuyProducts {
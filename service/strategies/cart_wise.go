@@ -1,9 +1,6 @@
 package strategies
 
 import (
-	"encoding/json"
-	"errors"
-
 	"coupon-api/models"
 )
 
@@ -16,17 +13,12 @@ type CartWiseDetails struct {
 
 func (s *CartWiseStrategy) CalculateDiscount(coupon *models.Coupon, cart *models.Cart) (float64, error) {
 	var details CartWiseDetails
-	data, err := json.Marshal(coupon.Details)
-	if err != nil {
-		return 0, errors.New("invalid coupon details")
-	}
-	err = json.Unmarshal(data, &details)
-	if err != nil {
-		return 0, errors.New("invalid coupon details")
+	if err := decodeDetails(coupon, &details); err != nil {
+		return 0, err
 	}
 
 	totalAmount := calculateCartTotal(cart)
-	if totalAmount > details.Threshold {
+	if meetsThreshold(totalAmount, details.Threshold) {
 		discount := totalAmount * (details.Discount / 100)
 		return discount, nil
 	}
@@ -48,6 +40,39 @@ func (s *CartWiseStrategy) ApplyCoupon(coupon *models.Coupon, cart *models.Cart)
 	return updatedCart, nil
 }
 
+func (s *CartWiseStrategy) NearMiss(coupon *models.Coupon, cart *models.Cart) (*models.NearMissCoupon, error) {
+	var details CartWiseDetails
+	if err := decodeDetails(coupon, &details); err != nil {
+		return nil, err
+	}
+
+	totalAmount := calculateCartTotal(cart)
+	if meetsThreshold(totalAmount, details.Threshold) {
+		return nil, nil
+	}
+	return &models.NearMissCoupon{
+		Missing: []models.MissingRequirement{{
+			Kind:     models.CartTotalRequirement,
+			Required: details.Threshold,
+			Actual:   totalAmount,
+			// The total must exceed the threshold, so a cart right at it
+			// still misses the smallest amount there is.
+			Missing: details.Threshold - totalAmount + minimumAmount,
+		}},
+		PotentialDiscount: details.Threshold * (details.Discount / 100),
+		DiscountPercent:   details.Discount,
+	}, nil
+}
+
+// minimumAmount is the smallest amount of money, one cent.
+const minimumAmount = 0.01
+
+// meetsThreshold reports whether a cart total qualifies for a cart-wise
+// coupon, which takes a total above the threshold.
+func meetsThreshold(total float64, threshold float64) bool {
+	return total > threshold
+}
+
 func calculateCartTotal(cart *models.Cart) float64 {
 	total := 0.0
 	for _, item := range cart.Items {
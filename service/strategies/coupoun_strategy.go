@@ -1,12 +1,18 @@
 package strategies
 
 import (
+	"encoding/json"
+	"errors"
+
 	"coupon-api/models"
 )
 
 type CouponStrategy interface {
 	CalculateDiscount(coupon *models.Coupon, cart *models.Cart) (float64, error)
 	ApplyCoupon(coupon *models.Coupon, cart *models.Cart) (*models.UpdatedCart, error)
+	// NearMiss reports what the cart still lacks for the coupon to give a
+	// discount. It returns nil when the coupon already applies.
+	NearMiss(coupon *models.Coupon, cart *models.Cart) (*models.NearMissCoupon, error)
 }
 
 type CouponStrategyFactory interface {
@@ -31,3 +37,31 @@ func NewCouponStrategyFactory() CouponStrategyFactory {
 func (f *strategyFactory) GetStrategy(couponType models.CouponType) CouponStrategy {
 	return f.strategies[couponType]
 }
+
+// ValidateDetails checks that a coupon's details have the shape its type's
+// strategy reads. Types without a strategy take any details.
+func ValidateDetails(coupon *models.Coupon) error {
+	var details interface{}
+	switch coupon.Type {
+	case models.CartWise:
+		details = &CartWiseDetails{}
+	case models.ProductWise:
+		details = &ProductWiseDetails{}
+	case models.BxGy:
+		details = &BxGyDetails{}
+	default:
+		return nil
+	}
+	return decodeDetails(coupon, details)
+}
+
+func decodeDetails(coupon *models.Coupon, details interface{}) error {
+	data, err := json.Marshal(coupon.Details)
+	if err != nil {
+		return errors.New("invalid coupon details")
+	}
+	if err := json.Unmarshal(data, details); err != nil {
+		return errors.New("invalid coupon details")
+	}
+	return nil
+}
@@ -1,9 +1,6 @@
 package strategies
 
 import (
-	"encoding/json"
-	"errors"
-
 	"coupon-api/models"
 )
 
@@ -16,13 +13,8 @@ type ProductWiseDetails struct {
 
 func (s *ProductWiseStrategy) CalculateDiscount(coupon *models.Coupon, cart *models.Cart) (float64, error) {
 	var details ProductWiseDetails
-	data, err := json.Marshal(coupon.Details)
-	if err != nil {
-		return 0, errors.New("invalid coupon details")
-	}
-	err = json.Unmarshal(data, &details)
-	if err != nil {
-		return 0, errors.New("invalid coupon details")
+	if err := decodeDetails(coupon, &details); err != nil {
+		return 0, err
 	}
 
 	totalDiscount := 0.0
@@ -36,13 +28,8 @@ func (s *ProductWiseStrategy) CalculateDiscount(coupon *models.Coupon, cart *mod
 
 func (s *ProductWiseStrategy) ApplyCoupon(coupon *models.Coupon, cart *models.Cart) (*models.UpdatedCart, error) {
 	var details ProductWiseDetails
-	data, err := json.Marshal(coupon.Details)
-	if err != nil {
-		return nil, errors.New("invalid coupon details")
-	}
-	err = json.Unmarshal(data, &details)
-	if err != nil {
-		return nil, errors.New("invalid coupon details")
+	if err := decodeDetails(coupon, &details); err != nil {
+		return nil, err
 	}
 
 	totalDiscount := 0.0
@@ -65,3 +52,27 @@ func (s *ProductWiseStrategy) ApplyCoupon(coupon *models.Coupon, cart *models.Ca
 	}
 	return updatedCart, nil
 }
+
+func (s *ProductWiseStrategy) NearMiss(coupon *models.Coupon, cart *models.Cart) (*models.NearMissCoupon, error) {
+	var details ProductWiseDetails
+	if err := decodeDetails(coupon, &details); err != nil {
+		return nil, err
+	}
+
+	for _, item := range cart.Items {
+		if item.ProductID == details.ProductID {
+			return nil, nil
+		}
+	}
+	// The product's price is unknown until it is in the cart, so only the
+	// percentage can be reported.
+	return &models.NearMissCoupon{
+		Missing: []models.MissingRequirement{{
+			Kind:      models.ProductRequirement,
+			ProductID: details.ProductID,
+			Required:  1,
+			Missing:   1,
+		}},
+		DiscountPercent: details.Discount,
+	}, nil
+}
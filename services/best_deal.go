@@ -0,0 +1,340 @@
+package services
+
+import (
+	"errors"
+	"sort"
+
+	"coupon-api/models"
+)
+
+const (
+	// bestDealSearchBudget bounds how many coupon combinations are evaluated
+	// so that checkout latency stays predictable for carts with many coupons.
+	// It counts combinations rather than time, so the same cart and coupons
+	// always get the same deal.
+	bestDealSearchBudget = 20000
+	// bestDealMaxCandidates caps how many applicable coupons enter the search,
+	// keeping the ones with the highest stand-alone discount.
+	bestDealMaxCandidates = 16
+	discountEpsilon       = 1e-9
+)
+
+var ErrNoApplicableCoupons = errors.New("no applicable coupons")
+
+type dealCandidate struct {
+	coupon   models.Coupon
+	discount float64
+}
+
+type dealSearch struct {
+	service    *couponService
+	cart       *models.Cart
+	candidates []dealCandidate
+	remaining  []float64 // remaining[i] is the sum of stand-alone discounts of candidates[i:]
+	budget     int       // combinations left to evaluate
+	exhaustive bool
+
+	bestDiscount    float64
+	bestIDs         []uint
+	bestCart        *models.UpdatedCart
+	bestAllocations []couponAllocation
+}
+
+func (s *couponService) GetBestDeal(cart *models.Cart) (*models.BestDeal, error) {
+	bestDeal, _, err := s.findBestDeal(cart)
+	return bestDeal, err
+}
+
+func (s *couponService) findBestDeal(cart *models.Cart) (*models.BestDeal, []couponAllocation, error) {
+	candidates, err := s.collectCandidates(cart)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, nil, nil
+	}
+
+	// Trying the largest discounts first finds a good incumbent early, which
+	// makes the upper-bound pruning below far more effective.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].discount != candidates[j].discount {
+			return candidates[i].discount > candidates[j].discount
+		}
+		return candidates[i].coupon.ID < candidates[j].coupon.ID
+	})
+	if len(candidates) > bestDealMaxCandidates {
+		candidates = candidates[:bestDealMaxCandidates]
+	}
+
+	search := &dealSearch{
+		service:    s,
+		cart:       cart,
+		candidates: candidates,
+		remaining:  make([]float64, len(candidates)+1),
+		budget:     bestDealSearchBudget,
+		exhaustive: true,
+	}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		search.remaining[i] = search.remaining[i+1] + candidates[i].discount
+	}
+	search.run(0, nil, 0)
+
+	if search.bestCart == nil {
+		return nil, nil, nil
+	}
+	bestDeal := &models.BestDeal{
+		CouponIDs:     search.bestIDs,
+		TotalDiscount: search.bestDiscount,
+		UpdatedCart:   search.bestCart,
+		Exhaustive:    search.exhaustive,
+	}
+	sort.Slice(search.bestAllocations, func(i, j int) bool {
+		return search.bestAllocations[i].coupon.ID < search.bestAllocations[j].coupon.ID
+	})
+	for _, allocation := range search.bestAllocations {
+		bestDeal.Breakdown = append(bestDeal.Breakdown, models.ApplicableCoupon{
+			CouponID: allocation.coupon.ID,
+			Type:     allocation.coupon.Type,
+			Discount: allocation.discount(),
+		})
+	}
+	return bestDeal, search.bestAllocations, nil
+}
+
+// ReserveBestDeal finds the best combination for the cart and reserves every
+// coupon in it. If any reservation fails, the ones already made are released.
+func (s *couponService) ReserveBestDeal(request *models.ReservationRequest) (*models.BestDeal, error) {
+	ttl, err := reservationTTL(request.TTLSeconds)
+	if err != nil {
+		return nil, err
+	}
+	cart := &request.Cart
+	bestDeal, allocations, err := s.findBestDeal(cart)
+	if err != nil {
+		return nil, err
+	}
+	if bestDeal == nil {
+		return nil, ErrNoApplicableCoupons
+	}
+
+	for _, allocation := range allocations {
+		reservation, err := s.hold(allocation.coupon, nil, cart, nil, allocation.lines, ttl)
+		if err != nil {
+			for _, id := range bestDeal.ReservationIDs {
+				s.ReleaseReservation(id)
+			}
+			return nil, err
+		}
+		bestDeal.ReservationIDs = append(bestDeal.ReservationIDs, reservation.ID)
+	}
+	return bestDeal, nil
+}
+
+// run walks combinations in candidate order. A combination's real discount
+// never exceeds the sum of its members' stand-alone discounts, so a branch
+// is cut as soon as that bound cannot beat the best deal found so far.
+func (d *dealSearch) run(start int, chosen []int, current float64) {
+	for i := start; i < len(d.candidates); i++ {
+		if d.budget == 0 {
+			d.exhaustive = false
+			return
+		}
+		if d.bestCart != nil && current+d.remaining[i] < d.bestDiscount-discountEpsilon {
+			return
+		}
+		if !d.canStack(chosen, i) {
+			continue
+		}
+
+		d.budget--
+		combination := append(append([]int{}, chosen...), i)
+		coupons := make([]*models.Coupon, len(combination))
+		for j, idx := range combination {
+			coupons[j] = &d.candidates[idx].coupon
+		}
+		updatedCart, allocations, err := d.service.evaluateCombination(coupons, d.cart)
+		if err != nil {
+			continue
+		}
+		d.consider(coupons, updatedCart, allocations)
+		d.run(i+1, combination, updatedCart.TotalDiscount)
+	}
+}
+
+// canStack enforces the stacking rules: a non-stackable coupon is only ever
+// used on its own, and a cart can carry at most one cart-wise discount.
+func (d *dealSearch) canStack(chosen []int, next int) bool {
+	if len(chosen) == 0 {
+		return true
+	}
+	candidate := d.candidates[next].coupon
+	if !candidate.Stackable {
+		return false
+	}
+	for _, idx := range chosen {
+		coupon := d.candidates[idx].coupon
+		if !coupon.Stackable {
+			return false
+		}
+		if coupon.Type == models.CartWise && candidate.Type == models.CartWise {
+			return false
+		}
+	}
+	return true
+}
+
+// consider keeps the combination with the highest saving. Ties go to the
+// combination with fewer coupons, then to the lowest coupon IDs.
+func (d *dealSearch) consider(coupons []*models.Coupon, updatedCart *models.UpdatedCart, allocations []couponAllocation) {
+	ids := make([]uint, len(coupons))
+	for i, coupon := range coupons {
+		ids[i] = coupon.ID
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	discount := updatedCart.TotalDiscount
+	if d.bestCart != nil {
+		if discount < d.bestDiscount-discountEpsilon {
+			return
+		}
+		if discount <= d.bestDiscount+discountEpsilon && !preferIDs(ids, d.bestIDs) {
+			return
+		}
+	}
+	d.bestDiscount = discount
+	d.bestIDs = ids
+	d.bestCart = updatedCart
+	d.bestAllocations = allocations
+}
+
+func preferIDs(ids, other []uint) bool {
+	if len(ids) != len(other) {
+		return len(ids) < len(other)
+	}
+	for i := range ids {
+		if ids[i] != other[i] {
+			return ids[i] < other[i]
+		}
+	}
+	return false
+}
+
+// couponAllocation is one coupon's share of a combination's discount, per
+// cart item.
+type couponAllocation struct {
+	coupon *models.Coupon
+	lines  []float64
+}
+
+func (a couponAllocation) discount() float64 {
+	total := 0.0
+	for _, line := range a.lines {
+		total += line
+	}
+	return total
+}
+
+// evaluateCombination applies item-level coupons to the original prices and
+// then computes cart-wise coupons on the total left after those discounts.
+// It also returns how the discount splits between the coupons.
+func (s *couponService) evaluateCombination(coupons []*models.Coupon, cart *models.Cart) (*models.UpdatedCart, []couponAllocation, error) {
+	base := withoutDiscounts(cart)
+	items := make([]models.CartItem, len(base.Items))
+	copy(items, base.Items)
+
+	var allocations []couponAllocation
+	var cartLevel []*models.Coupon
+	for _, coupon := range coupons {
+		if coupon.Type == models.CartWise {
+			cartLevel = append(cartLevel, coupon)
+			continue
+		}
+		strategy := s.strategyFactory.GetStrategy(coupon.Type)
+		if strategy == nil {
+			return nil, nil, errors.New("unsupported coupon type")
+		}
+		updatedCart, err := strategy.ApplyCoupon(coupon, base)
+		if err != nil {
+			return nil, nil, err
+		}
+		allocation := couponAllocation{coupon: coupon, lines: make([]float64, len(items))}
+		for i := range items {
+			items[i].TotalDiscount += updatedCart.Items[i].TotalDiscount
+			allocation.lines[i] = updatedCart.Items[i].TotalDiscount
+		}
+		allocations = append(allocations, allocation)
+	}
+
+	lineDiscount := 0.0
+	net := &models.Cart{UserID: cart.UserID, Items: make([]models.CartItem, len(items))}
+	for i, item := range items {
+		gross := item.Price * float64(item.Quantity)
+		if item.TotalDiscount > gross {
+			// Scale every coupon's share down so the line is at most free.
+			for _, allocation := range allocations {
+				allocation.lines[i] *= gross / item.TotalDiscount
+			}
+			items[i].TotalDiscount = gross
+		}
+		lineDiscount += items[i].TotalDiscount
+		net.Items[i] = item
+		net.Items[i].Price = (gross - items[i].TotalDiscount) / float64(item.Quantity)
+		net.Items[i].TotalDiscount = 0
+	}
+
+	cartDiscount := 0.0
+	for _, coupon := range cartLevel {
+		strategy := s.strategyFactory.GetStrategy(coupon.Type)
+		if strategy == nil {
+			return nil, nil, errors.New("unsupported coupon type")
+		}
+		discount, err := strategy.CalculateDiscount(coupon, net)
+		if err != nil {
+			return nil, nil, err
+		}
+		allocations = append(allocations, couponAllocation{coupon: coupon, lines: spreadDiscount(discount, net)})
+		cartDiscount += discount
+	}
+
+	totalPrice := cartTotal(base)
+	totalDiscount := lineDiscount + cartDiscount
+	return &models.UpdatedCart{
+		Items:         items,
+		TotalPrice:    totalPrice,
+		TotalDiscount: totalDiscount,
+		FinalPrice:    totalPrice - totalDiscount,
+	}, allocations, nil
+}
+
+// withoutDiscounts copies the cart with every item's discount cleared. Item
+// discounts are only ever computed here; whatever the client sent is ignored.
+func withoutDiscounts(cart *models.Cart) *models.Cart {
+	base := &models.Cart{UserID: cart.UserID, Items: make([]models.CartItem, len(cart.Items))}
+	for i, item := range cart.Items {
+		item.TotalDiscount = 0
+		base.Items[i] = item
+	}
+	return base
+}
+
+// spreadDiscount splits a cart-level discount over the cart's items in
+// proportion to their value.
+func spreadDiscount(discount float64, cart *models.Cart) []float64 {
+	lines := make([]float64, len(cart.Items))
+	total := cartTotal(cart)
+	if total <= 0 {
+		return lines
+	}
+	for i, item := range cart.Items {
+		lines[i] = discount * item.Price * float64(item.Quantity) / total
+	}
+	return lines
+}
+
+func cartTotal(cart *models.Cart) float64 {
+	total := 0.0
+	for _, item := range cart.Items {
+		total += item.Price * float64(item.Quantity)
+	}
+	return total
+}
@@ -0,0 +1,41 @@
+package services
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"coupon-api/models"
+)
+
+func TestGetBestDealPicksOptimalCombination(t *testing.T) {
+	s := newTestService(t)
+	// Alone: 25, 100, 25, 75 and 30. Stacked, the product-wise 50% leaves
+	// 150 in the cart, so the 12% cart-wise coupon adds 18 where the 10% one
+	// adds 15; the two cart-wise coupons cannot stack.
+	createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Stackable: true, Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+	productHalf := createTestCoupon(t, s, &models.Coupon{Type: models.ProductWise, Stackable: true, Details: map[string]interface{}{"product_id": 1, "discount": 50}})
+	createTestCoupon(t, s, &models.Coupon{Type: models.ProductWise, Details: map[string]interface{}{"product_id": 2, "discount": 50}})
+	createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 100, "discount": 30}})
+	cartTwelve := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Stackable: true, Details: map[string]interface{}{"threshold": 100, "discount": 12}})
+
+	cart := &models.Cart{Items: []models.CartItem{
+		{ProductID: 1, Quantity: 2, Price: 100},
+		{ProductID: 2, Quantity: 1, Price: 50},
+	}}
+	for attempt := 0; attempt < 3; attempt++ {
+		deal, err := s.GetBestDeal(cart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []uint{productHalf.ID, cartTwelve.ID}; !reflect.DeepEqual(deal.CouponIDs, want) {
+			t.Fatalf("coupon IDs = %v, want %v", deal.CouponIDs, want)
+		}
+		if math.Abs(deal.TotalDiscount-118) > 1e-6 {
+			t.Fatalf("total discount = %v, want 118", deal.TotalDiscount)
+		}
+		if !deal.Exhaustive {
+			t.Fatal("search of five coupons was not exhaustive")
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+)
+
+var (
+	ErrUnsupportedFormat = errors.New("unsupported format: expected csv or jsonl")
+	ErrInvalidImportMode = errors.New("invalid import mode: expected all_or_nothing or best_effort")
+	ErrInvalidRow        = errors.New("invalid row")
+	// ErrImportRejected is returned with the result of an all-or-nothing
+	// import that had invalid rows, in which case nothing was created.
+	ErrImportRejected = errors.New("import has invalid rows, no coupons were created")
+)
+
+// couponColumns are the CSV columns, in export order. Imports find columns by
+// header name; id is ignored on import since new coupons get new IDs.
+var couponColumns = []string{
+	"id", "code", "type", "status", "valid_from", "expiration_date",
+	"usage_limit", "per_user_limit", "users", "stackable", "details",
+}
+
+const (
+	exportPageSize = 500
+	// maxImportLine is the longest JSON line an import accepts.
+	maxImportLine = 1024 * 1024
+)
+
+type importRow struct {
+	line        int
+	coupon      *models.Coupon
+	unsupported []string
+	err         error
+}
+
+// ImportCoupons validates every row before creating any coupon, so a dry run
+// reports exactly what a real import would do.
+func (s *couponService) ImportCoupons(r io.Reader, options models.ImportOptions, actor string) (*models.ImportResult, error) {
+	if err := checkImportMode(&options); err != nil {
+		return nil, err
+	}
+	var rows []importRow
+	var err error
+	switch options.Format {
+	case models.BulkCSV:
+		rows, err = readCSVCoupons(r)
+	case models.BulkJSONLines:
+		rows, err = readJSONLinesCoupons(r)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := &models.ImportResult{Format: options.Format}
+	return result, s.importRows(rows, options, result, actor)
+}
+
+func checkImportMode(options *models.ImportOptions) error {
+	if options.Mode == "" {
+		options.Mode = models.ImportAllOrNothing
+	}
+	if options.Mode != models.ImportAllOrNothing && options.Mode != models.ImportBestEffort {
+		return ErrInvalidImportMode
+	}
+	return nil
+}
+
+// importRows validates the rows and creates the valid ones as the options
+// say, filling in the result.
+func (s *couponService) importRows(rows []importRow, options models.ImportOptions, result *models.ImportResult, actor string) error {
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	result.Mode = options.Mode
+	result.DryRun = options.DryRun
+	result.Total = len(rows)
+	result.CouponIDs = []uint{}
+	result.Errors = []models.ImportRowError{}
+	var valid []importRow
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		if row.err == nil {
+			row.err = s.validateImport(row.coupon, seen)
+		}
+		if row.err != nil {
+			result.Errors = append(result.Errors, row.failure())
+			continue
+		}
+		valid = append(valid, row)
+	}
+	result.Valid = len(valid)
+	if options.DryRun {
+		return nil
+	}
+	if options.Mode == models.ImportAllOrNothing && len(result.Errors) > 0 {
+		return ErrImportRejected
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+
+	var created []*models.Coupon
+	if options.Mode == models.ImportAllOrNothing {
+		for _, row := range valid {
+			created = append(created, row.coupon)
+		}
+		if err := s.repo.CreateCoupons(created); err != nil {
+			return err
+		}
+	} else {
+		// Coupons are created one at a time so that a code taken since
+		// validation only fails its own row.
+		for _, row := range valid {
+			if row.err = s.repo.CreateCoupon(row.coupon); row.err != nil {
+				result.Errors = append(result.Errors, row.failure())
+				continue
+			}
+			created = append(created, row.coupon)
+		}
+	}
+	for _, coupon := range created {
+		s.recordRevision(models.RevisionCreated, actor, nil, coupon, 0)
+		result.CouponIDs = append(result.CouponIDs, coupon.ID)
+	}
+	result.Created = len(created)
+	return nil
+}
+
+// validateImport applies the same checks as CreateCoupon, and also rejects a
+// code used by an earlier row of the same import. Paused and archived
+// coupons may be imported so that an export can be loaded back as it was.
+func (s *couponService) validateImport(coupon *models.Coupon, seen map[string]bool) error {
+	if err := ValidateCoupon(coupon); err != nil {
+		return err
+	}
+	if err := s.normalizeCouponCode(coupon); err != nil {
+		return err
+	}
+	if coupon.Code != "" {
+		if _, err := s.repo.GetCouponByCode(coupon.Code); err == nil || seen[coupon.Code] {
+			return fmt.Errorf("%w: %s", repositories.ErrDuplicateCode, coupon.Code)
+		}
+		seen[coupon.Code] = true
+	}
+	coupon.ID, coupon.Version, coupon.UsedCount, coupon.ReservedCount = 0, 0, 0, 0
+	coupon.ExternalKey = ""
+	if coupon.Status == models.CouponPaused || coupon.Status == models.CouponArchived {
+		return checkSchedule(coupon)
+	}
+	return prepareStatus(coupon)
+}
+
+func (row importRow) failure() models.ImportRowError {
+	failure := models.ImportRowError{Line: row.line, Error: row.err.Error(), Unsupported: row.unsupported}
+	if row.coupon != nil {
+		failure.Code = row.coupon.Code
+	}
+	return failure
+}
+
+func readJSONLinesCoupons(r io.Reader) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		row := importRow{line: line, coupon: &models.Coupon{}}
+		if err := json.Unmarshal(text, row.coupon); err != nil {
+			row.err = fmt.Errorf("%w: %v", ErrInvalidRow, err)
+		}
+		rows = append(rows, row)
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return nil, fmt.Errorf("%w: line %d is longer than %d bytes", ErrInvalidRow, line+1, maxImportLine)
+	}
+	return rows, scanner.Err()
+}
+
+func readCSVCoupons(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRow, err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, required := range []string{"type", "details"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("%w: missing %s column", ErrInvalidRow, required)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{line: parseErr.Line, coupon: &models.Coupon{}, err: fmt.Errorf("%w: %v", ErrInvalidRow, err)})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		coupon, err := parseCSVCoupon(field)
+		rows = append(rows, importRow{line: line, coupon: coupon, err: err})
+	}
+}
+
+func parseCSVCoupon(field func(string) string) (*models.Coupon, error) {
+	coupon := &models.Coupon{
+		Code:   field("code"),
+		Type:   models.CouponType(field("type")),
+		Status: models.CouponStatus(field("status")),
+	}
+	var err error
+	if coupon.ValidFrom, err = parseCSVTime(field("valid_from"), "valid_from"); err != nil {
+		return coupon, err
+	}
+	if coupon.ExpirationDate, err = parseCSVTime(field("expiration_date"), "expiration_date"); err != nil {
+		return coupon, err
+	}
+	if coupon.UsageLimit, err = parseCSVUint(field("usage_limit"), "usage_limit"); err != nil {
+		return coupon, err
+	}
+	if coupon.PerUserLimit, err = parseCSVUint(field("per_user_limit"), "per_user_limit"); err != nil {
+		return coupon, err
+	}
+	if users := field("users"); users != "" {
+		for _, user := range strings.Split(users, ";") {
+			id, err := parseCSVUint(strings.TrimSpace(user), "users")
+			if err != nil {
+				return coupon, err
+			}
+			coupon.Users = append(coupon.Users, id)
+		}
+	}
+	if stackable := field("stackable"); stackable != "" {
+		if coupon.Stackable, err = strconv.ParseBool(stackable); err != nil {
+			return coupon, fmt.Errorf("%w: stackable must be true or false", ErrInvalidRow)
+		}
+	}
+	if details := field("details"); details != "" {
+		if err := json.Unmarshal([]byte(details), &coupon.Details); err != nil {
+			return coupon, fmt.Errorf("%w: details must be a JSON object", ErrInvalidRow)
+		}
+	}
+	return coupon, nil
+}
+
+func parseCSVTime(value string, name string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s must be an RFC 3339 timestamp", ErrInvalidRow, name)
+	}
+	return &t, nil
+}
+
+func parseCSVUint(value string, name string) (uint, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be a non-negative integer", ErrInvalidRow, name)
+	}
+	return uint(n), nil
+}
+
+// ExportCoupons writes the coupon definitions page by page, so the whole set
+// is never held in memory at once. Statuses are the stored ones, which
+// ImportCoupons accepts back.
+func (s *couponService) ExportCoupons(w io.Writer, format models.BulkFormat, includeArchived bool) error {
+	var write func(coupon *models.Coupon) error
+	flush := func() error { return nil }
+	switch format {
+	case models.BulkCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(couponColumns); err != nil {
+			return err
+		}
+		write = func(coupon *models.Coupon) error { return writeCSVCoupon(writer, coupon) }
+		flush = func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+	case models.BulkJSONLines:
+		encoder := json.NewEncoder(w)
+		write = func(coupon *models.Coupon) error { return encoder.Encode(coupon) }
+	default:
+		return ErrUnsupportedFormat
+	}
+
+	query := models.CouponQuery{IncludeArchived: includeArchived, Limit: exportPageSize}
+	for {
+		page, err := s.repo.ListCoupons(query)
+		if err != nil {
+			return err
+		}
+		for i := range page.Coupons {
+			if err := write(&page.Coupons[i]); err != nil {
+				return err
+			}
+		}
+		if err := flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+		if page.NextCursor == "" {
+			return nil
+		}
+		query.Cursor = page.NextCursor
+	}
+}
+
+func writeCSVCoupon(writer *csv.Writer, coupon *models.Coupon) error {
+	details, err := json.Marshal(coupon.Details)
+	if err != nil {
+		return err
+	}
+	users := make([]string, len(coupon.Users))
+	for i, user := range coupon.Users {
+		users[i] = strconv.FormatUint(uint64(user), 10)
+	}
+	return writer.Write([]string{
+		strconv.FormatUint(uint64(coupon.ID), 10),
+		coupon.Code,
+		string(coupon.Type),
+		string(coupon.Status),
+		formatCSVTime(coupon.ValidFrom),
+		formatCSVTime(coupon.ExpirationDate),
+		formatCSVUint(coupon.UsageLimit),
+		formatCSVUint(coupon.PerUserLimit),
+		strings.Join(users, ";"),
+		strconv.FormatBool(coupon.Stackable),
+		string(details),
+	})
+}
+
+func formatCSVTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func formatCSVUint(n uint) string {
+	if n == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(n), 10)
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"coupon-api/models"
+)
+
+const importCSV = `code,type,details,usage_limit
+WELCOME,cart-wise,"{""threshold"":100,""discount"":10}",5
+BROKEN,bxgy,not json,
+SPRING,product-wise,"{""product_id"":1,""discount"":20}",
+welcome,cart-wise,"{""threshold"":50,""discount"":5}",
+`
+
+func TestImportAllOrNothingCreatesNothingWithInvalidRows(t *testing.T) {
+	s := newTestService(t)
+	result, err := s.ImportCoupons(strings.NewReader(importCSV), models.ImportOptions{Format: models.BulkCSV}, "test")
+	if !errors.Is(err, ErrImportRejected) {
+		t.Fatalf("ImportCoupons = %v, want %v", err, ErrImportRejected)
+	}
+	if result.Total != 4 || result.Valid != 2 || result.Created != 0 || len(result.Errors) != 2 {
+		t.Fatalf("result = %+v, want 2 of 4 rows valid and none created", result)
+	}
+	if result.Errors[0].Line != 3 || result.Errors[1].Line != 5 || result.Errors[1].Code != "WELCOME" {
+		t.Fatalf("errors = %+v, want lines 3 and 5, the second a duplicate of WELCOME", result.Errors)
+	}
+	if page, err := s.ListCoupons(models.CouponQuery{}); err != nil || page.Total != 0 {
+		t.Fatalf("coupons after a rejected import = %+v, %v; want none", page, err)
+	}
+}
+
+func TestImportBestEffortAndDryRun(t *testing.T) {
+	s := newTestService(t)
+	options := models.ImportOptions{Format: models.BulkCSV, Mode: models.ImportBestEffort, DryRun: true}
+	result, err := s.ImportCoupons(strings.NewReader(importCSV), options, "test")
+	if err != nil || result.Valid != 2 || result.Created != 0 {
+		t.Fatalf("dry run = %+v, %v; want 2 valid and none created", result, err)
+	}
+	options.DryRun = false
+	result, err = s.ImportCoupons(strings.NewReader(importCSV), options, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Created != 2 || len(result.CouponIDs) != 2 || len(result.Errors) != 2 {
+		t.Fatalf("result = %+v, want the 2 valid rows created", result)
+	}
+	coupon, err := s.repo.GetCouponByCode("WELCOME")
+	if err != nil || coupon.UsageLimit != 5 {
+		t.Fatalf("imported WELCOME = %+v, %v; want a usage limit of 5", coupon, err)
+	}
+}
+
+func TestExportImportsBackUnchanged(t *testing.T) {
+	s := newTestService(t)
+	createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Code: "ONE", UsageLimit: 3, Users: []uint{4, 5}, Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+	createTestCoupon(t, s, &models.Coupon{Type: models.BxGy, Code: "TWO", Stackable: true, Details: map[string]interface{}{
+		"buy_products": []interface{}{map[string]interface{}{"product_id": 1, "quantity": 2}},
+		"get_products": []interface{}{map[string]interface{}{"product_id": 2, "quantity": 1}},
+	}})
+
+	for _, format := range []models.BulkFormat{models.BulkCSV, models.BulkJSONLines} {
+		var exported bytes.Buffer
+		if err := s.ExportCoupons(&exported, format, false); err != nil {
+			t.Fatal(err)
+		}
+		target := newTestService(t)
+		result, err := target.ImportCoupons(bytes.NewReader(exported.Bytes()), models.ImportOptions{Format: format}, "test")
+		if err != nil || result.Created != 2 {
+			t.Fatalf("importing the %s export = %+v, %v; want 2 coupons created", format, result, err)
+		}
+		var reexported bytes.Buffer
+		if err := target.ExportCoupons(&reexported, format, false); err != nil {
+			t.Fatal(err)
+		}
+		if reexported.String() != exported.String() {
+			t.Fatalf("%s export after import:\n%s\nwant:\n%s", format, reexported.String(), exported.String())
+		}
+	}
+}
+
+func TestImportRejectsOverlongJSONLine(t *testing.T) {
+	s := newTestService(t)
+	line := `{"type":"cart-wise","code":"` + strings.Repeat("A", maxImportLine) + `"}`
+	_, err := s.ImportCoupons(strings.NewReader(line+"\n"), models.ImportOptions{Format: models.BulkJSONLines}, "test")
+	if !errors.Is(err, ErrInvalidRow) {
+		t.Fatalf("ImportCoupons = %v, want %v", err, ErrInvalidRow)
+	}
+}
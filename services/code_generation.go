@@ -0,0 +1,137 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"coupon-api/models"
+)
+
+const (
+	defaultCodePattern = "####-####"
+	// defaultCodeAlphabet leaves out 0/O, 1/I/L so printed codes can be
+	// typed back without guessing.
+	defaultCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	codePlaceholder     = '#'
+	// codeSpaceFactor is how many times larger than the batch the pattern's
+	// code space must be, so random draws rarely collide.
+	codeSpaceFactor = 10
+)
+
+var (
+	ErrInvalidPattern     = errors.New("code pattern must contain '#' placeholders and only letters, digits, spaces or dashes")
+	ErrInvalidAlphabet    = errors.New("code alphabet must contain at least two distinct letters or digits")
+	ErrCodeSpaceExhausted = errors.New("code pattern does not leave enough unique codes for this batch")
+)
+
+func (s *couponService) GenerateCodes(couponID uint, request *models.CodeGenerationRequest) ([]models.CouponCode, error) {
+	if _, err := s.repo.GetCouponByID(couponID); err != nil {
+		return nil, err
+	}
+
+	pattern := request.Pattern
+	if pattern == "" {
+		pattern = defaultCodePattern
+	}
+	pattern = models.NormalizeCode(pattern)
+	slots := strings.Count(pattern, string(codePlaceholder))
+	if slots == 0 || !models.IsValidCode(strings.ReplaceAll(pattern, string(codePlaceholder), "A")) {
+		return nil, ErrInvalidPattern
+	}
+
+	alphabet, err := normalizeAlphabet(request.Alphabet)
+	if err != nil {
+		return nil, err
+	}
+	if math.Pow(float64(len(alphabet)), float64(slots)) < float64(request.Count*codeSpaceFactor) {
+		return nil, ErrCodeSpaceExhausted
+	}
+
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	now := time.Now().UTC()
+	seen := make(map[string]bool, request.Count)
+	codes := make([]models.CouponCode, 0, request.Count)
+	for attempts := 0; len(codes) < request.Count; attempts++ {
+		if attempts >= request.Count*codeSpaceFactor {
+			return nil, ErrCodeSpaceExhausted
+		}
+		code, err := randomCode(pattern, alphabet)
+		if err != nil {
+			return nil, err
+		}
+		if seen[code] || s.codeInUse(code) {
+			continue
+		}
+		seen[code] = true
+		codes = append(codes, models.CouponCode{
+			Code:      code,
+			CouponID:  couponID,
+			Status:    models.CodeAvailable,
+			CreatedAt: now,
+		})
+	}
+
+	if err := s.codeRepo.CreateCodes(codes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (s *couponService) GetCouponCodes(couponID uint) ([]models.CouponCode, error) {
+	if _, err := s.repo.GetCouponByID(couponID); err != nil {
+		return nil, err
+	}
+	return s.codeRepo.GetCodesByCoupon(couponID)
+}
+
+// codeInUse reports whether code is taken by a coupon or a single-use code.
+func (s *couponService) codeInUse(code string) bool {
+	if _, err := s.repo.GetCouponByCode(code); err == nil {
+		return true
+	}
+	if _, err := s.codeRepo.GetCode(code); err == nil {
+		return true
+	}
+	return false
+}
+
+func normalizeAlphabet(alphabet string) (string, error) {
+	if alphabet == "" {
+		return defaultCodeAlphabet, nil
+	}
+	seen := make(map[rune]bool)
+	var normalized strings.Builder
+	for _, r := range models.NormalizeCode(alphabet) {
+		if seen[r] {
+			continue
+		}
+		seen[r] = true
+		normalized.WriteRune(r)
+	}
+	if normalized.Len() < 2 || !models.IsValidCode(normalized.String()) {
+		return "", ErrInvalidAlphabet
+	}
+	return normalized.String(), nil
+}
+
+func randomCode(pattern, alphabet string) (string, error) {
+	var code strings.Builder
+	limit := big.NewInt(int64(len(alphabet)))
+	for _, r := range pattern {
+		if r != codePlaceholder {
+			code.WriteRune(r)
+			continue
+		}
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(alphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
@@ -2,8 +2,12 @@ package services
 
 import (
 	"errors"
+	"io"
+	"sort"
+	"sync"
 	"time"
 
+	"coupon-api/service/adapters"
 	"coupon-api/service/strategies"
 
 	"coupon-api/models"
@@ -11,54 +15,285 @@ import (
 )
 
 type CouponService interface {
-	CreateCoupon(coupon *models.Coupon) error
-	GetAllCoupons() ([]models.Coupon, error)
+	CreateCoupon(coupon *models.Coupon, actor string) error
+	ListCoupons(query models.CouponQuery) (*models.CouponPage, error)
+	ImportCoupons(r io.Reader, options models.ImportOptions, actor string) (*models.ImportResult, error)
+	ExportCoupons(w io.Writer, format models.BulkFormat, includeArchived bool) error
+	PlanSync(definitions []models.CouponDefinition) (*models.SyncPlan, error)
+	ApplySync(plan *models.SyncPlan) (int, error)
+	ImportAdapters() []string
+	ImportFromPlatform(adapter string, r io.Reader, options models.ImportOptions, actor string) (*models.ImportResult, error)
+	GetReloadStatus() models.ReloadStatus
 	GetCouponByID(id uint) (*models.Coupon, error)
-	UpdateCoupon(coupon *models.Coupon) error
-	DeleteCoupon(id uint) error
+	UpdateCoupon(coupon *models.Coupon, actor string) error
+	PatchCoupon(id uint, version uint, patchType string, patch []byte, actor string) (*models.Coupon, error)
+	DeleteCoupon(id uint, version uint, actor string) error
+	ActivateCoupon(id uint, version uint, actor string) (*models.Coupon, error)
+	PauseCoupon(id uint, version uint, actor string) (*models.Coupon, error)
+	ResumeCoupon(id uint, version uint, actor string) (*models.Coupon, error)
+	ArchiveCoupon(id uint, version uint, actor string) (*models.Coupon, error)
+	RestoreCoupon(id uint, version uint, actor string) (*models.Coupon, error)
+	GetCouponVersions(id uint) ([]models.CouponRevision, error)
+	GetCouponVersion(id uint, version uint) (*models.CouponRevision, error)
+	RollbackCoupon(id uint, version uint, expectedVersion uint, actor string) (*models.Coupon, error)
 	GetApplicableCoupons(cart *models.Cart) ([]models.ApplicableCoupon, error)
 	ApplyCoupon(couponID uint, cart *models.Cart) (*models.UpdatedCart, error)
+	ApplyCouponByCode(code string, cart *models.Cart) (*models.UpdatedCart, error)
+	ValidateCode(code string, cart *models.Cart) (*models.CodeValidation, error)
+	GetIneligibleCoupons(cart *models.Cart) ([]models.IneligibleCoupon, error)
+	GetNearMissCoupons(cart *models.Cart) ([]models.NearMissCoupon, error)
+	GetBestDeal(cart *models.Cart) (*models.BestDeal, error)
+	ReserveBestDeal(request *models.ReservationRequest) (*models.BestDeal, error)
+	GenerateCodes(couponID uint, request *models.CodeGenerationRequest) ([]models.CouponCode, error)
+	GetCouponCodes(couponID uint) ([]models.CouponCode, error)
+	ListRedemptions(query models.RedemptionQuery) (*models.RedemptionPage, error)
+	GetRedemption(id uint) (*models.Redemption, error)
+	GetReversals(redemptionID uint) ([]models.Reversal, error)
+	ReverseRedemption(id uint, request *models.ReversalRequest) (*models.Reversal, error)
+	ReserveCoupon(couponID uint, request *models.ReservationRequest) (*models.Reservation, error)
+	ReserveCouponByCode(code string, request *models.ReservationRequest) (*models.Reservation, error)
+	GetReservation(id uint) (*models.Reservation, error)
+	CommitReservation(id uint) (*models.Reservation, error)
+	ReleaseReservation(id uint) (*models.Reservation, error)
+	ReleaseExpiredReservations() (int, error)
+	RestoreReservedUsage() error
 }
 
 type couponService struct {
 	repo            repositories.CouponRepository
+	codeRepo        repositories.CouponCodeRepository
+	redemptionRepo  repositories.RedemptionRepository
+	reservationRepo repositories.ReservationRepository
+	historyRepo     repositories.CouponHistoryRepository
 	strategyFactory strategies.CouponStrategyFactory
+	adapterRegistry adapters.ImportAdapterRegistry
+	// codeMutex is held from checking that a code is free until it is
+	// stored, since a coupon code and a single-use code are kept in
+	// different repositories and neither can check the other.
+	codeMutex sync.Mutex
 }
 
-func NewCouponService(repo repositories.CouponRepository, factory strategies.CouponStrategyFactory) CouponService {
-	return &couponService{
+func NewCouponService(repo repositories.CouponRepository, codeRepo repositories.CouponCodeRepository, redemptionRepo repositories.RedemptionRepository, reservationRepo repositories.ReservationRepository, historyRepo repositories.CouponHistoryRepository, factory strategies.CouponStrategyFactory, adapterRegistry adapters.ImportAdapterRegistry) CouponService {
+	service := &couponService{
 		repo:            repo,
+		codeRepo:        codeRepo,
+		redemptionRepo:  redemptionRepo,
+		reservationRepo: reservationRepo,
+		historyRepo:     historyRepo,
 		strategyFactory: factory,
+		adapterRegistry: adapterRegistry,
 	}
+	repo.OnReload(service.recordReload)
+	return service
 }
 
-func (s *couponService) CreateCoupon(coupon *models.Coupon) error {
-	return s.repo.CreateCoupon(coupon)
+var ErrInvalidCode = errors.New("coupon code may only contain letters and digits")
+
+func (s *couponService) CreateCoupon(coupon *models.Coupon, actor string) error {
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	if err := ValidateCoupon(coupon); err != nil {
+		return err
+	}
+	coupon.ExternalKey = ""
+	if err := s.normalizeCouponCode(coupon); err != nil {
+		return err
+	}
+	if err := prepareStatus(coupon); err != nil {
+		return err
+	}
+	if err := s.repo.CreateCoupon(coupon); err != nil {
+		return err
+	}
+	s.recordRevision(models.RevisionCreated, actor, nil, coupon, 0)
+	coupon.Status = coupon.StatusAt(time.Now())
+	return nil
+}
+
+const (
+	defaultCouponPageSize = 50
+	maxCouponPageSize     = 500
+)
+
+// ListCoupons and GetCouponByID report each coupon's current status rather
+// than the stored one. Archived coupons are only listed on request.
+func (s *couponService) ListCoupons(query models.CouponQuery) (*models.CouponPage, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultCouponPageSize
+	}
+	if query.Limit > maxCouponPageSize {
+		query.Limit = maxCouponPageSize
+	}
+	page, err := s.repo.ListCoupons(query)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for i := range page.Coupons {
+		page.Coupons[i].Status = page.Coupons[i].StatusAt(now)
+	}
+	return page, nil
+}
+
+// evaluableCoupons returns the coupons to consider for a cart. Archived
+// coupons are left out entirely rather than reported as ineligible.
+func (s *couponService) evaluableCoupons() ([]models.Coupon, error) {
+	coupons, err := s.repo.GetAllCoupons()
+	if err != nil {
+		return nil, err
+	}
+	evaluable := []models.Coupon{}
+	for _, coupon := range coupons {
+		if coupon.Status != models.CouponArchived {
+			evaluable = append(evaluable, coupon)
+		}
+	}
+	return evaluable, nil
 }
 
-func (s *couponService) GetAllCoupons() ([]models.Coupon, error) {
-	return s.repo.GetAllCoupons()
+// GetReloadStatus reports how the last reload of the coupons file, after it
+// was edited by hand, went.
+func (s *couponService) GetReloadStatus() models.ReloadStatus {
+	return s.repo.ReloadStatus()
 }
 
 func (s *couponService) GetCouponByID(id uint) (*models.Coupon, error) {
-	return s.repo.GetCouponByID(id)
+	coupon, err := s.repo.GetCouponByID(id)
+	if err != nil {
+		return nil, err
+	}
+	coupon.Status = coupon.StatusAt(time.Now())
+	return coupon, nil
 }
 
-func (s *couponService) UpdateCoupon(coupon *models.Coupon) error {
-	return s.repo.UpdateCoupon(coupon)
+func (s *couponService) UpdateCoupon(coupon *models.Coupon, actor string) error {
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	if err := ValidateCoupon(coupon); err != nil {
+		return err
+	}
+	if err := s.normalizeCouponCode(coupon); err != nil {
+		return err
+	}
+	existing, err := s.repo.GetCouponByID(coupon.ID)
+	if err != nil {
+		return err
+	}
+	// A zero version matches any; the repository still checks that the
+	// coupon has not changed since it was read here.
+	expectedVersion := coupon.Version
+	if expectedVersion == 0 {
+		coupon.Version = existing.Version
+	}
+	if existing.Version != coupon.Version {
+		return repositories.ErrVersionMismatch
+	}
+	// The status only changes through the lifecycle endpoints, and the
+	// external key only through a sync.
+	coupon.Status = existing.Status
+	coupon.ExternalKey = existing.ExternalKey
+	if err := checkSchedule(coupon); err != nil {
+		return err
+	}
+	err = s.repo.UpdateCoupon(coupon)
+	if errors.Is(err, repositories.ErrVersionMismatch) && expectedVersion == 0 {
+		return repositories.ErrCouponChanged
+	}
+	if err != nil {
+		return err
+	}
+	s.recordRevision(models.RevisionUpdated, actor, existing, coupon, 0)
+	coupon.Status = coupon.StatusAt(time.Now())
+	return nil
 }
 
-func (s *couponService) DeleteCoupon(id uint) error {
-	return s.repo.DeleteCoupon(id)
+// normalizeCouponCode normalizes the coupon's code and rejects it if it is
+// malformed or already used as a single-use code. Clashes with other coupons'
+// codes are caught by the repository. A caller that goes on to store the
+// coupon must hold codeMutex from the check until then.
+func (s *couponService) normalizeCouponCode(coupon *models.Coupon) error {
+	if coupon.Code == "" {
+		return nil
+	}
+	coupon.Code = models.NormalizeCode(coupon.Code)
+	if !models.IsValidCode(coupon.Code) {
+		return ErrInvalidCode
+	}
+	if _, err := s.codeRepo.GetCode(coupon.Code); err == nil {
+		return repositories.ErrDuplicateCode
+	}
+	return nil
+}
+
+// DeleteCoupon archives the coupon. Coupons are never removed, so their IDs
+// and codes stay unique and history that refers to them keeps its context.
+func (s *couponService) DeleteCoupon(id uint, version uint, actor string) error {
+	_, err := s.ArchiveCoupon(id, version, actor)
+	return err
 }
 
 func (s *couponService) GetApplicableCoupons(cart *models.Cart) ([]models.ApplicableCoupon, error) {
-	coupons, err := s.repo.GetAllCoupons()
+	candidates, err := s.collectCandidates(cart)
 	if err != nil {
 		return nil, err
 	}
 
 	applicableCoupons := []models.ApplicableCoupon{}
+	for _, candidate := range candidates {
+		applicableCoupons = append(applicableCoupons, models.ApplicableCoupon{
+			CouponID: candidate.coupon.ID,
+			Type:     candidate.coupon.Type,
+			Discount: candidate.discount,
+		})
+	}
+	return applicableCoupons, nil
+}
+
+func (s *couponService) collectCandidates(cart *models.Cart) ([]dealCandidate, error) {
+	coupons, err := s.evaluableCoupons()
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []dealCandidate{}
+	for _, coupon := range coupons {
+		discount, reasons := s.evaluateCoupon(&coupon, cart)
+		if len(reasons) > 0 {
+			continue
+		}
+		candidates = append(candidates, dealCandidate{coupon: coupon, discount: discount})
+	}
+	return candidates, nil
+}
+
+func (s *couponService) GetIneligibleCoupons(cart *models.Cart) ([]models.IneligibleCoupon, error) {
+	coupons, err := s.evaluableCoupons()
+	if err != nil {
+		return nil, err
+	}
+
+	ineligibleCoupons := []models.IneligibleCoupon{}
+	for _, coupon := range coupons {
+		_, reasons := s.evaluateCoupon(&coupon, cart)
+		if len(reasons) == 0 {
+			continue
+		}
+		ineligibleCoupons = append(ineligibleCoupons, models.IneligibleCoupon{
+			CouponID: coupon.ID,
+			Type:     coupon.Type,
+			Reasons:  reasons,
+		})
+	}
+	return ineligibleCoupons, nil
+}
+
+func (s *couponService) GetNearMissCoupons(cart *models.Cart) ([]models.NearMissCoupon, error) {
+	coupons, err := s.evaluableCoupons()
+	if err != nil {
+		return nil, err
+	}
+
+	nearMisses := []models.NearMissCoupon{}
 	for _, coupon := range coupons {
 		if !s.isCouponApplicable(&coupon, cart) {
 			continue
@@ -69,71 +304,209 @@ func (s *couponService) GetApplicableCoupons(cart *models.Cart) ([]models.Applic
 			continue
 		}
 
-		discount, err := strategy.CalculateDiscount(&coupon, cart)
-		if err != nil {
+		nearMiss, err := strategy.NearMiss(&coupon, cart)
+		if err != nil || nearMiss == nil || !isNearMiss(nearMiss) {
 			continue
 		}
+		nearMiss.CouponID = coupon.ID
+		nearMiss.Type = coupon.Type
+		nearMisses = append(nearMisses, *nearMiss)
+	}
 
-		if discount > 0 {
-			applicableCoupons = append(applicableCoupons, models.ApplicableCoupon{
-				CouponID: coupon.ID,
-				Type:     coupon.Type,
-				Discount: discount,
-			})
+	// Carts closest to qualifying come first, and only the best few are
+	// suggested: every product-wise coupon whose product is not in the cart
+	// is technically a near miss.
+	sort.SliceStable(nearMisses, func(i, j int) bool {
+		a, b := nearMissProgress(&nearMisses[i]), nearMissProgress(&nearMisses[j])
+		if a != b {
+			return a > b
+		}
+		if nearMisses[i].PotentialDiscount != nearMisses[j].PotentialDiscount {
+			return nearMisses[i].PotentialDiscount > nearMisses[j].PotentialDiscount
 		}
+		return nearMisses[i].CouponID < nearMisses[j].CouponID
+	})
+	if len(nearMisses) > maxNearMisses {
+		nearMisses = nearMisses[:maxNearMisses]
 	}
-	return applicableCoupons, nil
+	return nearMisses, nil
 }
 
 func (s *couponService) ApplyCoupon(couponID uint, cart *models.Cart) (*models.UpdatedCart, error) {
 	coupon, err := s.repo.GetCouponByID(couponID)
 	if err != nil {
-		return nil, errors.New("coupon not found")
+		return nil, err
 	}
+	return s.applyCoupon(coupon, cart)
+}
 
-	if !s.isCouponApplicable(coupon, cart) {
-		return nil, errors.New("coupon is not applicable")
+// ApplyCouponByCode previews a coupon by its code. Like ApplyCoupon it has no
+// side effects; single-use codes are only claimed by a reservation.
+func (s *couponService) ApplyCouponByCode(code string, cart *models.Cart) (*models.UpdatedCart, error) {
+	coupon, singleUse, err := s.resolveCode(code)
+	if err != nil {
+		return nil, err
 	}
-
-	strategy := s.strategyFactory.GetStrategy(coupon.Type)
-	if strategy == nil {
-		return nil, errors.New("unsupported coupon type")
+	if singleUse != nil {
+		if reasons := singleUseReasons(singleUse); len(reasons) > 0 {
+			return nil, &IneligibleError{Reasons: reasons}
+		}
 	}
+	return s.applyCoupon(coupon, cart)
+}
 
-	updatedCart, err := strategy.ApplyCoupon(coupon, cart)
+func (s *couponService) ValidateCode(code string, cart *models.Cart) (*models.CodeValidation, error) {
+	validation := &models.CodeValidation{Code: models.NormalizeCode(code)}
+	coupon, singleUse, err := s.resolveCode(code)
 	if err != nil {
 		return nil, err
 	}
+	validation.CouponID = coupon.ID
+	validation.Type = coupon.Type
 
-	// Increment usage count if there is a usage limit
-	if coupon.UsageLimit > 0 {
-		err := s.repo.IncrementUsageCount(coupon.ID)
-		if err != nil {
-			return nil, err
-		}
+	discount, reasons := s.evaluateCoupon(coupon, cart)
+	if singleUse != nil {
+		reasons = append(singleUseReasons(singleUse), reasons...)
+	}
+	validation.Valid = len(reasons) == 0
+	if validation.Valid {
+		validation.Discount = discount
+	}
+	validation.Reasons = reasons
+	return validation, nil
+}
+
+// resolveCode finds the coupon behind a code. Coupon codes are looked up
+// first; otherwise the code is treated as a single-use code, which is
+// returned along with its parent coupon.
+func (s *couponService) resolveCode(code string) (*models.Coupon, *models.CouponCode, error) {
+	coupon, err := s.repo.GetCouponByCode(code)
+	if err == nil {
+		return coupon, nil, nil
+	}
+	if !errors.Is(err, repositories.ErrCouponNotFound) {
+		return nil, nil, err
 	}
 
-	return updatedCart, nil
+	singleUse, err := s.codeRepo.GetCode(code)
+	if errors.Is(err, repositories.ErrCodeNotFound) {
+		return nil, nil, repositories.ErrCouponNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	coupon, err = s.repo.GetCouponByID(singleUse.CouponID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return coupon, singleUse, nil
+}
+
+func singleUseReasons(code *models.CouponCode) []models.IneligibilityReason {
+	switch code.Status {
+	case models.CodeAvailable:
+		return nil
+	case models.CodeReserved:
+		return []models.IneligibilityReason{{
+			Code:    models.ReasonCodeReserved,
+			Message: "coupon code is held by another checkout",
+		}}
+	}
+	return []models.IneligibilityReason{{
+		Code:    models.ReasonCodeRedeemed,
+		Message: "coupon code has already been redeemed",
+	}}
+}
+
+// applyCoupon computes the cart with the coupon applied. It has no side
+// effects: uses are only counted through reservations.
+func (s *couponService) applyCoupon(coupon *models.Coupon, cart *models.Cart) (*models.UpdatedCart, error) {
+	cart = withoutDiscounts(cart)
+	if _, reasons := s.evaluateCoupon(coupon, cart); len(reasons) > 0 {
+		return nil, &IneligibleError{Reasons: reasons}
+	}
+
+	strategy := s.strategyFactory.GetStrategy(coupon.Type)
+	return strategy.ApplyCoupon(coupon, cart)
 }
 
 func (s *couponService) isCouponApplicable(coupon *models.Coupon, cart *models.Cart) bool {
+	return len(s.checkEligibility(coupon, cart)) == 0
+}
+
+// checkEligibility runs the checks that do not depend on the coupon type and
+// returns a reason for every check that fails.
+func (s *couponService) checkEligibility(coupon *models.Coupon, cart *models.Cart) []models.IneligibilityReason {
+	reasons := []models.IneligibilityReason{}
+
+	// Check lifecycle status; expiry is reported below
+	switch status := coupon.StatusAt(time.Now()); status {
+	case models.CouponScheduled:
+		reasons = append(reasons, models.IneligibilityReason{
+			Code:     models.ReasonNotYetValid,
+			Message:  "coupon is not valid yet",
+			Required: coupon.ValidFrom,
+		})
+	case models.CouponDraft, models.CouponPaused, models.CouponArchived:
+		reasons = append(reasons, models.IneligibilityReason{
+			Code:    models.ReasonCouponInactive,
+			Message: "coupon is " + string(status),
+			Actual:  status,
+		})
+	}
+
 	// Check expiration date
 	if coupon.ExpirationDate != nil && time.Now().After(*coupon.ExpirationDate) {
-		return false
+		reasons = append(reasons, models.IneligibilityReason{
+			Code:     models.ReasonExpired,
+			Message:  "coupon has expired",
+			Required: coupon.ExpirationDate,
+		})
 	}
 
-	// Check usage limit
-	if coupon.UsageLimit > 0 && coupon.UsedCount >= coupon.UsageLimit {
-		return false
+	// Check usage limit, counting uses held by reservations
+	if coupon.UsageLimit > 0 && coupon.UsedCount+coupon.ReservedCount >= coupon.UsageLimit {
+		reasons = append(reasons, models.IneligibilityReason{
+			Code:     models.ReasonUsageExhausted,
+			Message:  "coupon usage limit has been reached",
+			Actual:   coupon.UsedCount + coupon.ReservedCount,
+			Required: coupon.UsageLimit,
+		})
+	}
+
+	// Check per-user usage limit
+	if coupon.PerUserLimit > 0 {
+		if cart.UserID == 0 {
+			reasons = append(reasons, models.IneligibilityReason{
+				Code:    models.ReasonUserNotEligible,
+				Message: "coupon has a per-user limit and requires a user ID",
+			})
+		} else if used, err := s.repo.GetUserUsageCount(coupon.ID, cart.UserID); err == nil && used >= coupon.PerUserLimit {
+			reasons = append(reasons, models.IneligibilityReason{
+				Code:     models.ReasonUserLimitReached,
+				Message:  "user has reached the per-user limit for this coupon",
+				Actual:   used,
+				Required: coupon.PerUserLimit,
+			})
+		}
 	}
 
 	// Check user-specific coupon
 	if coupon.Type == models.UserSpecific && !s.isCouponForUser(coupon, cart.UserID) {
-		return false
+		reasons = append(reasons, models.IneligibilityReason{
+			Code:    models.ReasonUserNotEligible,
+			Message: "coupon is not available to this user",
+			Actual:  cart.UserID,
+		})
 	}
 
 	// Additional checks can be added here
-	return true
+	return reasons
+}
+
+// tracksUsage reports whether redemptions of the coupon need to be counted.
+func tracksUsage(coupon *models.Coupon) bool {
+	return coupon.UsageLimit > 0 || coupon.PerUserLimit > 0
 }
 
 func (s *couponService) isCouponForUser(coupon *models.Coupon, userID uint) bool {
@@ -144,3 +517,41 @@ func (s *couponService) isCouponForUser(coupon *models.Coupon, userID uint) bool
 	}
 	return false
 }
+
+// nearMissRatio is how far along a quantitative requirement the cart must be
+// for the coupon to be suggested as almost eligible.
+const nearMissRatio = 0.5
+
+// maxNearMisses caps how many near-miss coupons are suggested for a cart.
+const maxNearMisses = 10
+
+// nearMissProgress is how far along the cart is on its least met
+// requirement. A missing product counts as no progress.
+func nearMissProgress(nearMiss *models.NearMissCoupon) float64 {
+	progress := 1.0
+	for _, requirement := range nearMiss.Missing {
+		ratio := 0.0
+		if requirement.Kind != models.ProductRequirement && requirement.Required > 0 {
+			ratio = requirement.Actual / requirement.Required
+		}
+		if ratio < progress {
+			progress = ratio
+		}
+	}
+	return progress
+}
+
+func isNearMiss(nearMiss *models.NearMissCoupon) bool {
+	if len(nearMiss.Missing) == 0 {
+		return false
+	}
+	for _, requirement := range nearMiss.Missing {
+		if requirement.Kind == models.ProductRequirement {
+			continue
+		}
+		if requirement.Required > 0 && requirement.Actual/requirement.Required < nearMissRatio {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+	"coupon-api/service/adapters"
+	"coupon-api/service/strategies"
+)
+
+// newTestService returns a service backed by JSON repositories in a fresh
+// temporary directory.
+func newTestService(t *testing.T) *couponService {
+	t.Helper()
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	repo, err := repositories.NewCouponRepository(path("coupons.json"), ValidateCoupon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	codeRepo, err := repositories.NewCouponCodeRepository(path("coupon_codes.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	redemptionRepo, err := repositories.NewRedemptionRepository(path("redemptions.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reservationRepo, err := repositories.NewReservationRepository(path("reservations.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	historyRepo, err := repositories.NewCouponHistoryRepository(path("coupon_revisions.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := adapters.NewImportAdapterRegistry(path("import_mappings"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewCouponService(repo, codeRepo, redemptionRepo, reservationRepo, historyRepo, strategies.NewCouponStrategyFactory(), registry)
+	return service.(*couponService)
+}
+
+func createTestCoupon(t *testing.T, s *couponService, coupon *models.Coupon) *models.Coupon {
+	t.Helper()
+	if err := s.CreateCoupon(coupon, "test"); err != nil {
+		t.Fatalf("creating %s coupon: %v", coupon.Type, err)
+	}
+	return coupon
+}
+
+func TestNearMissCouponsClosestFirstAndCapped(t *testing.T) {
+	s := newTestService(t)
+	far := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 150, "discount": 10}})
+	createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 300, "discount": 10}})
+	nearest := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+	for productID := 10; productID < 20; productID++ {
+		createTestCoupon(t, s, &models.Coupon{Type: models.ProductWise, Details: map[string]interface{}{"product_id": productID, "discount": 10}})
+	}
+
+	cart := &models.Cart{Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}
+	nearMisses, err := s.GetNearMissCoupons(cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nearMisses) != maxNearMisses {
+		t.Fatalf("got %d near misses, want %d", len(nearMisses), maxNearMisses)
+	}
+	if nearMisses[0].CouponID != nearest.ID || nearMisses[1].CouponID != far.ID {
+		t.Fatalf("first near misses are %d and %d, want %d and %d", nearMisses[0].CouponID, nearMisses[1].CouponID, nearest.ID, far.ID)
+	}
+	// A cart right at the threshold still has to go past it.
+	if missing := nearMisses[0].Missing[0].Missing; missing <= 0 {
+		t.Fatalf("missing amount at the threshold = %v, want more than 0", missing)
+	}
+}
+
+func TestCouponCodesAreNormalizedAndUnique(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Code: " summer-10 ", Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	if coupon.Code != "SUMMER10" {
+		t.Fatalf("stored code = %q, want SUMMER10", coupon.Code)
+	}
+	duplicate := &models.Coupon{Type: models.CartWise, Code: "Summer10", Details: map[string]interface{}{"threshold": 10, "discount": 5}}
+	if err := s.CreateCoupon(duplicate, "test"); !errors.Is(err, repositories.ErrDuplicateCode) {
+		t.Fatalf("creating a coupon with a taken code = %v, want %v", err, repositories.ErrDuplicateCode)
+	}
+	invalid := &models.Coupon{Type: models.CartWise, Code: "10%OFF", Details: map[string]interface{}{"threshold": 10, "discount": 5}}
+	if err := s.CreateCoupon(invalid, "test"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("creating a coupon with code 10%%OFF = %v, want %v", err, ErrInvalidCode)
+	}
+
+	cart := &models.Cart{Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}
+	updated, err := s.ApplyCouponByCode("summer 10", cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.TotalDiscount != 10 {
+		t.Fatalf("discount by code = %v, want 10", updated.TotalDiscount)
+	}
+	validation, err := s.ValidateCode("SUMMER10", &models.Cart{Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 5}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validation.Valid || validation.CouponID != coupon.ID || len(validation.Reasons) == 0 {
+		t.Fatalf("validation of a cart below the threshold = %+v, want invalid with reasons", validation)
+	}
+	if _, err := s.ValidateCode("NOSUCHCODE", cart); !errors.Is(err, repositories.ErrCouponNotFound) {
+		t.Fatalf("validating an unknown code = %v, want %v", err, repositories.ErrCouponNotFound)
+	}
+}
+
+// blockingCodeRepository holds each batch of new codes until released.
+type blockingCodeRepository struct {
+	repositories.CouponCodeRepository
+	creating chan []models.CouponCode
+	release  chan struct{}
+}
+
+func (r *blockingCodeRepository) CreateCodes(codes []models.CouponCode) error {
+	r.creating <- codes
+	<-r.release
+	return r.CouponCodeRepository.CreateCodes(codes)
+}
+
+func TestCouponCannotTakeCodeBeingGenerated(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	codeRepo := &blockingCodeRepository{CouponCodeRepository: s.codeRepo, creating: make(chan []models.CouponCode), release: make(chan struct{})}
+	s.codeRepo = codeRepo
+
+	generated := make(chan error)
+	go func() {
+		_, err := s.GenerateCodes(coupon.ID, &models.CodeGenerationRequest{Count: 1})
+		generated <- err
+	}()
+	code := (<-codeRepo.creating)[0].Code
+	created := make(chan error)
+	go func() {
+		created <- s.CreateCoupon(&models.Coupon{Type: models.CartWise, Code: code, Details: map[string]interface{}{"threshold": 10, "discount": 10}}, "test")
+	}()
+	select {
+	case err := <-created:
+		t.Fatalf("CreateCoupon with a code being generated returned %v before the codes were stored", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(codeRepo.release)
+	if err := <-generated; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-created; !errors.Is(err, repositories.ErrDuplicateCode) {
+		t.Fatalf("CreateCoupon with a generated code = %v, want %v", err, repositories.ErrDuplicateCode)
+	}
+}
+
+// failingHistoryRepository fails to write revisions until fixed.
+type failingHistoryRepository struct {
+	repositories.CouponHistoryRepository
+	failing bool
+}
+
+func (r *failingHistoryRepository) AddRevision(revision *models.CouponRevision) error {
+	if r.failing {
+		return errors.New("disk full")
+	}
+	return r.CouponHistoryRepository.AddRevision(revision)
+}
+
+func TestRevisionLeftOutIsRecordedOnNextChange(t *testing.T) {
+	s := newTestService(t)
+	history := &failingHistoryRepository{CouponHistoryRepository: s.historyRepo}
+	s.historyRepo = history
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+
+	history.failing = true
+	coupon.Code = "FIRST"
+	if err := s.UpdateCoupon(coupon, "alice"); err != nil {
+		t.Fatalf("UpdateCoupon with history failing = %v, want the update made", err)
+	}
+	history.failing = false
+	coupon.Code = "SECOND"
+	if err := s.UpdateCoupon(coupon, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	revisions, err := s.GetCouponVersions(coupon.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("got %d revisions, want 3", len(revisions))
+	}
+	for i, revision := range revisions {
+		if revision.Version != uint(i+1) {
+			t.Fatalf("revision %d has version %d, want %d", i, revision.Version, i+1)
+		}
+	}
+	if revisions[1].Coupon.Code != "FIRST" || revisions[1].Actor != "" || len(revisions[1].Changes) == 0 {
+		t.Fatalf("revision left out was recorded as %+v, want code FIRST with no actor", revisions[1])
+	}
+	if revisions[2].Actor != "bob" {
+		t.Fatalf("latest revision actor = %q, want bob", revisions[2].Actor)
+	}
+}
+
+func TestReloadEditRecordedAsRevisionByFile(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	edited := *coupon
+	edited.Version++
+	edited.Details = map[string]interface{}{"threshold": 10, "discount": 25}
+	s.recordReload(coupon, &edited)
+
+	revision, err := s.GetCouponVersion(coupon.ID, edited.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision.Actor != ReloadActor || revision.Action != models.RevisionUpdated || len(revision.Changes) == 0 {
+		t.Fatalf("reload revision = %+v, want an update by %q", revision, ReloadActor)
+	}
+}
+
+// racingCouponRepository loses every update to a write that got in first.
+type racingCouponRepository struct {
+	repositories.CouponRepository
+}
+
+func (racingCouponRepository) UpdateCoupon(*models.Coupon) error {
+	return repositories.ErrVersionMismatch
+}
+
+func TestUpdateCouponWithoutVersionLosingRaceIsConflict(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	s.repo = racingCouponRepository{s.repo}
+	for version, want := range map[uint]error{0: repositories.ErrCouponChanged, coupon.Version: repositories.ErrVersionMismatch} {
+		update := *coupon
+		update.Version = version
+		if err := s.UpdateCoupon(&update, "test"); !errors.Is(err, want) {
+			t.Fatalf("UpdateCoupon with version %d = %v, want %v", version, err, want)
+		}
+	}
+}
+
+func TestCreateCouponRejectsDetailsOfWrongShape(t *testing.T) {
+	s := newTestService(t)
+	coupon := &models.Coupon{Type: models.BxGy, Details: map[string]interface{}{"buy_products": "two of product 1"}}
+	if err := s.CreateCoupon(coupon, "test"); !errors.Is(err, ErrInvalidCoupon) {
+		t.Fatalf("CreateCoupon = %v, want %v", err, ErrInvalidCoupon)
+	}
+}
+
+func TestUpdateCouponRejectsDetailsOfWrongShape(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	update := *coupon
+	update.Details = map[string]interface{}{"threshold": "a lot", "discount": 10}
+	if err := s.UpdateCoupon(&update, "test"); !errors.Is(err, ErrInvalidCoupon) {
+		t.Fatalf("UpdateCoupon = %v, want %v", err, ErrInvalidCoupon)
+	}
+}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"fmt"
+
+	"coupon-api/models"
+)
+
+// IneligibleError is returned when a coupon cannot be applied to a cart and
+// carries the reasons why.
+type IneligibleError struct {
+	Reasons []models.IneligibilityReason
+}
+
+func (e *IneligibleError) Error() string {
+	return "coupon is not applicable"
+}
+
+// evaluateCoupon returns the coupon's discount for the cart, or the reasons it
+// gives none. A coupon is applicable only when no reasons are returned.
+func (s *couponService) evaluateCoupon(coupon *models.Coupon, cart *models.Cart) (float64, []models.IneligibilityReason) {
+	if reasons := s.checkEligibility(coupon, cart); len(reasons) > 0 {
+		return 0, reasons
+	}
+
+	strategy := s.strategyFactory.GetStrategy(coupon.Type)
+	if strategy == nil {
+		return 0, []models.IneligibilityReason{{
+			Code:    models.ReasonUnsupportedType,
+			Message: fmt.Sprintf("coupon type %q is not supported", coupon.Type),
+		}}
+	}
+
+	discount, err := strategy.CalculateDiscount(coupon, cart)
+	if err != nil {
+		return 0, []models.IneligibilityReason{{
+			Code:    models.ReasonInvalidDetails,
+			Message: err.Error(),
+		}}
+	}
+	if discount > 0 {
+		return discount, nil
+	}
+
+	nearMiss, err := strategy.NearMiss(coupon, cart)
+	if err != nil {
+		return 0, []models.IneligibilityReason{{
+			Code:    models.ReasonInvalidDetails,
+			Message: err.Error(),
+		}}
+	}
+	if reasons := reasonsFromNearMiss(nearMiss); len(reasons) > 0 {
+		return 0, reasons
+	}
+	return 0, []models.IneligibilityReason{{
+		Code:    models.ReasonNoDiscount,
+		Message: "coupon gives no discount for this cart",
+	}}
+}
+
+func reasonsFromNearMiss(nearMiss *models.NearMissCoupon) []models.IneligibilityReason {
+	if nearMiss == nil {
+		return nil
+	}
+
+	reasons := []models.IneligibilityReason{}
+	for _, requirement := range nearMiss.Missing {
+		switch requirement.Kind {
+		case models.CartTotalRequirement:
+			reasons = append(reasons, models.IneligibilityReason{
+				Code:     models.ReasonThresholdNotMet,
+				Message:  fmt.Sprintf("cart total must exceed %.2f", requirement.Required),
+				Actual:   requirement.Actual,
+				Required: requirement.Required,
+			})
+		case models.BuyQuantityRequirement:
+			reasons = append(reasons, models.IneligibilityReason{
+				Code:      models.ReasonBuyQuantityNotMet,
+				Message:   fmt.Sprintf("%v more of product %d needed", requirement.Missing, requirement.ProductID),
+				ProductID: requirement.ProductID,
+				Actual:    requirement.Actual,
+				Required:  requirement.Required,
+			})
+		case models.ProductRequirement:
+			reasons = append(reasons, models.IneligibilityReason{
+				Code:      models.ReasonProductNotInCart,
+				Message:   fmt.Sprintf("product %d is not in the cart", requirement.ProductID),
+				ProductID: requirement.ProductID,
+			})
+		}
+	}
+	return reasons
+}
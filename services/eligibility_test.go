@@ -0,0 +1,66 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"coupon-api/models"
+)
+
+// applyIneligible applies a coupon that must not apply and returns the
+// reasons given.
+func applyIneligible(t *testing.T, s *couponService, id uint, cart *models.Cart) []models.IneligibilityReason {
+	t.Helper()
+	_, err := s.ApplyCoupon(id, cart)
+	var ineligible *IneligibleError
+	if !errors.As(err, &ineligible) {
+		t.Fatalf("ApplyCoupon = %v, want an IneligibleError", err)
+	}
+	return ineligible.Reasons
+}
+
+func TestApplyCouponReportsWhyItDoesNotApply(t *testing.T) {
+	s := newTestService(t)
+	expired := time.Now().Add(-time.Hour)
+	expiredCoupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, ExpirationDate: &expired, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	thresholdCoupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+	productCoupon := createTestCoupon(t, s, &models.Coupon{Type: models.ProductWise, Details: map[string]interface{}{"product_id": 7, "discount": 10}})
+
+	cart := &models.Cart{Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 40}}}
+	if reasons := applyIneligible(t, s, expiredCoupon.ID, cart); len(reasons) != 1 || reasons[0].Code != models.ReasonExpired {
+		t.Fatalf("expired coupon reasons = %+v, want one %s", reasons, models.ReasonExpired)
+	}
+	reasons := applyIneligible(t, s, thresholdCoupon.ID, cart)
+	if len(reasons) != 1 || reasons[0].Code != models.ReasonThresholdNotMet || reasons[0].Actual != 40.0 || reasons[0].Required != 100.0 {
+		t.Fatalf("threshold coupon reasons = %+v, want %s with actual 40 and required 100", reasons, models.ReasonThresholdNotMet)
+	}
+	reasons = applyIneligible(t, s, productCoupon.ID, cart)
+	if len(reasons) != 1 || reasons[0].Code != models.ReasonProductNotInCart || reasons[0].ProductID != 7 {
+		t.Fatalf("product coupon reasons = %+v, want %s for product 7", reasons, models.ReasonProductNotInCart)
+	}
+}
+
+func TestPerUserLimitCountsEachUser(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, PerUserLimit: 2, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	cart := func(userID uint) *models.Cart {
+		return &models.Cart{UserID: userID, Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.ReserveCoupon(coupon.ID, &models.ReservationRequest{Cart: *cart(1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reasons := applyIneligible(t, s, coupon.ID, cart(1))
+	if len(reasons) != 1 || reasons[0].Code != models.ReasonUserLimitReached {
+		t.Fatalf("third use by the same user: reasons = %+v, want %s", reasons, models.ReasonUserLimitReached)
+	}
+	if _, err := s.ReserveCoupon(coupon.ID, &models.ReservationRequest{Cart: *cart(2)}); err != nil {
+		t.Fatalf("first use by another user = %v, want it reserved", err)
+	}
+	if reasons := applyIneligible(t, s, coupon.ID, cart(0)); len(reasons) != 1 || reasons[0].Code != models.ReasonUserNotEligible {
+		t.Fatalf("use without a user: reasons = %+v, want %s", reasons, models.ReasonUserNotEligible)
+	}
+}
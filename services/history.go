@@ -0,0 +1,199 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+)
+
+func (s *couponService) GetCouponVersions(id uint) ([]models.CouponRevision, error) {
+	if _, err := s.repo.GetCouponByID(id); err != nil {
+		return nil, err
+	}
+	return s.historyRepo.GetRevisions(id)
+}
+
+func (s *couponService) GetCouponVersion(id uint, version uint) (*models.CouponRevision, error) {
+	if _, err := s.repo.GetCouponByID(id); err != nil {
+		return nil, err
+	}
+	return s.historyRepo.GetRevision(id, version)
+}
+
+// RollbackCoupon restores the definition the coupon had at version as a new
+// version. The status and usage counters are left as they are. A non-zero
+// expectedVersion must match the coupon's current version.
+func (s *couponService) RollbackCoupon(id uint, version uint, expectedVersion uint, actor string) (*models.Coupon, error) {
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	revision, err := s.historyRepo.GetRevision(id, version)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := s.repo.GetCouponByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if expectedVersion != 0 && existing.Version != expectedVersion {
+		return nil, repositories.ErrVersionMismatch
+	}
+
+	coupon := revision.Coupon
+	coupon.ID = id
+	coupon.Status = existing.Status
+	coupon.Version = existing.Version
+	if err := s.normalizeCouponCode(&coupon); err != nil {
+		return nil, err
+	}
+	err = s.repo.UpdateCoupon(&coupon)
+	if errors.Is(err, repositories.ErrVersionMismatch) && expectedVersion == 0 {
+		return nil, repositories.ErrCouponChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.recordRevision(models.RevisionRolledBack, actor, existing, &coupon, version)
+	coupon.Status = coupon.StatusAt(time.Now())
+	return &coupon, nil
+}
+
+// recordRevision adds the coupon's new version to its history. before is nil
+// for a new coupon. The change itself is already made, so a revision that
+// cannot be written is logged rather than reported to the caller; the
+// version it left out is recorded from before the next time the coupon
+// changes.
+func (s *couponService) recordRevision(action models.RevisionAction, actor string, before *models.Coupon, after *models.Coupon, rolledBackTo uint) {
+	if before != nil {
+		if err := s.recordMissingRevision(before); err != nil {
+			log.Printf("Failed to record version %d of coupon %d: %v", before.Version, before.ID, err)
+		}
+	}
+	if err := s.addRevision(action, actor, before, after, rolledBackTo); err != nil {
+		log.Printf("Failed to record version %d of coupon %d: %v", after.Version, after.ID, err)
+	}
+}
+
+// recordMissingRevision adds the coupon's current version to its history if
+// it is not there, comparing it with the latest version that is. Who made
+// the change is not known.
+func (s *couponService) recordMissingRevision(coupon *models.Coupon) error {
+	revisions, err := s.historyRepo.GetRevisions(coupon.ID)
+	if err != nil {
+		return err
+	}
+	var latest *models.Coupon
+	for i := range revisions {
+		if revisions[i].Version == coupon.Version {
+			return nil
+		}
+		if latest == nil || revisions[i].Version > latest.Version {
+			latest = &revisions[i].Coupon
+		}
+	}
+	action := models.RevisionUpdated
+	if latest == nil {
+		action = models.RevisionCreated
+	}
+	return s.addRevision(action, "", latest, coupon, 0)
+}
+
+// ReloadActor is recorded in the history of coupons edited in the data file.
+const ReloadActor = "file"
+
+// recordReload records a coupon edited in the data file; before is nil for
+// one added there.
+func (s *couponService) recordReload(before *models.Coupon, after *models.Coupon) {
+	action := models.RevisionUpdated
+	if before == nil {
+		action = models.RevisionCreated
+	}
+	s.recordRevision(action, ReloadActor, before, after, 0)
+}
+
+func (s *couponService) addRevision(action models.RevisionAction, actor string, before *models.Coupon, after *models.Coupon, rolledBackTo uint) error {
+	revision := &models.CouponRevision{
+		CouponID:     after.ID,
+		Version:      after.Version,
+		Action:       action,
+		Actor:        actor,
+		CreatedAt:    time.Now().UTC(),
+		RolledBackTo: rolledBackTo,
+		Coupon:       definition(after),
+	}
+	if before != nil {
+		changes, err := diffCoupons(definition(before), revision.Coupon)
+		if err != nil {
+			return err
+		}
+		revision.Changes = changes
+	}
+	return s.historyRepo.AddRevision(revision)
+}
+
+// definition strips what is not part of a coupon's definition.
+func definition(coupon *models.Coupon) models.Coupon {
+	d := *coupon
+	d.UsedCount = 0
+	d.ReservedCount = 0
+	return d
+}
+
+// diffCoupons lists the fields that differ between two coupons, by their
+// JSON names, leaving out the version itself.
+func diffCoupons(before models.Coupon, after models.Coupon) ([]models.FieldChange, error) {
+	before.Version, after.Version = 0, 0
+	from, err := toJSONMap(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := toJSONMap(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := []models.FieldChange{}
+	diffMaps("", from, to, &changes)
+	return changes, nil
+}
+
+func toJSONMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+func diffMaps(prefix string, from map[string]interface{}, to map[string]interface{}, changes *[]models.FieldChange) {
+	keys := []string{}
+	for key := range from {
+		keys = append(keys, key)
+	}
+	for key := range to {
+		if _, exists := from[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		a, b := from[key], to[key]
+		if reflect.DeepEqual(a, b) {
+			continue
+		}
+		nestedA, okA := a.(map[string]interface{})
+		nestedB, okB := b.(map[string]interface{})
+		if okA && okB {
+			diffMaps(prefix+key+".", nestedA, nestedB, changes)
+			continue
+		}
+		*changes = append(*changes, models.FieldChange{Field: prefix + key, From: a, To: b})
+	}
+}
@@ -0,0 +1,101 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+)
+
+var (
+	ErrInvalidTransition = errors.New("invalid coupon status transition")
+	ErrInvalidStatus     = errors.New("a new coupon's status must be draft or active")
+	ErrInvalidSchedule   = errors.New("valid_from must be before expiration_date")
+)
+
+// ActivateCoupon publishes a draft. It goes live at valid_from, or at once if
+// valid_from is not set or has passed.
+func (s *couponService) ActivateCoupon(id uint, version uint, actor string) (*models.Coupon, error) {
+	return s.changeStatus(id, version, actor, models.CouponActive, models.CouponDraft)
+}
+
+// PauseCoupon takes a live or scheduled coupon out of evaluation at once.
+func (s *couponService) PauseCoupon(id uint, version uint, actor string) (*models.Coupon, error) {
+	return s.changeStatus(id, version, actor, models.CouponPaused, models.CouponActive, models.CouponScheduled)
+}
+
+func (s *couponService) ResumeCoupon(id uint, version uint, actor string) (*models.Coupon, error) {
+	return s.changeStatus(id, version, actor, models.CouponActive, models.CouponPaused)
+}
+
+func (s *couponService) ArchiveCoupon(id uint, version uint, actor string) (*models.Coupon, error) {
+	return s.changeStatus(id, version, actor, models.CouponArchived,
+		models.CouponDraft, models.CouponScheduled, models.CouponActive, models.CouponPaused, models.CouponExpired)
+}
+
+// RestoreCoupon brings an archived coupon back as paused, so that it does not
+// go live again until it is resumed.
+func (s *couponService) RestoreCoupon(id uint, version uint, actor string) (*models.Coupon, error) {
+	return s.changeStatus(id, version, actor, models.CouponPaused, models.CouponArchived)
+}
+
+// changeStatus moves the coupon to status if its current status is one of
+// from. Only draft, active, paused and archived are stored; scheduled and
+// expired are worked out from the dates of an active coupon. A non-zero
+// version must match the coupon's current version.
+func (s *couponService) changeStatus(id uint, version uint, actor string, status models.CouponStatus, from ...models.CouponStatus) (*models.Coupon, error) {
+	coupon, err := s.repo.GetCouponByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && coupon.Version != version {
+		return nil, repositories.ErrVersionMismatch
+	}
+	now := time.Now()
+	current := coupon.StatusAt(now)
+	allowed := false
+	for _, f := range from {
+		if current == f {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%w: coupon is %s and cannot become %s", ErrInvalidTransition, current, status)
+	}
+
+	updated, err := s.repo.SetCouponStatus(id, coupon.Version, status)
+	if errors.Is(err, repositories.ErrVersionMismatch) && version == 0 {
+		// The caller did not ask for a version; the coupon just changed
+		// under us.
+		return nil, repositories.ErrCouponChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.recordRevision(models.RevisionStatusChanged, actor, coupon, updated, 0)
+	updated.Status = updated.StatusAt(now)
+	return updated, nil
+}
+
+// prepareStatus validates the lifecycle fields of a new coupon. Coupons are
+// created active unless they are staged as a draft.
+func prepareStatus(coupon *models.Coupon) error {
+	switch coupon.Status {
+	case "", models.CouponActive:
+		coupon.Status = models.CouponActive
+	case models.CouponDraft:
+	default:
+		return ErrInvalidStatus
+	}
+	return checkSchedule(coupon)
+}
+
+func checkSchedule(coupon *models.Coupon) error {
+	if coupon.ValidFrom != nil && coupon.ExpirationDate != nil && !coupon.ValidFrom.Before(*coupon.ExpirationDate) {
+		return ErrInvalidSchedule
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"coupon-api/models"
+)
+
+func TestCouponLifecycle(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Status: models.CouponDraft, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	cart := &models.Cart{Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}
+	if reasons := applyIneligible(t, s, coupon.ID, cart); reasons[0].Code != models.ReasonCouponInactive {
+		t.Fatalf("draft coupon reasons = %+v, want %s", reasons, models.ReasonCouponInactive)
+	}
+
+	steps := []struct {
+		change func(id uint, version uint, actor string) (*models.Coupon, error)
+		want   models.CouponStatus
+	}{
+		{s.ActivateCoupon, models.CouponActive},
+		{s.PauseCoupon, models.CouponPaused},
+		{s.ResumeCoupon, models.CouponActive},
+		{s.ArchiveCoupon, models.CouponArchived},
+	}
+	for _, step := range steps {
+		changed, err := step.change(coupon.ID, 0, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed.Status != step.want {
+			t.Fatalf("status = %s, want %s", changed.Status, step.want)
+		}
+	}
+	if _, err := s.ResumeCoupon(coupon.ID, 0, "test"); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("resuming an archived coupon = %v, want %v", err, ErrInvalidTransition)
+	}
+}
+
+func TestScheduledCouponAppliesFromValidFrom(t *testing.T) {
+	s := newTestService(t)
+	tomorrow := time.Now().Add(24 * time.Hour)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, ValidFrom: &tomorrow, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	if status := coupon.StatusAt(time.Now()); status != models.CouponScheduled {
+		t.Fatalf("status before valid_from = %s, want %s", status, models.CouponScheduled)
+	}
+	cart := &models.Cart{Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}
+	if reasons := applyIneligible(t, s, coupon.ID, cart); reasons[0].Code != models.ReasonNotYetValid {
+		t.Fatalf("scheduled coupon reasons = %+v, want %s", reasons, models.ReasonNotYetValid)
+	}
+	if paused, err := s.PauseCoupon(coupon.ID, 0, "test"); err != nil || paused.Status != models.CouponPaused {
+		t.Fatalf("pausing a scheduled coupon = %v, %v; want it paused", paused, err)
+	}
+
+	yesterday := time.Now().Add(-24 * time.Hour)
+	invalid := &models.Coupon{Type: models.CartWise, ValidFrom: &tomorrow, ExpirationDate: &yesterday, Details: map[string]interface{}{"threshold": 10, "discount": 10}}
+	if err := s.CreateCoupon(invalid, "test"); !errors.Is(err, ErrInvalidSchedule) {
+		t.Fatalf("creating a coupon that expires before valid_from = %v, want %v", err, ErrInvalidSchedule)
+	}
+	paused := &models.Coupon{Type: models.CartWise, Status: models.CouponPaused, Details: map[string]interface{}{"threshold": 10, "discount": 10}}
+	if err := s.CreateCoupon(paused, "test"); !errors.Is(err, ErrInvalidStatus) {
+		t.Fatalf("creating a paused coupon = %v, want %v", err, ErrInvalidStatus)
+	}
+}
+
+func TestDeletedCouponIsArchivedAndItsIDNotReused(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Code: "GONE", Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	if err := s.DeleteCoupon(coupon.ID, 0, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if listed, err := s.ListCoupons(models.CouponQuery{}); err != nil || len(listed.Coupons) != 0 {
+		t.Fatalf("coupons listed after delete = %v, %v; want none", listed, err)
+	}
+	if listed, err := s.ListCoupons(models.CouponQuery{IncludeArchived: true}); err != nil || len(listed.Coupons) != 1 || listed.Coupons[0].Status != models.CouponArchived {
+		t.Fatalf("coupons listed with archived = %v, %v; want the archived one", listed, err)
+	}
+
+	next := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	if next.ID == coupon.ID {
+		t.Fatalf("new coupon got the archived coupon's ID %d", next.ID)
+	}
+	restored, err := s.RestoreCoupon(coupon.ID, 0, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Status != models.CouponPaused || restored.Code != "GONE" {
+		t.Fatalf("restored coupon = %+v, want it paused with its code", restored)
+	}
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+	"coupon-api/service/strategies"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+)
+
+const (
+	MergePatchType = "application/merge-patch+json" // RFC 7386
+	JSONPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+var (
+	ErrUnsupportedPatch = errors.New("patch must be application/merge-patch+json or application/json-patch+json")
+	ErrInvalidPatch     = errors.New("invalid patch")
+	ErrPatchFailed      = errors.New("patch cannot be applied to the coupon")
+	ErrProtectedField   = errors.New("field is managed by the server and cannot be changed")
+	ErrInvalidCoupon    = errors.New("coupon must have a type and details")
+)
+
+// protectedFields are the JSON fields a patch may not change. The status
+// changes through the lifecycle endpoints and the external key through a
+// sync.
+var protectedFields = []string{"id", "version", "status", "used_count", "reserved_count", "external_key"}
+
+// PatchCoupon applies a JSON Merge Patch or JSON Patch to the coupon as it is
+// returned by GET and saves the result as a new version. The patched coupon
+// is checked like a new one. A non-zero version must match the coupon's
+// current version.
+func (s *couponService) PatchCoupon(id uint, version uint, patchType string, patch []byte, actor string) (*models.Coupon, error) {
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	existing, err := s.repo.GetCouponByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if version != 0 && existing.Version != version {
+		return nil, repositories.ErrVersionMismatch
+	}
+
+	current := *existing
+	current.Status = current.StatusAt(time.Now())
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := applyPatch(patchType, doc, patch)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProtectedFields(doc, patched); err != nil {
+		return nil, err
+	}
+
+	var coupon models.Coupon
+	if err := json.Unmarshal(patched, &coupon); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPatchFailed, err)
+	}
+	coupon.Status = existing.Status
+	if err := ValidateCoupon(&coupon); err != nil {
+		return nil, err
+	}
+	if err := s.normalizeCouponCode(&coupon); err != nil {
+		return nil, err
+	}
+	if err := checkSchedule(&coupon); err != nil {
+		return nil, err
+	}
+
+	err = s.repo.UpdateCoupon(&coupon)
+	if errors.Is(err, repositories.ErrVersionMismatch) && version == 0 {
+		return nil, repositories.ErrCouponChanged
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.recordRevision(models.RevisionUpdated, actor, existing, &coupon, 0)
+	coupon.Status = coupon.StatusAt(time.Now())
+	return &coupon, nil
+}
+
+func applyPatch(patchType string, doc []byte, patch []byte) ([]byte, error) {
+	switch patchType {
+	case MergePatchType:
+		if !json.Valid(patch) {
+			return nil, ErrInvalidPatch
+		}
+		patched, err := jsonpatch.MergePatch(doc, patch)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPatchFailed, err)
+		}
+		return patched, nil
+	case JSONPatchType:
+		operations, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		patched, err := operations.Apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrPatchFailed, err)
+		}
+		return patched, nil
+	}
+	return nil, ErrUnsupportedPatch
+}
+
+func checkProtectedFields(before []byte, after []byte) error {
+	var from, to map[string]interface{}
+	if err := json.Unmarshal(before, &from); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(after, &to); err != nil {
+		return fmt.Errorf("%w: %v", ErrPatchFailed, err)
+	}
+	for _, field := range protectedFields {
+		if !reflect.DeepEqual(from[field], to[field]) {
+			return fmt.Errorf("%w: %s", ErrProtectedField, field)
+		}
+	}
+	return nil
+}
+
+// ValidateCoupon applies the binding rules of models.Coupon, for coupons
+// that did not come through request binding, and checks that the details
+// fit the coupon's type. The JSON repository uses it to check coupons
+// edited in its file.
+func ValidateCoupon(coupon *models.Coupon) error {
+	if coupon.Type == "" || coupon.Details == nil {
+		return ErrInvalidCoupon
+	}
+	if err := strategies.ValidateDetails(coupon); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCoupon, err)
+	}
+	return nil
+}
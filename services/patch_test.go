@@ -0,0 +1,63 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"coupon-api/models"
+)
+
+func TestPatchCoupon(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Code: "SUMMER10", Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+
+	merged, err := s.PatchCoupon(coupon.ID, coupon.Version, MergePatchType, []byte(`{"code":"summer-20","details":{"discount":20}}`), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	details := merged.Details.(map[string]interface{})
+	if merged.Code != "SUMMER20" || details["discount"] != 20.0 || details["threshold"] != 100.0 {
+		t.Fatalf("merge patched coupon = %+v, want code SUMMER20 with discount 20 and threshold 100", merged)
+	}
+
+	patched, err := s.PatchCoupon(coupon.ID, merged.Version, JSONPatchType, []byte(`[{"op":"test","path":"/code","value":"SUMMER20"},{"op":"replace","path":"/details/threshold","value":50}]`), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patched.Details.(map[string]interface{})["threshold"] != 50.0 || patched.Version != merged.Version+1 {
+		t.Fatalf("JSON patched coupon = %+v, want threshold 50 at version %d", patched, merged.Version+1)
+	}
+	revisions, err := s.GetCouponVersions(coupon.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 || revisions[2].Actor != "bob" {
+		t.Fatalf("revisions = %+v, want 3 with bob's last", revisions)
+	}
+}
+
+func TestPatchCouponErrors(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+
+	for _, test := range []struct {
+		patchType string
+		patch     string
+		want      error
+	}{
+		{"application/json", `{"code":"X"}`, ErrUnsupportedPatch},
+		{MergePatchType, `{"code":`, ErrInvalidPatch},
+		{JSONPatchType, `{"op":"replace"}`, ErrInvalidPatch},
+		{JSONPatchType, `[{"op":"test","path":"/code","value":"OTHER"}]`, ErrPatchFailed},
+		{MergePatchType, `{"used_count":0,"status":"paused"}`, ErrProtectedField},
+		{MergePatchType, `{"details":{"threshold":"a lot"}}`, ErrInvalidCoupon},
+		{MergePatchType, `{"details":null}`, ErrInvalidCoupon},
+	} {
+		if _, err := s.PatchCoupon(coupon.ID, 0, test.patchType, []byte(test.patch), "test"); !errors.Is(err, test.want) {
+			t.Errorf("%s %s = %v, want %v", test.patchType, test.patch, err, test.want)
+		}
+	}
+	if stored, err := s.GetCouponByID(coupon.ID); err != nil || stored.Version != coupon.Version {
+		t.Fatalf("coupon after failed patches = %+v, %v, want it unchanged", stored, err)
+	}
+}
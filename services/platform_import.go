@@ -0,0 +1,44 @@
+package services
+
+import (
+	"errors"
+	"io"
+
+	"coupon-api/models"
+)
+
+var (
+	ErrUnknownAdapter = errors.New("unknown import adapter")
+	// ErrUnsupportedRule fails a row whose discount has rules this service
+	// cannot express. The rules are listed with the row's error.
+	ErrUnsupportedRule = errors.New("discount has rules with no equivalent coupon setting")
+)
+
+func (s *couponService) ImportAdapters() []string {
+	return s.adapterRegistry.Names()
+}
+
+// ImportFromPlatform converts another platform's export with the named
+// adapter and imports the result like ImportCoupons does.
+func (s *couponService) ImportFromPlatform(adapter string, r io.Reader, options models.ImportOptions, actor string) (*models.ImportResult, error) {
+	if err := checkImportMode(&options); err != nil {
+		return nil, err
+	}
+	importAdapter := s.adapterRegistry.GetAdapter(adapter)
+	if importAdapter == nil {
+		return nil, ErrUnknownAdapter
+	}
+	conversions, err := importAdapter.Convert(r)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]importRow, len(conversions))
+	for i, conversion := range conversions {
+		rows[i] = importRow{line: conversion.Line, coupon: conversion.Coupon, unsupported: conversion.Unsupported, err: conversion.Err}
+		if rows[i].err == nil && len(conversion.Unsupported) > 0 {
+			rows[i].err = ErrUnsupportedRule
+		}
+	}
+	result := &models.ImportResult{Adapter: adapter}
+	return result, s.importRows(rows, options, result, actor)
+}
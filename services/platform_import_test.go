@@ -0,0 +1,40 @@
+package services
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"coupon-api/models"
+	"coupon-api/service/adapters"
+)
+
+func TestImportFromPlatformFailsRowsWithUnsupportedRules(t *testing.T) {
+	s := newTestService(t)
+	registry, err := adapters.NewImportAdapterRegistry(filepath.Join("..", "docs", "import_mappings"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.adapterRegistry = registry
+
+	export := "Discount Code,Discount Type,Amount,Amount Type,Minimum Order,Product IDs,Buy Product IDs,Buy Quantity,Get Product IDs,Get Quantity,Get Discount,Starts,Ends,Usage Limit,Limit Per Customer\n" +
+		"TENOFF,order,10,percentage,50,,,,,,,,,,\n" +
+		"FIVER,order,5,fixed_amount,,,,,,,,,,,\n"
+	options := models.ImportOptions{Mode: models.ImportBestEffort}
+	result, err := s.ImportFromPlatform("example", strings.NewReader(export), options, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Adapter != "example" || result.Created != 1 || len(result.Errors) != 1 {
+		t.Fatalf("result = %+v, want TENOFF created and FIVER failed", result)
+	}
+	failure := result.Errors[0]
+	if failure.Line != 3 || failure.Code != "FIVER" || failure.Error != ErrUnsupportedRule.Error() || len(failure.Unsupported) != 1 {
+		t.Fatalf("failure = %+v, want FIVER on line 3 with its unsupported rule", failure)
+	}
+
+	if _, err := s.ImportFromPlatform("other", strings.NewReader(export), options, "test"); !errors.Is(err, ErrUnknownAdapter) {
+		t.Fatalf("ImportFromPlatform with an unknown adapter = %v, want %v", err, ErrUnknownAdapter)
+	}
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+)
+
+const (
+	defaultRedemptionPageSize = 50
+	maxRedemptionPageSize     = 500
+)
+
+func (s *couponService) ListRedemptions(query models.RedemptionQuery) (*models.RedemptionPage, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultRedemptionPageSize
+	}
+	if query.Limit > maxRedemptionPageSize {
+		query.Limit = maxRedemptionPageSize
+	}
+	if query.Offset < 0 {
+		query.Offset = 0
+	}
+	return s.redemptionRepo.ListRedemptions(query)
+}
+
+func (s *couponService) GetRedemption(id uint) (*models.Redemption, error) {
+	return s.redemptionRepo.GetRedemptionByID(id)
+}
+
+func (s *couponService) GetReversals(redemptionID uint) ([]models.Reversal, error) {
+	return s.redemptionRepo.GetReversals(redemptionID)
+}
+
+// ReverseRedemption returns the given lines of a redemption, or all that is
+// left of it when no lines are given. Once every discounted line has been
+// reversed, the coupon use is given back to the global and per-user counts
+// and a single-use code becomes available again. The full reversal is
+// written first and stays pending until both are given back, so reversing
+// the redemption again after a failure finishes it.
+func (s *couponService) ReverseRedemption(id uint, request *models.ReversalRequest) (*models.Reversal, error) {
+	redemption, err := s.redemptionRepo.GetRedemptionByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if redemption.Status == models.RedemptionReversed {
+		reversals, err := s.redemptionRepo.GetReversals(id)
+		if err != nil {
+			return nil, err
+		}
+		for i := range reversals {
+			if reversals[i].Pending {
+				return s.completeReversal(redemption, &reversals[i])
+			}
+		}
+		return nil, repositories.ErrRedemptionReversed
+	}
+
+	requested := request.Lines
+	if len(requested) == 0 {
+		if requested, err = s.unreversedLines(redemption); err != nil {
+			return nil, err
+		}
+	}
+	reversal := &models.Reversal{
+		RedemptionID: redemption.ID,
+		CouponID:     redemption.CouponID,
+		UserID:       redemption.UserID,
+		Reason:       request.Reason,
+		ReversedAt:   time.Now().UTC(),
+		Lines:        []models.ReversalLine{},
+	}
+	quantities, discounts := productTotals(redemption)
+	for _, line := range requested {
+		discount := 0.0
+		if quantities[line.ProductID] > 0 {
+			discount = discounts[line.ProductID] * float64(line.Quantity) / float64(quantities[line.ProductID])
+		}
+		reversal.Lines = append(reversal.Lines, models.ReversalLine{ProductID: line.ProductID, Quantity: line.Quantity, Discount: discount})
+		reversal.Discount += discount
+	}
+	if err := s.redemptionRepo.CreateReversal(reversal); err != nil {
+		return nil, err
+	}
+	if !reversal.Full {
+		return reversal, nil
+	}
+	return s.completeReversal(redemption, reversal)
+}
+
+// completeReversal gives back the coupon use and code of a pending full
+// reversal. The code goes first because releasing it again is harmless: a
+// code that is no longer redeemed was already given back.
+func (s *couponService) completeReversal(redemption *models.Redemption, reversal *models.Reversal) (*models.Reversal, error) {
+	if redemption.SingleUse {
+		_, err := s.codeRepo.UpdateCodeStatus(redemption.Code, models.CodeRedeemed, models.CodeAvailable, 0)
+		if err != nil && !errors.Is(err, repositories.ErrCodeNotFound) && !errors.Is(err, repositories.ErrCodeStatusChanged) {
+			return nil, err
+		}
+	}
+	if redemption.CountedUsage {
+		err := s.repo.ReturnUsage(redemption.CouponID, redemption.UserID)
+		if err != nil && !errors.Is(err, repositories.ErrCouponNotFound) {
+			return nil, err
+		}
+	}
+	if err := s.redemptionRepo.CompleteReversal(reversal.ID); err != nil {
+		return nil, err
+	}
+	reversal.Pending = false
+	return reversal, nil
+}
+
+// unreversedLines returns what is left to reverse of each redemption line.
+func (s *couponService) unreversedLines(redemption *models.Redemption) ([]models.ReversalLineRequest, error) {
+	reversals, err := s.redemptionRepo.GetReversals(redemption.ID)
+	if err != nil {
+		return nil, err
+	}
+	reversed := make(map[uint]uint)
+	for _, reversal := range reversals {
+		for _, line := range reversal.Lines {
+			reversed[line.ProductID] += line.Quantity
+		}
+	}
+	quantities, _ := productTotals(redemption)
+	lines := []models.ReversalLineRequest{}
+	for _, line := range redemption.Lines {
+		quantity := quantities[line.ProductID]
+		if quantity > reversed[line.ProductID] {
+			lines = append(lines, models.ReversalLineRequest{ProductID: line.ProductID, Quantity: quantity - reversed[line.ProductID]})
+		}
+		// Later lines for the same product are covered by this one.
+		delete(quantities, line.ProductID)
+	}
+	return lines, nil
+}
+
+// productTotals adds up the quantity and discount of a redemption's lines
+// per product; a product can be on more than one line.
+func productTotals(redemption *models.Redemption) (map[uint]uint, map[uint]float64) {
+	quantities := make(map[uint]uint)
+	discounts := make(map[uint]float64)
+	for _, line := range redemption.Lines {
+		quantities[line.ProductID] += line.Quantity
+		discounts[line.ProductID] += line.Discount
+	}
+	return quantities, discounts
+}
+
+// recordRedemption writes the ledger entry for a committed reservation.
+func (s *couponService) recordRedemption(reservation *models.Reservation) (*models.Redemption, error) {
+	redemption := &models.Redemption{
+		CouponID:      reservation.CouponID,
+		CouponVersion: reservation.CouponVersion,
+		UserID:        reservation.UserID,
+		Code:          reservation.Code,
+		SingleUse:     reservation.SingleUse,
+		CountedUsage:  reservation.HoldsUsage,
+		RedeemedAt:    time.Now().UTC(),
+		CartTotal:     reservation.CartTotal,
+		Discount:      reservation.Discount,
+		Lines:         reservation.Lines,
+	}
+	if err := s.redemptionRepo.CreateRedemption(redemption); err != nil {
+		return nil, err
+	}
+	return redemption, nil
+}
+
+// redemptionLines turns per-item discounts into ledger lines, leaving out
+// items the coupon did not discount, and returns the total discount.
+func redemptionLines(cart *models.Cart, lines []float64) ([]models.RedemptionLine, float64) {
+	redemptionLines := []models.RedemptionLine{}
+	total := 0.0
+	for i, item := range cart.Items {
+		total += lines[i]
+		if lines[i] == 0 {
+			continue
+		}
+		redemptionLines = append(redemptionLines, models.RedemptionLine{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+			Price:     item.Price,
+			Discount:  lines[i],
+		})
+	}
+	return redemptionLines, total
+}
+
+// allocateLines returns each cart item's share of an applied coupon's
+// discount. Discounts a strategy did not put on items, such as cart-wise
+// ones, are spread over the items by their remaining value.
+func allocateLines(updatedCart *models.UpdatedCart, cart *models.Cart) []float64 {
+	lines := make([]float64, len(cart.Items))
+	remaining := &models.Cart{Items: make([]models.CartItem, len(cart.Items))}
+	unallocated := updatedCart.TotalDiscount
+	for i, item := range updatedCart.Items {
+		lines[i] = item.TotalDiscount
+		unallocated -= item.TotalDiscount
+		remaining.Items[i] = item
+		remaining.Items[i].Price -= item.TotalDiscount / float64(item.Quantity)
+	}
+	if unallocated > discountEpsilon {
+		for i, share := range spreadDiscount(unallocated, remaining) {
+			lines[i] += share
+		}
+	}
+	return lines
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+)
+
+// commitTestReservation reserves the coupon for the cart and commits the
+// reservation.
+func commitTestReservation(t *testing.T, s *couponService, couponID uint, cart *models.Cart) *models.Reservation {
+	t.Helper()
+	reservation, err := s.ReserveCoupon(couponID, &models.ReservationRequest{Cart: *cart})
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := s.CommitReservation(reservation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return committed
+}
+
+func TestCommitReservationRecordsRedemption(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+	other := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 10, "discount": 5}})
+
+	// The client's item discounts are ignored.
+	cart := &models.Cart{UserID: 7, Items: []models.CartItem{
+		{ProductID: 1, Quantity: 2, Price: 100, TotalDiscount: 150},
+		{ProductID: 2, Quantity: 1, Price: 50, TotalDiscount: 40},
+	}}
+	committed := commitTestReservation(t, s, coupon.ID, cart)
+	commitTestReservation(t, s, other.ID, cart)
+
+	page, err := s.ListRedemptions(models.RedemptionQuery{CouponID: coupon.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || len(page.Redemptions) != 1 {
+		t.Fatalf("redemptions of the coupon = %+v, want one", page)
+	}
+	redemption := page.Redemptions[0]
+	if redemption.ID != committed.RedemptionID || redemption.UserID != 7 || math.Abs(redemption.CartTotal-250) > 1e-6 {
+		t.Fatalf("redemption = %+v, want ID %d for user 7 with a cart total of 250", redemption, committed.RedemptionID)
+	}
+	lines := 0.0
+	for _, line := range redemption.Lines {
+		lines += line.Discount
+	}
+	if len(redemption.Lines) != 2 || math.Abs(lines-redemption.Discount) > 1e-6 || math.Abs(redemption.Discount-25) > 1e-6 {
+		t.Fatalf("redemption lines %+v add up to %v, want two lines adding up to 25", redemption.Lines, lines)
+	}
+}
+
+func TestReverseRedemptionWithRepeatedProduct(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.ProductWise, UsageLimit: 5, Details: map[string]interface{}{"product_id": 1, "discount": 10}})
+	request := &models.ReservationRequest{Cart: models.Cart{UserID: 3, Items: []models.CartItem{
+		{ProductID: 1, Quantity: 2, Price: 100},
+		{ProductID: 1, Quantity: 1, Price: 100},
+	}}}
+	reservation, err := s.ReserveCoupon(coupon.ID, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := s.CommitReservation(reservation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := committed.RedemptionID
+
+	partial, err := s.ReverseRedemption(id, &models.ReversalRequest{Lines: []models.ReversalLineRequest{{ProductID: 1, Quantity: 2}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial.Full || math.Abs(partial.Discount-20) > 1e-6 {
+		t.Fatalf("partial reversal: full %v, discount %v; want false and 20", partial.Full, partial.Discount)
+	}
+	_, err = s.ReverseRedemption(id, &models.ReversalRequest{Lines: []models.ReversalLineRequest{{ProductID: 1, Quantity: 2}}})
+	if !errors.Is(err, repositories.ErrReversalExceeds) {
+		t.Fatalf("reversing more than is left = %v, want %v", err, repositories.ErrReversalExceeds)
+	}
+
+	rest, err := s.ReverseRedemption(id, &models.ReversalRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rest.Full || len(rest.Lines) != 1 || rest.Lines[0].Quantity != 1 {
+		t.Fatalf("reversal of the rest = %+v, want one full line of quantity 1", rest)
+	}
+	redemption, err := s.GetRedemption(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redemption.Status != models.RedemptionReversed || math.Abs(redemption.ReversedDiscount-redemption.Discount) > 1e-6 {
+		t.Fatalf("redemption status %s, reversed %v of %v", redemption.Status, redemption.ReversedDiscount, redemption.Discount)
+	}
+	if stored, _ := s.repo.GetCouponByID(coupon.ID); stored.UsedCount != 0 {
+		t.Fatalf("used count = %d after a full reversal, want 0", stored.UsedCount)
+	}
+}
+
+type failingUsageRepository struct {
+	repositories.CouponRepository
+}
+
+func (failingUsageRepository) ReturnUsage(uint, uint) error {
+	return errors.New("disk full")
+}
+
+func TestReverseRedemptionFinishedAfterUsageReturnFails(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, UsageLimit: 1, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	request := &models.ReservationRequest{Cart: models.Cart{UserID: 4, Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}}
+	reservation, err := s.ReserveCoupon(coupon.ID, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := s.CommitReservation(reservation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo := s.repo
+	s.repo = failingUsageRepository{repo}
+	if _, err := s.ReverseRedemption(committed.RedemptionID, &models.ReversalRequest{}); err == nil {
+		t.Fatal("reversal succeeded without giving back the coupon use")
+	}
+	s.repo = repo
+	reversal, err := s.ReverseRedemption(committed.RedemptionID, &models.ReversalRequest{})
+	if err != nil {
+		t.Fatalf("retrying the reversal: %v", err)
+	}
+	if !reversal.Full || reversal.Pending {
+		t.Fatalf("reversal after retry = %+v, want full and not pending", reversal)
+	}
+	if stored, _ := s.repo.GetCouponByID(coupon.ID); stored.UsedCount != 0 {
+		t.Fatalf("used count = %d after the retried reversal, want 0", stored.UsedCount)
+	}
+	if _, err := s.ReverseRedemption(committed.RedemptionID, &models.ReversalRequest{}); !errors.Is(err, repositories.ErrRedemptionReversed) {
+		t.Fatalf("reversing again = %v, want %v", err, repositories.ErrRedemptionReversed)
+	}
+	if stored, _ := s.repo.GetCouponByID(coupon.ID); stored.UsedCount != 0 {
+		t.Fatalf("used count = %d after reversing again, want 0", stored.UsedCount)
+	}
+}
@@ -0,0 +1,302 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+)
+
+const (
+	defaultReservationTTL = 15 * time.Minute
+	maxReservationTTL     = 24 * time.Hour
+)
+
+var (
+	ErrInvalidTTL         = errors.New("ttl_seconds must be between 0 and 86400")
+	ErrReservationExpired = errors.New("reservation has expired")
+)
+
+func (s *couponService) ReserveCoupon(couponID uint, request *models.ReservationRequest) (*models.Reservation, error) {
+	coupon, err := s.repo.GetCouponByID(couponID)
+	if err != nil {
+		return nil, err
+	}
+	return s.reserve(coupon, nil, request)
+}
+
+func (s *couponService) ReserveCouponByCode(code string, request *models.ReservationRequest) (*models.Reservation, error) {
+	coupon, singleUse, err := s.resolveCode(code)
+	if err != nil {
+		return nil, err
+	}
+	return s.reserve(coupon, singleUse, request)
+}
+
+func (s *couponService) GetReservation(id uint) (*models.Reservation, error) {
+	return s.reservationRepo.GetReservationByID(id)
+}
+
+// CommitReservation turns a reservation into a redemption when the order is
+// placed: the held use becomes a used one and the ledger entry is written.
+// Closing the reservation first makes sure only one caller commits it. If a
+// later step fails, the steps before it are undone and the reservation is
+// active again, so the commit can be retried.
+func (s *couponService) CommitReservation(id uint) (*models.Reservation, error) {
+	reservation, err := s.reservationRepo.GetReservationByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if reservation.Status == models.ReservationActive && !time.Now().Before(reservation.ExpiresAt) {
+		// The sweeper has not got to it yet; expire it now.
+		s.closeReservation(id, models.ReservationExpired)
+		return nil, ErrReservationExpired
+	}
+
+	committed, err := s.reservationRepo.CloseReservation(id, models.ReservationCommitted)
+	if err != nil {
+		return nil, err
+	}
+	if committed.SingleUse {
+		if _, err := s.codeRepo.UpdateCodeStatus(committed.Code, models.CodeReserved, models.CodeRedeemed, committed.UserID); err != nil {
+			s.undoCommit(committed, false, false)
+			return nil, err
+		}
+	}
+	if committed.HoldsUsage {
+		if err := s.repo.CommitUsage(committed.CouponID, committed.UserID); err != nil {
+			s.undoCommit(committed, committed.SingleUse, false)
+			return nil, err
+		}
+	}
+	redemption, err := s.recordRedemption(committed)
+	if err != nil {
+		s.undoCommit(committed, committed.SingleUse, committed.HoldsUsage)
+		return nil, err
+	}
+
+	// The redemption is in the ledger and cannot be taken back, so the commit
+	// stands even if the reservation cannot be linked to it.
+	committed.RedemptionID = redemption.ID
+	if err := s.reservationRepo.AttachRedemption(id, redemption.ID); err != nil {
+		log.Printf("Failed to link reservation %d to redemption %d: %v", id, redemption.ID, err)
+	}
+	return committed, nil
+}
+
+// undoCommit reverses the steps of a commit that had been made when a later
+// one failed, and reopens the reservation.
+func (s *couponService) undoCommit(reservation *models.Reservation, codeRedeemed bool, usageCommitted bool) {
+	if usageCommitted {
+		if err := s.repo.UncommitUsage(reservation.CouponID, reservation.UserID); err != nil {
+			log.Printf("Failed to undo the use committed for reservation %d: %v", reservation.ID, err)
+		}
+	}
+	if codeRedeemed {
+		if _, err := s.codeRepo.UpdateCodeStatus(reservation.Code, models.CodeRedeemed, models.CodeReserved, reservation.UserID); err != nil {
+			log.Printf("Failed to undo the redemption of code %s for reservation %d: %v", reservation.Code, reservation.ID, err)
+		}
+	}
+	if err := s.reservationRepo.ReopenReservation(reservation.ID); err != nil {
+		log.Printf("Failed to reopen reservation %d: %v", reservation.ID, err)
+	}
+}
+
+func (s *couponService) ReleaseReservation(id uint) (*models.Reservation, error) {
+	return s.closeReservation(id, models.ReservationReleased)
+}
+
+// ReleaseExpiredReservations gives back the uses held by every reservation
+// past its expiry and returns how many were released.
+func (s *couponService) ReleaseExpiredReservations() (int, error) {
+	expired, err := s.reservationRepo.GetExpiredReservations(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	for _, reservation := range expired {
+		_, err := s.closeReservation(reservation.ID, models.ReservationExpired)
+		if errors.Is(err, repositories.ErrReservationClosed) {
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+// RestoreReservedUsage sets the coupons' reserved counts to the uses held by
+// active reservations. A use is reserved before its reservation is
+// recorded, so one held by a reservation that a crash kept from being
+// recorded is only given back this way; it runs at startup, before any
+// reservation is made.
+func (s *couponService) RestoreReservedUsage() error {
+	active, err := s.reservationRepo.GetActiveReservations()
+	if err != nil {
+		return err
+	}
+	held := make(map[uint]map[uint]uint)
+	for _, reservation := range active {
+		if !reservation.HoldsUsage {
+			continue
+		}
+		if held[reservation.CouponID] == nil {
+			held[reservation.CouponID] = make(map[uint]uint)
+		}
+		held[reservation.CouponID][reservation.UserID]++
+	}
+	return s.repo.SetReservedUsage(held)
+}
+
+// StartReservationSweeper releases expired reservations every interval until
+// the returned stop function is called.
+func StartReservationSweeper(service CouponService, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				released, err := service.ReleaseExpiredReservations()
+				if err != nil {
+					log.Printf("Failed to release expired reservations: %v", err)
+				}
+				if released > 0 {
+					log.Printf("Released %d expired reservations", released)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *couponService) reserve(coupon *models.Coupon, singleUse *models.CouponCode, request *models.ReservationRequest) (*models.Reservation, error) {
+	ttl, err := reservationTTL(request.TTLSeconds)
+	if err != nil {
+		return nil, err
+	}
+	cart := &request.Cart
+	if singleUse != nil {
+		if reasons := singleUseReasons(singleUse); len(reasons) > 0 {
+			return nil, &IneligibleError{Reasons: reasons}
+		}
+	}
+
+	updatedCart, err := s.applyCoupon(coupon, cart)
+	if err != nil {
+		return nil, err
+	}
+	return s.hold(coupon, singleUse, cart, updatedCart, allocateLines(updatedCart, cart), ttl)
+}
+
+// hold claims what a reservation needs - the single-use code, if any, and a
+// use under the coupon's limits - and records the reservation. Anything
+// already claimed is given back if a later step fails.
+func (s *couponService) hold(coupon *models.Coupon, singleUse *models.CouponCode, cart *models.Cart, updatedCart *models.UpdatedCart, lines []float64, ttl time.Duration) (*models.Reservation, error) {
+	now := time.Now().UTC()
+	reservation := &models.Reservation{
+		CouponID:      coupon.ID,
+		CouponVersion: coupon.Version,
+		UserID:        cart.UserID,
+		Code:          coupon.Code,
+		Status:        models.ReservationActive,
+		HoldsUsage:    tracksUsage(coupon),
+		CartTotal:     cartTotal(cart),
+		UpdatedCart:   updatedCart,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(ttl),
+	}
+	reservation.Lines, reservation.Discount = redemptionLines(cart, lines)
+
+	if singleUse != nil {
+		_, err := s.codeRepo.UpdateCodeStatus(singleUse.Code, models.CodeAvailable, models.CodeReserved, cart.UserID)
+		if errors.Is(err, repositories.ErrCodeStatusChanged) {
+			return nil, &IneligibleError{Reasons: singleUseReasons(&models.CouponCode{Status: models.CodeReserved})}
+		}
+		if err != nil {
+			return nil, err
+		}
+		reservation.Code = singleUse.Code
+		reservation.SingleUse = true
+	}
+
+	if reservation.HoldsUsage {
+		// The limits checked by applyCoupon may be stale by now; ReserveUsage
+		// checks them again atomically and is the one that counts.
+		if err := s.repo.ReserveUsage(coupon.ID, cart.UserID); err != nil {
+			s.releaseCode(reservation)
+			return nil, usageError(coupon, err)
+		}
+	}
+
+	if err := s.reservationRepo.CreateReservation(reservation); err != nil {
+		if reservation.HoldsUsage {
+			s.repo.ReleaseUsage(coupon.ID, cart.UserID)
+		}
+		s.releaseCode(reservation)
+		return nil, err
+	}
+	return reservation, nil
+}
+
+func (s *couponService) closeReservation(id uint, status models.ReservationStatus) (*models.Reservation, error) {
+	closed, err := s.reservationRepo.CloseReservation(id, status)
+	if err != nil {
+		return nil, err
+	}
+	if closed.HoldsUsage {
+		if err := s.repo.ReleaseUsage(closed.CouponID, closed.UserID); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.releaseCode(closed); err != nil {
+		return nil, err
+	}
+	return closed, nil
+}
+
+func (s *couponService) releaseCode(reservation *models.Reservation) error {
+	if !reservation.SingleUse {
+		return nil
+	}
+	_, err := s.codeRepo.UpdateCodeStatus(reservation.Code, models.CodeReserved, models.CodeAvailable, 0)
+	return err
+}
+
+// usageError turns a failed conditional reserve into the ineligibility reason
+// the caller would have got had the limit been reached before the request.
+func usageError(coupon *models.Coupon, err error) error {
+	switch {
+	case errors.Is(err, repositories.ErrUsageLimitReached):
+		return &IneligibleError{Reasons: []models.IneligibilityReason{{
+			Code:     models.ReasonUsageExhausted,
+			Message:  err.Error(),
+			Required: coupon.UsageLimit,
+		}}}
+	case errors.Is(err, repositories.ErrUserLimitReached):
+		return &IneligibleError{Reasons: []models.IneligibilityReason{{
+			Code:     models.ReasonUserLimitReached,
+			Message:  err.Error(),
+			Required: coupon.PerUserLimit,
+		}}}
+	}
+	return err
+}
+
+func reservationTTL(seconds int) (time.Duration, error) {
+	if seconds == 0 {
+		return defaultReservationTTL, nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	if seconds < 0 || ttl > maxReservationTTL {
+		return 0, ErrInvalidTTL
+	}
+	return ttl, nil
+}
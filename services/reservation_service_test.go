@@ -0,0 +1,122 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+)
+
+func TestReserveCouponIgnoresClientDiscounts(t *testing.T) {
+	s := newTestService(t)
+	cartWise := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, Details: map[string]interface{}{"threshold": 100, "discount": 10}})
+	productWise := createTestCoupon(t, s, &models.Coupon{Type: models.ProductWise, Details: map[string]interface{}{"product_id": 1, "discount": 50}})
+
+	for _, test := range []struct {
+		coupon *models.Coupon
+		want   float64
+	}{
+		{cartWise, 25},
+		{productWise, 100},
+	} {
+		request := &models.ReservationRequest{Cart: models.Cart{Items: []models.CartItem{
+			{ProductID: 1, Quantity: 2, Price: 100, TotalDiscount: 150},
+			{ProductID: 2, Quantity: 1, Price: 50, TotalDiscount: 40},
+		}}}
+		reservation, err := s.ReserveCoupon(test.coupon.ID, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(reservation.Discount-test.want) > 1e-6 {
+			t.Errorf("%s coupon: reserved discount = %v, want %v", test.coupon.Type, reservation.Discount, test.want)
+		}
+		if math.Abs(reservation.UpdatedCart.TotalDiscount-test.want) > 1e-6 {
+			t.Errorf("%s coupon: cart discount = %v, want %v", test.coupon.Type, reservation.UpdatedCart.TotalDiscount, test.want)
+		}
+	}
+}
+
+type failingRedemptionRepository struct {
+	repositories.RedemptionRepository
+}
+
+func (failingRedemptionRepository) CreateRedemption(*models.Redemption) error {
+	return errors.New("disk full")
+}
+
+func TestCommitReservationUndoneWhenLedgerFails(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, UsageLimit: 1, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	request := &models.ReservationRequest{Cart: models.Cart{UserID: 7, Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}}
+	reservation, err := s.ReserveCoupon(coupon.ID, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ledger := s.redemptionRepo
+	s.redemptionRepo = failingRedemptionRepository{ledger}
+	if _, err := s.CommitReservation(reservation.ID); err == nil {
+		t.Fatal("commit succeeded without a ledger entry")
+	}
+	reopened, err := s.GetReservation(reservation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.Status != models.ReservationActive {
+		t.Fatalf("reservation status = %s, want %s", reopened.Status, models.ReservationActive)
+	}
+	stored, err := s.repo.GetCouponByID(coupon.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.UsedCount != 0 || stored.ReservedCount != 1 {
+		t.Fatalf("used %d, reserved %d after a failed commit; want 0 and 1", stored.UsedCount, stored.ReservedCount)
+	}
+
+	s.redemptionRepo = ledger
+	committed, err := s.CommitReservation(reservation.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed.RedemptionID == 0 {
+		t.Fatal("committed reservation has no redemption")
+	}
+	if stored, _ = s.repo.GetCouponByID(coupon.ID); stored.UsedCount != 1 || stored.ReservedCount != 0 {
+		t.Fatalf("used %d, reserved %d after the commit; want 1 and 0", stored.UsedCount, stored.ReservedCount)
+	}
+}
+
+func TestRestoreReservedUsageDropsUsesWithoutReservation(t *testing.T) {
+	s := newTestService(t)
+	coupon := createTestCoupon(t, s, &models.Coupon{Type: models.CartWise, UsageLimit: 2, Details: map[string]interface{}{"threshold": 10, "discount": 10}})
+	request := &models.ReservationRequest{Cart: models.Cart{UserID: 5, Items: []models.CartItem{{ProductID: 1, Quantity: 1, Price: 100}}}}
+	if _, err := s.ReserveCoupon(coupon.ID, request); err != nil {
+		t.Fatal(err)
+	}
+	// A use held by a checkout that stopped before its reservation was
+	// recorded.
+	if err := s.repo.ReserveUsage(coupon.ID, 6); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.RestoreReservedUsage(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.repo.GetCouponByID(coupon.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ReservedCount != 1 {
+		t.Fatalf("reserved count = %d after restoring, want 1", stored.ReservedCount)
+	}
+	for userID, want := range map[uint]uint{5: 1, 6: 0} {
+		if count, err := s.repo.GetUserUsageCount(coupon.ID, userID); err != nil || count != want {
+			t.Fatalf("usage of user %d = %d, %v; want %d", userID, count, err, want)
+		}
+	}
+	if _, err := s.ReserveCoupon(coupon.ID, &models.ReservationRequest{Cart: models.Cart{UserID: 7, Items: request.Cart.Items}}); err != nil {
+		t.Fatalf("reserving the use given back: %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"coupon-api/models"
+	"coupon-api/repositories"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SyncActor is recorded in the history of every change a sync makes, which
+// is how changes made any other way are told apart as drift.
+const SyncActor = "sync"
+
+var (
+	ErrInvalidDefinition = errors.New("invalid coupon definition")
+	// ErrStalePlan is returned when a coupon changed between planning and
+	// applying a sync.
+	ErrStalePlan = errors.New("coupon changed since the plan was made")
+)
+
+// LoadCouponDefinitions reads every .yaml, .yml and .json file under dir. Each
+// file holds one coupon in the API's JSON shape plus a key, and may not set
+// fields the server manages.
+func LoadCouponDefinitions(dir string) ([]models.CouponDefinition, error) {
+	var definitions []models.CouponDefinition
+	paths := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext != ".yaml" && ext != ".yml" && ext != ".json" {
+			return nil
+		}
+		definition, err := readDefinition(path, ext)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidDefinition, path, err)
+		}
+		if other, exists := paths[definition.Key]; exists {
+			return fmt.Errorf("%w: key %q is used by both %s and %s", ErrInvalidDefinition, definition.Key, other, path)
+		}
+		paths[definition.Key] = path
+		definitions = append(definitions, *definition)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Key < definitions[j].Key })
+	return definitions, nil
+}
+
+func readDefinition(path string, ext string) (*models.CouponDefinition, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ext != ".json" {
+		// YAML is turned into JSON so that both formats share the coupon's
+		// JSON field names and checks.
+		var value interface{}
+		if err := yaml.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+		if data, err = json.Marshal(value); err != nil {
+			return nil, err
+		}
+	}
+	var file struct {
+		Key string `json:"key"`
+		models.Coupon
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return nil, err
+	}
+	if file.Key == "" {
+		return nil, errors.New("key is required")
+	}
+	coupon := file.Coupon
+	if coupon.ID != 0 || coupon.Version != 0 || coupon.UsedCount != 0 || coupon.ReservedCount != 0 || coupon.ExternalKey != "" {
+		return nil, errors.New("id, version, used_count, reserved_count and external_key are managed by the server")
+	}
+	return &models.CouponDefinition{Key: file.Key, Path: path, Coupon: coupon}, nil
+}
+
+// PlanSync compares the definitions with the stored coupons. Coupons whose
+// definition changed are updated, managed coupons without a definition are
+// archived, and managed coupons changed outside a sync are reported as
+// drift. Applying the plan overwrites drift with the definitions.
+func (s *couponService) PlanSync(definitions []models.CouponDefinition) (*models.SyncPlan, error) {
+	coupons, err := s.repo.GetAllCoupons()
+	if err != nil {
+		return nil, err
+	}
+	managed := make(map[string]models.Coupon)
+	owners := make(map[string]models.Coupon)
+	for _, coupon := range coupons {
+		if coupon.ExternalKey != "" {
+			managed[coupon.ExternalKey] = coupon
+		}
+		if coupon.Code != "" {
+			owners[models.NormalizeCode(coupon.Code)] = coupon
+		}
+	}
+
+	plan := &models.SyncPlan{Changes: []models.SyncChange{}, Drift: []models.SyncDrift{}}
+	var creates, updates, archives []models.SyncChange
+	defined := make(map[string]bool)
+	codes := make(map[string]string)
+	for _, def := range definitions {
+		defined[def.Key] = true
+		desired := def.Coupon
+		desired.ExternalKey = def.Key
+		if err := s.prepareDefinition(&desired); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidDefinition, def.Path, err)
+		}
+		if desired.Code != "" {
+			if other, exists := codes[desired.Code]; exists {
+				return nil, fmt.Errorf("%w: %s: code %s is also used by %q", ErrInvalidDefinition, def.Path, desired.Code, other)
+			}
+			codes[desired.Code] = def.Key
+			if owner, exists := owners[desired.Code]; exists && owner.ExternalKey == "" {
+				return nil, fmt.Errorf("%w: %s: code %s belongs to coupon %d, which is not managed by a sync", ErrInvalidDefinition, def.Path, desired.Code, owner.ID)
+			}
+		}
+
+		existing, exists := managed[def.Key]
+		if !exists {
+			creates = append(creates, models.SyncChange{Action: models.SyncCreate, Key: def.Key, Coupon: desired})
+			continue
+		}
+		if err := s.checkDrift(plan, &existing); err != nil {
+			return nil, err
+		}
+		desired.ID = existing.ID
+		desired.Version = existing.Version
+		current := definition(&existing)
+		if current.Status == "" {
+			current.Status = models.CouponActive
+		}
+		changes, err := diffCoupons(current, desired)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			plan.Unchanged++
+			continue
+		}
+		updates = append(updates, models.SyncChange{Action: models.SyncUpdate, Key: def.Key, CouponID: existing.ID, Coupon: desired, Changes: changes})
+	}
+
+	for key, existing := range managed {
+		if defined[key] || existing.Status == models.CouponArchived {
+			continue
+		}
+		if err := s.checkDrift(plan, &existing); err != nil {
+			return nil, err
+		}
+		archived := definition(&existing)
+		archived.Status = models.CouponArchived
+		archives = append(archives, models.SyncChange{
+			Action:   models.SyncArchive,
+			Key:      key,
+			CouponID: existing.ID,
+			Coupon:   archived,
+			Changes:  []models.FieldChange{{Field: "status", From: existing.StatusAt(time.Now()), To: models.CouponArchived}},
+		})
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].Key < archives[j].Key })
+	sort.Slice(plan.Drift, func(i, j int) bool { return plan.Drift[i].Key < plan.Drift[j].Key })
+
+	// Archiving and updating first frees codes that a new coupon may take.
+	plan.Changes = append(append(append(plan.Changes, archives...), updates...), creates...)
+	return plan, nil
+}
+
+// prepareDefinition checks a definition like a new coupon. A definition may
+// also declare a paused coupon.
+func (s *couponService) prepareDefinition(coupon *models.Coupon) error {
+	if err := ValidateCoupon(coupon); err != nil {
+		return err
+	}
+	if err := s.normalizeCouponCode(coupon); err != nil {
+		return err
+	}
+	if coupon.Status == models.CouponPaused {
+		return checkSchedule(coupon)
+	}
+	return prepareStatus(coupon)
+}
+
+// checkDrift reports the coupon if its latest version was not written by a
+// sync, comparing it with the last version that was.
+func (s *couponService) checkDrift(plan *models.SyncPlan, coupon *models.Coupon) error {
+	revisions, err := s.historyRepo.GetRevisions(coupon.ID)
+	if err != nil {
+		return err
+	}
+	var synced, latest *models.CouponRevision
+	for i := range revisions {
+		if latest == nil || revisions[i].Version > latest.Version {
+			latest = &revisions[i]
+		}
+		if revisions[i].Actor == SyncActor && (synced == nil || revisions[i].Version > synced.Version) {
+			synced = &revisions[i]
+		}
+	}
+	if synced == nil || synced.Version == coupon.Version {
+		return nil
+	}
+	changes, err := diffCoupons(synced.Coupon, definition(coupon))
+	if err != nil {
+		return err
+	}
+	// A coupon changed and then put back the way the sync left it has a
+	// newer version but nothing that drifted.
+	if len(changes) == 0 {
+		return nil
+	}
+	drift := models.SyncDrift{Key: coupon.ExternalKey, CouponID: coupon.ID, Version: coupon.Version, Changes: changes}
+	if latest != nil {
+		drift.Actor = latest.Actor
+	}
+	plan.Drift = append(plan.Drift, drift)
+	return nil
+}
+
+// ApplySync makes the plan's changes in order and returns how many were
+// made. It stops at the first failure; running a new plan picks up from
+// there.
+func (s *couponService) ApplySync(plan *models.SyncPlan) (int, error) {
+	for i, change := range plan.Changes {
+		if err := s.applySyncChange(change); err != nil {
+			return i, fmt.Errorf("%s %s: %w", change.Action, change.Key, err)
+		}
+	}
+	return len(plan.Changes), nil
+}
+
+func (s *couponService) applySyncChange(change models.SyncChange) error {
+	s.codeMutex.Lock()
+	defer s.codeMutex.Unlock()
+	coupon := change.Coupon
+	// A single-use code may have taken the coupon's code since the plan
+	// was made.
+	if change.Action != models.SyncArchive {
+		if err := s.normalizeCouponCode(&coupon); err != nil {
+			return err
+		}
+	}
+	switch change.Action {
+	case models.SyncCreate:
+		if err := s.repo.CreateCoupon(&coupon); err != nil {
+			return err
+		}
+		s.recordRevision(models.RevisionCreated, SyncActor, nil, &coupon, 0)
+		return nil
+	case models.SyncUpdate:
+		existing, err := s.repo.GetCouponByID(change.CouponID)
+		if err != nil {
+			return err
+		}
+		err = s.repo.UpdateCoupon(&coupon)
+		if errors.Is(err, repositories.ErrVersionMismatch) {
+			return ErrStalePlan
+		}
+		if err != nil {
+			return err
+		}
+		s.recordRevision(models.RevisionUpdated, SyncActor, existing, &coupon, 0)
+		return nil
+	case models.SyncArchive:
+		_, err := s.changeStatus(change.CouponID, coupon.Version, SyncActor, models.CouponArchived,
+			models.CouponDraft, models.CouponScheduled, models.CouponActive, models.CouponPaused, models.CouponExpired)
+		if errors.Is(err, repositories.ErrVersionMismatch) {
+			return ErrStalePlan
+		}
+		return err
+	}
+	return fmt.Errorf("unknown sync action %q", change.Action)
+}
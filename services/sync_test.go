@@ -0,0 +1,43 @@
+package services
+
+import (
+	"testing"
+
+	"coupon-api/models"
+)
+
+func TestPlanSyncIgnoresChangesThatWereUndone(t *testing.T) {
+	s := newTestService(t)
+	definitions := []models.CouponDefinition{{Key: "spring", Path: "spring.yaml", Coupon: models.Coupon{
+		Type:    models.CartWise,
+		Details: map[string]interface{}{"threshold": 100, "discount": 10},
+	}}}
+	plan, err := s.PlanSync(definitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ApplySync(plan); err != nil {
+		t.Fatal(err)
+	}
+	coupons, err := s.repo.GetAllCoupons()
+	if err != nil || len(coupons) != 1 {
+		t.Fatalf("coupons after sync = %v, %v; want one", coupons, err)
+	}
+
+	paused, err := s.PauseCoupon(coupons[0].ID, coupons[0].Version, "ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ResumeCoupon(paused.ID, paused.Version, "ops"); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err = s.PlanSync(definitions); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Drift) != 0 {
+		t.Fatalf("drift = %+v, want none", plan.Drift)
+	}
+	if len(plan.Changes) != 0 || plan.Unchanged != 1 {
+		t.Fatalf("plan has %d changes and %d unchanged, want 0 and 1", len(plan.Changes), plan.Unchanged)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"coupon-api/models"
+	"coupon-api/services"
+)
+
+const syncUsage = `usage: coupon-api sync plan|apply <dir>
+
+Reconciles coupons with the YAML/JSON definitions in <dir>. "plan" prints
+what would change; "apply" prints the plan and then makes the changes.
+Both open the data files themselves, so with the JSON backend the server
+must be stopped first.`
+
+// runSync runs the sync subcommand and returns the exit code.
+func runSync(service services.CouponService, args []string) int {
+	if len(args) != 2 || (args[0] != "plan" && args[0] != "apply") {
+		fmt.Fprintln(os.Stderr, syncUsage)
+		return 2
+	}
+	definitions, err := services.LoadCouponDefinitions(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	plan, err := service.PlanSync(definitions)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printPlan(os.Stdout, plan)
+	if args[0] == "plan" || len(plan.Changes) == 0 {
+		return 0
+	}
+
+	applied, err := service.ApplySync(plan)
+	fmt.Printf("\nApplied %d of %d changes.\n", applied, len(plan.Changes))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printPlan(w io.Writer, plan *models.SyncPlan) {
+	symbols := map[models.SyncAction]string{models.SyncCreate: "+", models.SyncUpdate: "~", models.SyncArchive: "-"}
+	counts := make(map[models.SyncAction]int)
+	for _, change := range plan.Changes {
+		counts[change.Action]++
+		switch change.Action {
+		case models.SyncCreate:
+			description := string(change.Coupon.Type)
+			if change.Coupon.Code != "" {
+				description += " " + change.Coupon.Code
+			}
+			fmt.Fprintf(w, "%s %s %s (%s)\n", symbols[change.Action], change.Action, change.Key, description)
+		default:
+			fmt.Fprintf(w, "%s %s %s (coupon %d)\n", symbols[change.Action], change.Action, change.Key, change.CouponID)
+		}
+		printFieldChanges(w, change.Changes)
+	}
+	for _, drift := range plan.Drift {
+		actor := drift.Actor
+		if actor == "" {
+			actor = "unknown"
+		}
+		fmt.Fprintf(w, "! drift %s (coupon %d): changed outside sync, now at version %d, last by %s\n", drift.Key, drift.CouponID, drift.Version, actor)
+		printFieldChanges(w, drift.Changes)
+	}
+	fmt.Fprintf(w, "Plan: %d to create, %d to update, %d to archive, %d unchanged, %d drifted.\n",
+		counts[models.SyncCreate], counts[models.SyncUpdate], counts[models.SyncArchive], plan.Unchanged, len(plan.Drift))
+}
+
+func printFieldChanges(w io.Writer, changes []models.FieldChange) {
+	for _, change := range changes {
+		from, _ := json.Marshal(change.From)
+		to, _ := json.Marshal(change.To)
+		fmt.Fprintf(w, "    %s: %s -> %s\n", change.Field, from, to)
+	}
+}